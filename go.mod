@@ -15,12 +15,14 @@ require (
 	gopkg.in/yaml.v3 v3.0.1
 )
 
-require github.com/gin-contrib/static v1.1.3
+require (
+	github.com/adhocore/gronx v1.19.5
+	github.com/gin-contrib/static v1.1.3
+	github.com/go-co-op/gocron/v2 v2.15.0
+)
 
 require (
-	github.com/adhocore/gronx v1.19.5 // indirect
 	github.com/go-co-op/gocron v1.37.0 // indirect
-	github.com/go-co-op/gocron/v2 v2.15.0 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/jonboulle/clockwork v0.4.0 // indirect
 	github.com/robfig/cron/v3 v3.0.1 // indirect
@@ -0,0 +1,53 @@
+package backup
+
+import (
+	"errors"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/cephsupport"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/replication"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/status"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/util"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/zfssupport"
+)
+
+// moveBase makes snapName (which was just copied, so exists on both sides) the replication base of the image: the RBD
+// snapshot is protected, and the ZFS snapshot is held with the job's hold tag. The previous base is only released once
+// the new one is in place on both sides, see replication.MoveBase. If holdBase is disabled, any existing hold and
+// protection are released instead. This runs before pruning, so that the previous base can be pruned straight away.
+func (t *ImageBackupTask) moveBase(cephImage *cephsupport.CephImageView, zv *zfssupport.ZvolDestination, snapName string) error {
+	if !t.holdBase {
+		return t.releaseBase(cephImage, zv)
+	}
+	t.log.SetStatus(status.MakeStatus(status.Finishing, "Holding replication base"))
+	previous, err := replication.MoveBase(cephImage, zv, snapName, t.holdTag)
+	if previous != "" && previous != snapName {
+		t.log.Log("Moved replication base from %v to %v", previous, snapName)
+	}
+	if err != nil {
+		return err
+	}
+	t.log.SetExtraData("replicationBase", snapName)
+	return nil
+}
+
+// releaseBase releases the hold and protection placed by moveBase, if there are any
+func (t *ImageBackupTask) releaseBase(cephImage *cephsupport.CephImageView, zv *zfssupport.ZvolDestination) error {
+	var errs []error
+	err := zv.ReleaseHolds(t.holdTag, "")
+	if err != nil {
+		errs = append(errs, err)
+	}
+	previous, err := cephImage.ClearBase(t.holdTag)
+	if err != nil {
+		errs = append(errs, err)
+	} else if previous != "" {
+		t.log.Log("Releasing replication base %v, since holdBase is disabled", previous)
+		err = cephImage.UnprotectBase(previous)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return util.Wrap("error releasing replication base", errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package backup
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// runHook runs a hook command (see config.HooksConfig) with /bin/sh. An empty command is a no-op. The command's output
+// is logged by the image task.
+func (t *ImageBackupTask) runHook(hookName string, command string, extraEnv ...string) error {
+	if command == "" {
+		return nil
+	}
+	t.log.Log("Running %v hook: %v", hookName, command)
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"CTZ_JOB="+t.jobId,
+		"CTZ_POOL="+t.poolName,
+		"CTZ_NAMESPACE="+t.spec.namespace,
+		"CTZ_IMAGE="+t.spec.name,
+	)
+	cmd.Env = append(cmd.Env, extraEnv...)
+	output, err := cmd.CombinedOutput()
+	if len(output) > 0 {
+		t.log.Log("%v hook output: %v", hookName, strings.TrimSuffix(string(output), "\n"))
+	}
+	if err != nil {
+		t.log.Warn("%v hook failed: %v", hookName, err)
+		return err
+	}
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/ceph/go-ceph/rbd"
 	"github.com/mattventura/ceph-to-zfs/pkg/ctz/cephsupport"
 	"github.com/mattventura/ceph-to-zfs/pkg/ctz/config"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/extents"
 	"github.com/mattventura/ceph-to-zfs/pkg/ctz/logging"
 	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
 	"github.com/mattventura/ceph-to-zfs/pkg/ctz/pruning"
@@ -25,18 +26,53 @@ import (
 	"unsafe"
 )
 
+// imageSpec identifies an RBD image within a pool
+type imageSpec struct {
+	// namespace is the RBD namespace of the image. The default namespace is represented by the empty string.
+	namespace string
+	name      string
+}
+
+// String formats the spec as "namespace/image", or just "image" for the default namespace.
+func (s imageSpec) String() string {
+	if s.namespace == "" {
+		return s.name
+	}
+	return s.namespace + "/" + s.name
+}
+
+// DatasetPath is the path of the zvol relative to the job's zfsDestination. This is String() with any characters that
+// ZFS does not allow escaped, see zfssupport.EscapeNamePath.
+func (s imageSpec) DatasetPath() string {
+	return zfssupport.EscapeNamePath(s.String())
+}
+
 // ImageBackupTask represents the backup process for a single image (one RBD image to one ZVOL)
 type ImageBackupTask struct {
-	imageName  string
-	cephConfig *config.CephClusterConfig
-	srcPruner  pruning.Pruner[*models.CephSnapshot]
-	rcvPruner  pruning.Pruner[*zfssupport.ZvolSnapshot]
-	poolName   string
-	ioctx      *rados.IOContext
-	zfsContext *zfssupport.ZfsContext
-	log        *logging.JobStatusLogger
-	mt         *task.ManagedTask
-	finalData  *finalData
+	spec        imageSpec
+	jobId       string
+	cephConfig  *config.CephClusterConfig
+	imageConfig *config.ImageConfig
+	copyOptions config.CopyOptions
+	spaceCheck  *config.SpaceCheckConfig
+	poolName    string
+	ioctx       *rados.IOContext
+	zfsContext  *zfssupport.ZfsContext
+	log         *logging.JobStatusLogger
+	mt          *task.ManagedTask
+	finalData   *finalData
+	// pruneResult is set by a successful prune-only run, see Prune
+	pruneResult *pruneResult
+	space       *models.SpaceUsage
+	// holdBase and holdTag control the hold on the replication base, see moveBase
+	holdBase bool
+	holdTag  string
+	// reservation is shared with the other images of the pool, and reservedBytes is this image's share of it, see
+	// checkSpace
+	reservation   *spaceReservation
+	reservedBytes uint64
+	// volumes is shared with the other images of the pool, see volumeCache
+	volumes *volumeCache
 }
 
 type finalData struct {
@@ -46,28 +82,49 @@ type finalData struct {
 }
 
 func NewImageBackupTask(
-	imageName string,
+	spec imageSpec,
 	cephConfig *config.CephClusterConfig,
 	poolname string,
 	zfsContext *zfssupport.ZfsContext,
 	parentLog *logging.JobStatusLogger,
 	jobConfig *config.RbdPoolJobProcessedConfig,
+	imageConfig *config.ImageConfig,
+	reservation *spaceReservation,
+	volumes *volumeCache,
 ) *ImageBackupTask {
-	log := parentLog.MakeOrReplaceChild(logging.LoggerKey(imageName), true)
 	out := &ImageBackupTask{
-		imageName: imageName,
+		spec:        spec,
+		jobId:       jobConfig.Id,
+		copyOptions: jobConfig.Copy,
+		spaceCheck:  jobConfig.SpaceCheck,
+		holdBase:    jobConfig.HoldBase,
+		holdTag:     jobConfig.HoldTag,
+		reservation: reservation,
+		volumes:     volumes,
 		//ioctx:      ioctx,
 		cephConfig: cephConfig,
 		poolName:   poolname,
 		zfsContext: zfsContext,
-		log:        log,
-		srcPruner:  jobConfig.SrcPruning,
-		rcvPruner:  jobConfig.RcvPruning,
 	}
+	log := parentLog.MakeOrReplaceChild(logging.LoggerKey(out.Id()), true)
+	out.log = log
 	out.mt = task.NewManagedTask(log, out.reset, out.run)
+	out.setImageConfig(imageConfig)
 	return out
 }
 
+// setImageConfig replaces the effective configuration for this image. The pool task calls this on every prep, since
+// the overrides which apply to an image can change along with its metadata.
+func (t *ImageBackupTask) setImageConfig(imageConfig *config.ImageConfig) {
+	t.imageConfig = imageConfig
+	t.log.SetDetailData("effectiveConfig", imageConfig)
+}
+
+// Priority is the effective priority of this image, see config.RbdPoolJobProcessedConfig
+func (t *ImageBackupTask) Priority() int {
+	return t.imageConfig.Priority
+}
+
 func (t *ImageBackupTask) StatusLog() *logging.JobStatusLogger {
 	return t.log
 }
@@ -78,12 +135,16 @@ func (t *ImageBackupTask) Children() []task.Task {
 }
 
 func (t *ImageBackupTask) Label() string {
-	return t.imageName
+	return t.spec.String()
 }
 
 func (t *ImageBackupTask) Id() string {
 	// TODO: I can't find a concrete source for what characters are allowed in an RBD image name
-	return t.imageName
+	// The ID is used as a path component in the web API, so it can't contain a slash.
+	if t.spec.namespace == "" {
+		return t.spec.name
+	}
+	return t.spec.namespace + ":" + t.spec.name
 }
 
 func (t *ImageBackupTask) Run() error {
@@ -100,16 +161,70 @@ func (t *ImageBackupTask) Run() error {
 
 func (t *ImageBackupTask) reset() error {
 	t.finalData = nil
+	t.pruneResult = nil
+	// Detail data was cleared by the reset, but the config and space usage are still relevant
+	t.log.SetDetailData("effectiveConfig", t.imageConfig)
+	if t.space != nil {
+		t.log.SetExtraData("space", t.space)
+	}
 	return nil
 }
 
-func (t *ImageBackupTask) run() error {
+// maxCopyChunk is the largest amount of data which is read from Ceph at once
+const maxCopyChunk = 4 * 1024 * 1024
+
+// discard trims a range of a block device
+func discard(file *os.File, offset uint64, length uint64) error {
+	rangeBytes := []byte{
+		byte(offset), byte(offset >> 8), byte(offset >> 16), byte(offset >> 24),
+		byte(offset >> 32), byte(offset >> 40), byte(offset >> 48), byte(offset >> 56),
+		byte(length), byte(length >> 8), byte(length >> 16), byte(length >> 24),
+		byte(length >> 32), byte(length >> 40), byte(length >> 48), byte(length >> 56),
+	}
+
+	_, _, errno := unix.Syscall(
+		unix.SYS_IOCTL,
+		file.Fd(),
+		uintptr(unix.BLKDISCARD),
+		uintptr(unsafe.Pointer(&rangeBytes[0])),
+	)
+	if errno != 0 {
+		return errors.New("Syscall error: " + errno.Error())
+	}
+	return nil
+}
+
+func (t *ImageBackupTask) run() (err error) {
 	var bytesWritten uint64
 	var bytesTrimmed uint64
 
-	// Snapshot name convention: ctz-YYYY-MM-dd-HH:mm:ss
-	// TODO make this configurable
-	snapName := "ctz-" + time.Now().Format("2006-01-02-15:04:05")
+	// Snapshot name convention: ctz-YYYY-MM-dd-HH:mm:ss by default, see config.DefaultSnapshotTemplate
+	snapName, err := t.imageConfig.SnapshotTemplate.Render(config.SnapshotTemplateData{
+		Time:      time.Now(),
+		Job:       t.jobId,
+		Pool:      t.poolName,
+		Namespace: t.spec.namespace,
+		Image:     t.spec.name,
+	})
+	if err != nil {
+		return util.Wrap("error generating snapshot name", err)
+	}
+	hooks := t.imageConfig.Hooks
+	if hooks == nil {
+		hooks = &config.HooksConfig{}
+	}
+	snapEnv := "CTZ_SNAPSHOT=" + snapName
+	defer func() {
+		result := "success"
+		var deferred *task.DeferredError
+		if errors.As(err, &deferred) {
+			result = "deferred"
+		} else if err != nil {
+			result = "failure"
+		}
+		// The result of the backup takes priority over the result of the hook
+		_ = t.runHook("postBackup", hooks.PostBackup, snapEnv, "CTZ_RESULT="+result)
+	}()
 
 	t.log.SetStatus(status.SimpleStatus(status.Preparing))
 	t.log.SetExtraData("snapName", snapName)
@@ -128,12 +243,18 @@ func (t *ImageBackupTask) run() error {
 	if err != nil {
 		return util.Wrap("error opening IOContext", err)
 	}
-	img, err := rbd.OpenImage(context, t.imageName, "")
+	context.SetNamespace(t.spec.namespace)
+	img, err := rbd.OpenImage(context, t.spec.name, "")
 	if err != nil {
 		return util.Wrap("error opening image", err)
 	}
 	defer img.Close()
-	cephImage := cephsupport.NewCephImageView(img)
+	cephImage := cephsupport.NewCephImageView(context, img)
+	imageId, err := img.GetId()
+	if err != nil {
+		return util.Wrap("error getting image ID", err)
+	}
+	t.log.SetExtraData("rbdImageId", imageId)
 
 	t.log.SetStatus(status.MakeStatus(status.Preparing, fmt.Sprintf("Creating RBD snapshot %v", snapName)))
 
@@ -144,10 +265,18 @@ func (t *ImageBackupTask) run() error {
 	}
 	t.log.Log("Ceph image size: %v", size)
 	// Snapshot the ceph pool
+	err = t.runHook("preSnapshot", hooks.PreSnapshot, snapEnv)
+	if err != nil {
+		return util.Wrap("preSnapshot hook failed", err)
+	}
 	err = cephImage.SnapAndActivate(snapName)
+	hookErr := t.runHook("postSnapshot", hooks.PostSnapshot, snapEnv)
 	if err != nil {
 		return util.Wrap("error preparing ceph image", err)
 	}
+	if hookErr != nil {
+		return util.Wrap("postSnapshot hook failed", hookErr)
+	}
 	//// Also check block size
 	// XXX this doesn't work - object size != block size
 	//blockSize, err := cephImage.ObjSize()
@@ -159,12 +288,42 @@ func (t *ImageBackupTask) run() error {
 	zplog := t.log.MakeOrReplaceChild("zfsprep", true)
 
 	// TODO: this isn't very much a "prep" step
-	zv, err := t.zfsContext.PrepareChild(t.Label(), size, zplog)
+	err = t.followRename(imageId)
+	if err != nil {
+		wrapped := util.Wrap("error following image rename", err)
+		zplog.SetStatusByError(wrapped)
+		return wrapped
+	}
+	err = t.checkDatasetName()
+	if err != nil {
+		zplog.SetStatusByError(err)
+		return err
+	}
+	zvolProps := t.imageConfig.ZvolProperties.Properties()
+	zv, err := t.zfsContext.PrepareChild(t.spec.DatasetPath(), size, zvolProps, zplog)
 	if err != nil {
 		wrapped := util.Wrap("error preparing zfs dataset", err)
 		zplog.SetStatusByError(wrapped)
 		return wrapped
 	}
+	// Existing zvols aren't changed to match the config (some properties can't be changed anyway), just reported
+	drift, err := zv.PropertyDrift(zvolProps)
+	if err != nil {
+		return util.Wrap("error checking zvol properties", err)
+	}
+	for _, d := range drift {
+		t.log.Log("WARNING: zvol property %v is '%v', but the config says '%v'", d.Property, d.Actual, d.Expected)
+	}
+	t.log.SetExtraData("propertyDriftCount", len(drift))
+	t.log.SetDetailData("propertyDrift", drift)
+	err = t.tagImageId(zv, imageId)
+	if err != nil {
+		return err
+	}
+	err = t.tagImageName(zv)
+	if err != nil {
+		return err
+	}
 	// Find the most recent models snapshot between the two, using the name as the key
 	zvolSnaps, err := zv.Snapshots()
 	if err != nil {
@@ -192,13 +351,59 @@ func (t *ImageBackupTask) run() error {
 		t.log.Log("No existing ZFS snapshot")
 		mostRecentName = ""
 	} else {
-		// Force-revert the ZFS side to the most recent models snapshot
 		mostRecentName = mostRecentCommon.Name()
 		t.log.Log("Most recent models snapshot: %v", mostRecentName)
+	}
+
+	t.log.SetStatus(status.MakeStatus(status.Preparing, "Scanning for changes"))
+	// Collect the changed extents first, so that they can be aligned to the zvol's block size. Unaligned writes would
+	// cause read-modify-write cycles on the zvol, and inflate snapshot space.
+	var changed []extents.Extent
+	err = cephImage.DiffIter(mostRecentName, func(offset uint64, length uint64, exists int, _ interface{}) int {
+		changed = append(changed, extents.Extent{Offset: offset, Length: length, Data: exists > 0})
+		return 0
+	})
+	if err != nil {
+		return util.Wrap("error listing changed extents", err)
+	}
+	blockSizeProp, err := zv.GetProperty("volblocksize")
+	if err != nil {
+		return util.Wrap("error getting volblocksize", err)
+	}
+	blockSize, err := util.ParseSize(blockSizeProp)
+	if err != nil {
+		return util.Wrap("error getting volblocksize", err)
+	}
+	aligned := extents.Align(changed, blockSize, size, maxCopyChunk)
+	unalignedStats := extents.Sum(changed)
+	alignedStats := extents.Sum(aligned)
+	t.log.Log("Changed extents: %v (%v bytes), aligned to %v byte blocks: %v (%v bytes)", len(changed), unalignedStats.DataBytes, blockSize, len(aligned), alignedStats.DataBytes)
+	t.log.SetExtraData("bytesWrittenUnaligned", unalignedStats.DataBytes)
+	t.log.SetExtraData("bytesToWrite", alignedStats.DataBytes)
+
+	// Nothing has been written to the zvol yet, so this is the last point at which it is safe to give up
+	err = t.checkSpace(zv, alignedStats.DataBytes)
+	defer t.releaseSpace()
+	var deferred *task.DeferredError
+	if errors.As(err, &deferred) {
+		t.log.Log("Deferring backup: %v", deferred.Reason)
+		// The snapshot would not be replicated, so don't leave it lying around
+		discardErr := cephImage.DiscardActiveSnapshot(snapName)
+		if discardErr != nil {
+			return util.Wrap("error discarding snapshot of deferred backup", discardErr)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if mostRecentCommon != nil {
+		// Force-revert the ZFS side to the most recent models snapshot
 		t.log.SetStatus(status.MakeStatus(status.Preparing, fmt.Sprintf("Reverting ZFS to %v", mostRecentName)))
 		err = zv.RevertTo(mostRecentCommon)
 		if err != nil {
-			return util.WrapFmt(err, "error reverting ZFS to %v@%v", t.imageName, mostRecentName)
+			return util.WrapFmt(err, "error reverting ZFS to %v@%v", t.spec, mostRecentName)
 		}
 	}
 	var mostRecentNameFmt string
@@ -212,10 +417,14 @@ func (t *ImageBackupTask) run() error {
 	node := zv.DevNode()
 	t.log.SetStatus(status.MakeStatus(status.Preparing, "Opening zvol device node"))
 	var file *os.File
+	openFlags := os.O_WRONLY
+	if t.copyOptions.CompareBeforeWrite {
+		openFlags = os.O_RDWR
+	}
 	for tries := 5; tries > 0; {
 		tries--
 		var fileErr error
-		file, fileErr = os.OpenFile(node, os.O_WRONLY, 600)
+		file, fileErr = os.OpenFile(node, openFlags, 600)
 		if fileErr != nil {
 			if tries <= 0 {
 				return util.WrapFmt(fileErr, "Failed to open Zvol device %v", node)
@@ -235,54 +444,56 @@ func (t *ImageBackupTask) run() error {
 	t.log.SetStatus(status.MakeStatus(status.InProgress, "Copying data"))
 
 	// TODO: allow buffering between the reads and writes
-	var diffErr error
-	err = cephImage.DiffIter(mostRecentName, func(offset uint64, length uint64, exists int, _ interface{}) int {
-		if exists > 0 {
-			bytes, errInner := cephImage.Read(offset, length)
-			if errInner != nil {
-				diffErr = errInner
-				return 1
+	var savings extents.Savings
+	for _, extent := range aligned {
+		toApply := []extents.Extent{extent}
+		if extent.Data {
+			bytes, err := cephImage.Read(extent.Offset, extent.Length)
+			if err != nil {
+				return util.Wrap("error copying data", err)
 			}
-			_, errInner = file.WriteAt(bytes, int64(offset))
-			if errInner != nil {
-				diffErr = errInner
-				return 1
+			var existing []byte
+			if t.copyOptions.CompareBeforeWrite {
+				existing = make([]byte, extent.Length)
+				_, err = file.ReadAt(existing, int64(extent.Offset))
+				if err != nil {
+					return util.Wrap("error reading existing data", err)
+				}
 			}
-			bytesWritten += length
-			t.log.SetExtraData("bytesWritten", bytesWritten)
-			return 0
-		} else {
-
-			rangeBytes := []byte{
-				byte(offset), byte(offset >> 8), byte(offset >> 16), byte(offset >> 24),
-				byte(offset >> 32), byte(offset >> 40), byte(offset >> 48), byte(offset >> 56),
-				byte(length), byte(length >> 8), byte(length >> 16), byte(length >> 24),
-				byte(length >> 32), byte(length >> 40), byte(length >> 48), byte(length >> 56),
+			var saved extents.Savings
+			toApply, saved = extents.Refine(extent, bytes, existing, blockSize, t.copyOptions.ZeroDetect)
+			savings.Add(saved)
+			for _, part := range toApply {
+				if !part.Data {
+					continue
+				}
+				start := part.Offset - extent.Offset
+				_, err = file.WriteAt(bytes[start:start+part.Length], int64(part.Offset))
+				if err != nil {
+					return util.Wrap("error copying data", err)
+				}
+				bytesWritten += part.Length
 			}
-
-			_, _, errno := unix.Syscall(
-				unix.SYS_IOCTL,
-				file.Fd(),
-				uintptr(unix.BLKDISCARD),
-				uintptr(unsafe.Pointer(&rangeBytes[0])),
-			)
-			if errno != 0 {
-				diffErr = util.Wrap("error copying data", errors.New("Syscall error: "+errno.Error()))
-				return 1
+		}
+		for _, part := range toApply {
+			if part.Data {
+				continue
 			}
-			t.log.SetExtraData("bytesTrimmed", bytesTrimmed)
-			bytesTrimmed += length
-			return 0
+			err = discard(file, part.Offset, part.Length)
+			if err != nil {
+				return util.Wrap("error copying data", err)
+			}
+			bytesTrimmed += part.Length
 		}
-	})
+		t.log.SetExtraData("bytesWritten", bytesWritten)
+		t.log.SetExtraData("bytesTrimmed", bytesTrimmed)
+		t.log.SetExtraData("bytesSavedZero", savings.Zero)
+		t.log.SetExtraData("bytesSavedUnchanged", savings.Unchanged)
+	}
 	t.log.SetExtraData("bytesWritten", bytesWritten)
 	t.log.SetExtraData("bytesTrimmed", bytesTrimmed)
-
-	if err != nil {
-		return util.Wrap("error copying data", err)
-	}
-	if diffErr != nil {
-		return util.Wrap("error copying data", diffErr)
+	if savings.Zero > 0 || savings.Unchanged > 0 {
+		t.log.Log("Saved %v bytes by zero detection and %v bytes by skipping unchanged data", savings.Zero, savings.Unchanged)
 	}
 
 	t.log.SetStatus(status.MakeStatus(status.Finishing, "Flushing"))
@@ -298,66 +509,21 @@ func (t *ImageBackupTask) run() error {
 	if err != nil {
 		return util.Wrap("error creating snapshot", err)
 	}
-	t.log.SetStatus(status.MakeStatus(status.Finishing, "Planning snapshot pruning"))
-	cephSnaps, err := cephImage.Snapshots()
+	// The data has been copied, so a failure here is only a warning, and doesn't fail the backup. The previous base is
+	// still in place in that case.
+	err = t.moveBase(cephImage, zv, snapName)
 	if err != nil {
-		return err
+		t.log.Warn("Error moving replication base: %v", err)
 	}
-	srcDestroy := t.srcPruner.Destroy(cephSnaps)
-	srcSnaps := len(cephSnaps)
-	srcToDestroy := len(srcDestroy)
-	srcToKeep := srcSnaps - srcToDestroy
-	t.log.SetExtraData("srcSnaps", srcSnaps)
-	t.log.SetExtraData("srcSnapsToDestroy", srcToDestroy)
-	t.log.SetExtraData("srcSnapsToKeep", srcToKeep)
-
-	// Refresh the list so that it includes our new snapshots
-	zvolSnaps, err = zv.Snapshots()
+	pruned, err := t.prune(cephImage, zv, status.Finishing, false)
 	if err != nil {
 		return err
 	}
-	rcvDestroy := t.rcvPruner.Destroy(zvolSnaps)
-	rcvSnaps := len(rcvDestroy)
-	rcvToDestroy := len(rcvDestroy)
-	rcvToKeep := rcvSnaps - rcvToDestroy
-	t.log.SetExtraData("rcvSnaps", rcvSnaps)
-	t.log.SetExtraData("rcvSnapsToDestroy", rcvToDestroy)
-	t.log.SetExtraData("rcvSnapsToKeep", rcvToKeep)
-
-	snapReport := t.makeSnapshotReport(cephSnaps, srcDestroy, zvolSnaps, rcvDestroy)
-	t.log.SetDetailData("snapshotReport", snapReport)
-	for _, snapshot := range snapReport.Snapshots {
-		t.log.Log(snapshot.String())
-	}
-
-	t.log.SetStatus(status.MakeStatus(status.Finishing, fmt.Sprintf("Pruning %v ceph snapshots", srcToDestroy)))
-	pruneErrors := []error{}
-	cephPruned := 0
-	for _, snapshot := range srcDestroy {
-		t.log.Log("Pruning ceph snapshot %v", snapshot.Name())
-		err := cephImage.DeleteSnapshot(snapshot)
-		if err != nil {
-			pruneErrors = append(pruneErrors, err)
-		} else {
-			cephPruned++
-		}
-	}
-	t.log.SetStatus(status.MakeStatus(status.Finishing, fmt.Sprintf("Pruned %v ceph snapshots", cephPruned)))
 
-	t.log.SetStatus(status.MakeStatus(status.Finishing, fmt.Sprintf("Pruning %v ZFS snapshots", rcvToDestroy)))
-	zfsPruned := 0
-	for _, snapshot := range rcvDestroy {
-		t.log.Log("Pruning ZFS snapshot %v", snapshot.Name())
-		err := zv.DeleteSnapshot(snapshot)
-		if err != nil {
-			pruneErrors = append(pruneErrors, err)
-		} else {
-			zfsPruned++
-		}
-	}
-	t.log.SetStatus(status.MakeStatus(status.Finishing, fmt.Sprintf("Pruned %v ZFS snapshots", zfsPruned)))
-	if len(pruneErrors) > 0 {
-		return errors.Join(pruneErrors...)
+	t.log.SetStatus(status.MakeStatus(status.Finishing, "Collecting space usage"))
+	t.collectSpaceUsage(cephImage, zv, size)
+	if len(pruned.errors) > 0 {
+		return errors.Join(pruned.errors...)
 	}
 
 	t.finalData = &finalData{
@@ -372,6 +538,8 @@ var _ task.Task = &ImageBackupTask{}
 
 type SnapshotReport struct {
 	Snapshots []SnapshotReportElement `json:"snapshots"`
+	// DryRun indicates that the snapshots marked as pruned were not actually deleted
+	DryRun bool `json:"dryRun,omitempty"`
 }
 
 type UnixTime time.Time
@@ -388,6 +556,58 @@ var _ json.Marshaler = &UnixTime{}
 type SnapshotReportInner struct {
 	When   *UnixTime `json:"when"`
 	Pruned bool      `json:"pruned"`
+	// Protected and Children are only reported for source snapshots
+	Protected bool `json:"protected,omitempty"`
+	Children  int  `json:"children,omitempty"`
+	// InUse is the reason that a snapshot which would otherwise have been pruned was kept, see
+	// models.InUseSnapshot
+	InUse string `json:"inUse,omitempty"`
+	// Quarantined snapshots have been chosen for pruning, but won't be destroyed until PruneAfter, see
+	// pruning.QuarantinePlan
+	Quarantined bool      `json:"quarantined,omitempty"`
+	PruneAfter  *UnixTime `json:"pruneAfter,omitempty"`
+	// Kept snapshots were released from quarantine by hand, so pruning leaves them alone, see
+	// models.QuarantinedSnapshot
+	Kept bool `json:"kept,omitempty"`
+	// Reasons are the pruning rules which kept the snapshot, or why it was chosen for pruning, see pruning.Reasons
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// state describes the snapshot on one side, for SnapshotReportElement.String
+func (i *SnapshotReportInner) state() string {
+	switch {
+	case i == nil:
+		return "Absent"
+	case i.Pruned:
+		return "Pruned"
+	case i.Quarantined:
+		return fmt.Sprintf("Quarantined (until %v)", time.Time(*i.PruneAfter))
+	case i.Kept:
+		return "Kept (released from quarantine)"
+	case i.InUse != "":
+		return fmt.Sprintf("Kept (in use: %v)", i.InUse)
+	default:
+		return "Present"
+	}
+}
+
+// describe is state, followed by the reasons for it
+func (i *SnapshotReportInner) describe() string {
+	if i == nil || len(i.Reasons) == 0 {
+		return i.state()
+	}
+	return fmt.Sprintf("%v [%v]", i.state(), strings.Join(i.Reasons, "; "))
+}
+
+// markQuarantined sets Quarantined and PruneAfter if the snapshot is in the given map
+func (i *SnapshotReportInner) markQuarantined(name string, quarantine map[string]time.Time) {
+	until, found := quarantine[name]
+	if !found {
+		return
+	}
+	pruneAfter := UnixTime(until)
+	i.Quarantined = true
+	i.PruneAfter = &pruneAfter
 }
 
 type SnapshotReportElement struct {
@@ -413,26 +633,34 @@ func (e *SnapshotReportElement) String() string {
 	sb.WriteString(": (")
 	sb.WriteString(e.When().String())
 	sb.WriteString("). Sender: ")
-	if e.Source != nil {
-		if e.Source.Pruned {
-			sb.WriteString("Pruned")
-		} else {
-			sb.WriteString("Present")
-		}
-	} else {
-		sb.WriteString("Absent")
-	}
+	sb.WriteString(e.Source.describe())
 	sb.WriteString(", Receiver: ")
-	if e.Receiver != nil {
-		if e.Receiver.Pruned {
-			sb.WriteString("Pruned")
+	sb.WriteString(e.Receiver.describe())
+	return sb.String()
+}
+
+// excludeInUse removes snapshots which can't currently be deleted from the destroy list, rather than letting the
+// deletion fail. It returns the remaining snapshots, and the reasons for the excluded ones, keyed by snapshot name.
+// side ("ceph" or "ZFS") is used in log messages, and warn logs a warning for each excluded snapshot.
+func excludeInUse[T models.InUseSnapshot](t *ImageBackupTask, side string, warn bool, destroy []T) ([]T, map[string]string) {
+	inUse := make(map[string]string)
+	out := make([]T, 0, len(destroy))
+	for _, snap := range destroy {
+		reason := snap.InUseReason()
+		if reason == "" {
+			out = append(out, snap)
+			continue
+		}
+		inUse[snap.Name()] = reason
+		// Snapshots released by hand are expected to be kept, so they aren't worth a warning
+		quarantined, ok := any(snap).(models.QuarantinedSnapshot)
+		if warn && !(ok && quarantined.Kept()) {
+			t.log.Warn("Not pruning %v snapshot %v: %v", side, snap.Name(), reason)
 		} else {
-			sb.WriteString("Present")
+			t.log.Log("Keeping %v snapshot %v: %v", side, snap.Name(), reason)
 		}
-	} else {
-		sb.WriteString("Absent")
 	}
-	return sb.String()
+	return out, inUse
 }
 
 //type snapshotReportInternalComp struct {
@@ -441,7 +669,9 @@ func (e *SnapshotReportElement) String() string {
 //	Rcv    models.Snapshot
 //}
 
-func (t *ImageBackupTask) makeSnapshotReport(srcSnaps []*models.CephSnapshot, srcDestroy []*models.CephSnapshot, rcvSnaps []*zfssupport.ZvolSnapshot, rcvDestroy []*zfssupport.ZvolSnapshot) *SnapshotReport {
+// makeSnapshotReport combines the snapshots on both sides by name. srcQuarantine and rcvQuarantine map the names of
+// quarantined snapshots to the end of their grace period, and srcReasons and rcvReasons explain the pruning decisions.
+func (t *ImageBackupTask) makeSnapshotReport(srcSnaps []*models.CephSnapshot, srcDestroy []*models.CephSnapshot, srcInUse map[string]string, srcQuarantine map[string]time.Time, srcReasons pruning.Reasons, rcvSnaps []*zfssupport.ZvolSnapshot, rcvDestroy []*zfssupport.ZvolSnapshot, rcvInUse map[string]string, rcvQuarantine map[string]time.Time, rcvReasons pruning.Reasons) *SnapshotReport {
 	elements := make(map[string]*SnapshotReportElement)
 	for _, snap := range srcSnaps {
 		name := snap.Name()
@@ -449,18 +679,28 @@ func (t *ImageBackupTask) makeSnapshotReport(srcSnaps []*models.CephSnapshot, sr
 		elements[name] = &SnapshotReportElement{
 			Name: name,
 			Source: &SnapshotReportInner{
-				When:   &when,
-				Pruned: false,
+				When:      &when,
+				Pruned:    false,
+				Protected: snap.Protected,
+				Children:  snap.Children,
+				InUse:     srcInUse[name],
+				Kept:      snap.Kept(),
+				Reasons:   srcReasons[name],
 			},
 		}
+		elements[name].Source.markQuarantined(name, srcQuarantine)
 	}
 	for _, snap := range rcvSnaps {
 		name := snap.Name()
 		when := UnixTime(snap.When())
 		rcv := &SnapshotReportInner{
-			When:   &when,
-			Pruned: false,
+			When:    &when,
+			Pruned:  false,
+			InUse:   rcvInUse[name],
+			Kept:    snap.Kept(),
+			Reasons: rcvReasons[name],
 		}
+		rcv.markQuarantined(name, rcvQuarantine)
 		existing, found := elements[name]
 		if found {
 			existing.Receiver = rcv
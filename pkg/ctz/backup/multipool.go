@@ -0,0 +1,146 @@
+package backup
+
+import (
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/cephsupport"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/config"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/logging"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/status"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/task"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/util"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/zfssupport"
+)
+
+// MultiPoolBackupTask is responsible for a job which covers several pools (a pool list or regex). The pools are
+// enumerated during prep, and each pool gets its own RbdPoolBackupTask, backing up to <zfsDestination>/<pool>.
+type MultiPoolBackupTask struct {
+	cephConfig *config.CephClusterConfig
+	jobConfig  *config.RbdPoolJobProcessedConfig
+	log        *logging.JobStatusLogger
+	children   []*RbdPoolBackupTask
+	childMap   map[string]*RbdPoolBackupTask
+	mt         *task.ManagedTask
+}
+
+func NewMultiPoolBackupTask(
+	jobConfig *config.RbdPoolJobProcessedConfig,
+	parentLog *logging.JobStatusLogger,
+) *MultiPoolBackupTask {
+	log := parentLog.MakeOrReplaceChild(logging.LoggerKey(jobConfig.Id), false)
+	out := &MultiPoolBackupTask{
+		cephConfig: jobConfig.ClusterConfig,
+		jobConfig:  jobConfig,
+		log:        log,
+		children:   []*RbdPoolBackupTask{},
+		childMap:   map[string]*RbdPoolBackupTask{},
+	}
+	out.mt = task.NewManagedTask(log, out.prep, out.run)
+	if jobConfig.Cron != nil {
+		log.SetFixedExtraData("cron", jobConfig.Cron)
+	}
+	if jobConfig.PruneCron != nil {
+		log.SetFixedExtraData("pruneCron", jobConfig.PruneCron)
+	}
+	return out
+}
+
+func (t *MultiPoolBackupTask) StatusLog() *logging.JobStatusLogger {
+	return t.log
+}
+
+func (t *MultiPoolBackupTask) Children() []task.Task {
+	return util.Map(t.children, func(in *RbdPoolBackupTask) task.Task {
+		return in
+	})
+}
+
+// prep enumerates the pools in the cluster, so pools which were created since the last prep are picked up.
+func (t *MultiPoolBackupTask) prep() error {
+	t.log.SetStatus(status.MakeStatus(status.Preparing, "Connecting to Ceph Cluster"))
+	conn, err := cephsupport.Connect(t.cephConfig)
+	if err != nil {
+		return err
+	}
+	defer func() { go conn.Shutdown() }()
+	t.log.SetStatus(status.MakeStatus(status.Preparing, "Enumerating Pools"))
+	pools, err := conn.ListPools()
+	if err != nil {
+		return util.Wrap("error listing pools", err)
+	}
+	var children []*RbdPoolBackupTask
+	var included []string
+	for _, pool := range pools {
+		if !t.jobConfig.MatchesPool(pool) {
+			continue
+		}
+		tsk := t.childMap[pool]
+		if tsk == nil {
+			poolConfig := t.jobConfig.ForPool(pool)
+			_, err := zfssupport.EnsureZfsContext(poolConfig.ZfsDestination)
+			if err != nil {
+				return err
+			}
+			tsk = newRbdPoolBackupTask(poolConfig, t.log, true)
+			t.childMap[pool] = tsk
+		}
+		children = append(children, tsk)
+		included = append(included, pool)
+	}
+	t.children = children
+	t.log.SetExtraData("space", t.SpaceUsage())
+
+	if len(children) == 0 {
+		t.log.SetStatus(status.MakeStatus(status.Failed, "No pools found to back up"))
+		return nil
+	}
+	t.log.Log("Included pools: %v", included)
+
+	t.log.SetStatus(status.MakeStatus(status.Preparing, "Preparing Children"))
+	_ = task.RunParallel(t.children, func(pt *RbdPoolBackupTask) error { return pt.Prepare() })
+	return nil
+}
+
+func (t *MultiPoolBackupTask) run() error {
+	t.log.SetStatus(status.MakeStatus(status.InProgress, "Running Children"))
+	_ = task.RunParallel(t.children, func(pt *RbdPoolBackupTask) error { return pt.Run() })
+	t.log.SetExtraData("space", t.SpaceUsage())
+	return nil
+}
+
+// Prune prunes every pool without backing them up, see RbdPoolBackupTask.Prune
+func (t *MultiPoolBackupTask) Prune(dryRun bool) error {
+	return t.mt.RunFunc(func() error {
+		t.log.SetStatus(status.MakeStatus(status.InProgress, "Pruning Children"))
+		_ = task.RunParallel(t.children, func(pt *RbdPoolBackupTask) error { return pt.Prune(dryRun) })
+		t.log.SetExtraData("space", t.SpaceUsage())
+		return nil
+	}, nil)
+}
+
+// ReleaseQuarantine releases quarantined snapshots in every pool, see RbdPoolBackupTask.ReleaseQuarantine
+func (t *MultiPoolBackupTask) ReleaseQuarantine(snapshot string) error {
+	return t.mt.RunFunc(func() error {
+		t.log.SetStatus(status.MakeStatus(status.InProgress, "Releasing Children"))
+		_ = task.RunParallel(t.children, func(pt *RbdPoolBackupTask) error { return pt.ReleaseQuarantine(snapshot) })
+		return nil
+	}, nil)
+}
+
+func (t *MultiPoolBackupTask) Run() error {
+	return t.mt.Run(nil)
+}
+
+func (t *MultiPoolBackupTask) Prepare() error {
+	return t.mt.Prepare()
+}
+
+func (t *MultiPoolBackupTask) Id() string {
+	return t.jobConfig.Id
+}
+
+func (t *MultiPoolBackupTask) Label() string {
+	return t.jobConfig.Label
+}
+
+var _ task.PreparableTask = &MultiPoolBackupTask{}
+var _ task.PrunableTask = &MultiPoolBackupTask{}
+var _ task.ReleasableTask = &MultiPoolBackupTask{}
@@ -0,0 +1,65 @@
+package backup
+
+import (
+	"fmt"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/util"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/zfssupport"
+)
+
+// checkDatasetName makes sure that the zvol at the image's (escaped) dataset path, if any, belongs to this image.
+//
+// Zvols created before names were escaped use the raw image name and have no name property. If such a zvol exists
+// under the raw name, it is renamed to the escaped name. A zvol without the name property at the escaped path is only
+// accepted if the escaped path is the same as the raw name, otherwise it belongs to an image whose raw name happened
+// to look like this image's escaped name.
+func (t *ImageBackupTask) checkDatasetName() error {
+	rawPath := t.spec.String()
+	path := t.spec.DatasetPath()
+	if path != rawPath {
+		t.log.Log("Image %v is stored in dataset %v", rawPath, path)
+	}
+	t.log.SetExtraData("dataset", t.zfsContext.Name()+"/"+path)
+	volumes, err := t.volumes.get()
+	if err != nil {
+		return err
+	}
+	if existing, found := volumes[path]; found {
+		name, err := existing.GetProperty(zfssupport.RbdImageNameProperty)
+		if err != nil {
+			return util.Wrap("error reading image name property", err)
+		}
+		if name == rawPath || ((name == "-" || name == "") && path == rawPath) {
+			return nil
+		}
+		if name == "-" || name == "" {
+			name = path
+		}
+		return fmt.Errorf("dataset %v is needed for image '%v', but it belongs to image '%v'", existing.Name(), rawPath, name)
+	}
+	if legacy, found := volumes[rawPath]; found && path != rawPath {
+		name, err := legacy.GetProperty(zfssupport.RbdImageNameProperty)
+		if err != nil {
+			return util.Wrap("error reading image name property", err)
+		}
+		if name != "-" && name != "" && name != rawPath {
+			return nil
+		}
+		newName := t.zfsContext.Name() + "/" + path
+		t.log.Log("Renaming %v to %v to escape the image name", legacy.Name(), newName)
+		t.volumes.invalidate()
+		return legacy.Rename(newName)
+	}
+	return nil
+}
+
+// tagImageName records the original image name on the zvol, see checkDatasetName
+func (t *ImageBackupTask) tagImageName(zv *zfssupport.ZvolDestination) error {
+	current, err := zv.GetProperty(zfssupport.RbdImageNameProperty)
+	if err != nil {
+		return util.Wrap("error reading image name property", err)
+	}
+	if current == t.spec.String() {
+		return nil
+	}
+	return zv.SetUserProperty(zfssupport.RbdImageNameProperty, t.spec.String())
+}
@@ -0,0 +1,237 @@
+package backup
+
+import (
+	"fmt"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/config"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/util"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/zfssupport"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Orphan is a zvol under the job's zfsDestination which does not correspond to any image currently included in the
+// job. These are reported in the pool task's detail data.
+type Orphan struct {
+	// Dataset is the full name of the zvol
+	Dataset string `json:"dataset"`
+	// Image is the name of the image that the zvol is a copy of
+	Image string `json:"image"`
+	// OrphanedSince is when the zvol was first found to be orphaned. Nil if it was only just discovered.
+	OrphanedSince *time.Time `json:"orphanedSince"`
+	// Action describes what was done (or will be done) with the orphan
+	Action string `json:"action"`
+
+	dest    *zfssupport.ZvolDestination
+	relPath string
+}
+
+// listOrphans compares the zvols under zfsContext with the dataset paths of the images that are to be backed up. Zvols tagged with the ID
+// of an included image are not orphans, since they will be renamed by the image task (see followRename). It also
+// returns any non-orphaned zvols which still carry the orphan property.
+func (t *RbdPoolBackupTask) listOrphans(zfsContext *zfssupport.ZfsContext, included []string, includedIds map[string]bool) (orphans []*Orphan, recovered []*zfssupport.ZvolDestination, err error) {
+	volumes, err := t.volumes.get()
+	if err != nil {
+		return nil, nil, err
+	}
+	since, err := zfsContext.GetPropertyRecursive(zfssupport.OrphanedSinceProperty)
+	if err != nil {
+		return nil, nil, util.Wrap("error reading orphan properties", err)
+	}
+	ids, err := zfsContext.GetPropertyRecursive(zfssupport.RbdImageIdProperty)
+	if err != nil {
+		return nil, nil, util.Wrap("error reading image ID properties", err)
+	}
+	archivePrefix := t.jobConfig.Orphans.ArchiveDataset + "/"
+	names, err := zfsContext.GetPropertyRecursive(zfssupport.RbdImageNameProperty)
+	if err != nil {
+		return nil, nil, util.Wrap("error reading image name properties", err)
+	}
+	for relPath, dest := range volumes {
+		unix, parseErr := strconv.ParseInt(since[dest.Name()], 10, 64)
+		if slices.Contains(included, relPath) {
+			if parseErr == nil {
+				recovered = append(recovered, dest)
+			}
+			continue
+		}
+		if includedIds[ids[dest.Name()]] {
+			continue
+		}
+		// If the archive dataset is below the destination, don't treat things which have already been archived as
+		// orphans.
+		if t.jobConfig.Orphans.ArchiveDataset != "" && strings.HasPrefix(dest.Name(), archivePrefix) {
+			continue
+		}
+		image := names[dest.Name()]
+		if image == "-" || image == "" {
+			image, err = zfssupport.UnescapeNamePath(relPath)
+			if err != nil {
+				// Not something that ctz created
+				image = relPath
+			}
+		}
+		orphan := &Orphan{
+			Dataset: dest.Name(),
+			Image:   image,
+			dest:    dest,
+			relPath: relPath,
+		}
+		if parseErr == nil {
+			when := time.Unix(unix, 0)
+			orphan.OrphanedSince = &when
+		}
+		orphan.Action = t.plannedOrphanAction(orphan)
+		orphans = append(orphans, orphan)
+	}
+	slices.SortFunc(orphans, func(a, b *Orphan) int {
+		return strings.Compare(a.Dataset, b.Dataset)
+	})
+	return orphans, recovered, nil
+}
+
+func (t *RbdPoolBackupTask) plannedOrphanAction(orphan *Orphan) string {
+	cfg := t.jobConfig.Orphans
+	switch cfg.Policy {
+	case config.OrphanPrune:
+		if orphan.OrphanedSince == nil {
+			return fmt.Sprintf("prune after %v", cfg.GracePeriod)
+		}
+		pruneAt := orphan.OrphanedSince.Add(cfg.GracePeriod)
+		if time.Now().Before(pruneAt) {
+			return fmt.Sprintf("prune after %v", pruneAt.Format(time.RFC3339))
+		}
+		return "prune"
+	case config.OrphanArchive:
+		if orphan.OrphanedSince == nil {
+			return fmt.Sprintf("archive after %v", cfg.GracePeriod)
+		}
+		archiveAt := orphan.OrphanedSince.Add(cfg.GracePeriod)
+		if time.Now().Before(archiveAt) {
+			return fmt.Sprintf("archive after %v", archiveAt.Format(time.RFC3339))
+		}
+		return "archive"
+	default:
+		return "keep"
+	}
+}
+
+// handleOrphans marks orphans with the time they were first seen, and applies the job's orphan policy. It also clears
+// the mark from zvols which are no longer orphaned (e.g. the image was re-included).
+func (t *RbdPoolBackupTask) handleOrphans() error {
+	zfsContext, err := zfssupport.ZfsContextByPath(t.jobConfig.ZfsDestination)
+	if err != nil {
+		return err
+	}
+	// An image which could not be opened may have been renamed, and without its ID there is no telling which zvol
+	// belongs to it, so nothing is treated as an orphan until every image can be opened again
+	if len(t.failedImages) > 0 {
+		t.log.Warn("Not handling orphans, since %v image(s) could not be opened", len(t.failedImages))
+		return nil
+	}
+	// The children may have created or renamed zvols since prep
+	t.volumes.reset(zfsContext)
+	included := util.Map(t.children, func(in *ImageBackupTask) string {
+		return in.spec.DatasetPath()
+	})
+	// Renames have already happened by now, so anything which is still in the wrong place is an orphan
+	orphans, recovered, err := t.listOrphans(zfsContext, included, nil)
+	if err != nil {
+		return err
+	}
+	for _, dest := range recovered {
+		t.log.Log("Zvol %v is no longer orphaned", dest.Name())
+		err = dest.ClearUserProperty(zfssupport.OrphanedSinceProperty)
+		if err != nil {
+			return util.WrapFmt(err, "error clearing orphan property on %v", dest.Name())
+		}
+	}
+	now := time.Now()
+	var errs []error
+	for _, orphan := range orphans {
+		if orphan.OrphanedSince == nil {
+			t.log.Log("Found new orphan %v", orphan.Dataset)
+			err = orphan.dest.SetUserProperty(zfssupport.OrphanedSinceProperty, strconv.FormatInt(now.Unix(), 10))
+			if err != nil {
+				errs = append(errs, util.WrapFmt(err, "error marking %v as orphaned", orphan.Dataset))
+				continue
+			}
+			orphan.OrphanedSince = &now
+		}
+		orphan.Action = t.plannedOrphanAction(orphan)
+		err = t.applyOrphanPolicy(orphan)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	t.log.SetDetailData("orphans", orphans)
+	t.log.SetExtraData("orphanCount", len(orphans))
+	if len(errs) > 0 {
+		return util.WrapFmt(errs[0], "%v error(s) handling orphans", len(errs))
+	}
+	return nil
+}
+
+func (t *RbdPoolBackupTask) applyOrphanPolicy(orphan *Orphan) error {
+	cfg := t.jobConfig.Orphans
+	switch cfg.Policy {
+	case config.OrphanPrune:
+		// Nothing is touched during the grace period, so that an image which is only excluded for a while (e.g. by a
+		// mistake in the include regex) can be backed up incrementally again
+		now := time.Now()
+		if now.Before(orphan.OrphanedSince.Add(cfg.GracePeriod)) {
+			return nil
+		}
+		// The image is gone, so the replication base is no longer needed, and the job's hold would stop it being pruned
+		err := orphan.dest.ReleaseHolds(t.jobConfig.HoldTag, "")
+		if err != nil {
+			return util.WrapFmt(err, "error releasing hold on orphan %v", orphan.Dataset)
+		}
+		snaps, err := orphan.dest.Snapshots()
+		if err != nil {
+			return util.WrapFmt(err, "error listing snapshots of orphan %v", orphan.Dataset)
+		}
+		// Other holds, and snapshots released from quarantine by hand, are left alone
+		destroy := slices.DeleteFunc(cfg.Pruning.Destroy(snaps), func(snap *zfssupport.ZvolSnapshot) bool {
+			return snap.InUseReason() != ""
+		})
+		period := t.jobConfig.Pruning.QuarantinePeriod()
+		until := now.Add(period)
+		plan := planQuarantine(snaps, destroy, period, now)
+		for _, snap := range plan.Release {
+			t.log.Log("Releasing orphan snapshot %v from quarantine, since it is no longer chosen for pruning", snap.Name())
+			err = orphan.dest.ReleaseSnapshot(snap)
+			if err != nil {
+				return util.WrapFmt(err, "error releasing orphan snapshot %v", snap.Name())
+			}
+		}
+		for _, snap := range plan.Quarantine {
+			t.log.Log("Quarantining orphan snapshot %v until %v", snap.Name(), until)
+			err = orphan.dest.QuarantineSnapshot(snap, until)
+			if err != nil {
+				return util.WrapFmt(err, "error quarantining orphan snapshot %v", snap.Name())
+			}
+		}
+		for _, snap := range plan.Destroy {
+			t.log.Log("Pruning orphan snapshot %v", snap.Name())
+			err = orphan.dest.DeleteSnapshot(snap)
+			if err != nil {
+				return util.WrapFmt(err, "error pruning orphan snapshot %v", snap.Name())
+			}
+		}
+	case config.OrphanArchive:
+		if time.Now().Before(orphan.OrphanedSince.Add(cfg.GracePeriod)) {
+			return nil
+		}
+		newName := cfg.ArchiveDataset + "/" + orphan.relPath
+		t.log.Log("Archiving orphan %v to %v", orphan.Dataset, newName)
+		err := orphan.dest.Rename(newName)
+		if err != nil {
+			return err
+		}
+		orphan.Dataset = newName
+		orphan.Action = "archived"
+	}
+	return nil
+}
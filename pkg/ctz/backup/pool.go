@@ -2,7 +2,9 @@ package backup
 
 import (
 	context2 "context"
+	"errors"
 	"fmt"
+	"github.com/ceph/go-ceph/rados"
 	"github.com/ceph/go-ceph/rbd"
 	"github.com/mattventura/ceph-to-zfs/pkg/ctz/cephsupport"
 	"github.com/mattventura/ceph-to-zfs/pkg/ctz/config"
@@ -13,6 +15,7 @@ import (
 	"github.com/mattventura/ceph-to-zfs/pkg/ctz/zfssupport"
 	"golang.org/x/sync/semaphore"
 	"runtime"
+	"slices"
 	"sync"
 )
 
@@ -26,13 +29,29 @@ type RbdPoolBackupTask struct {
 	children   []*ImageBackupTask
 	childMap   map[string]*ImageBackupTask
 	mt         *task.ManagedTask
+	// reservation is the space reserved by the images which are currently being copied, see checkSpace
+	reservation *spaceReservation
+	// volumes is shared with the images, so that the zvols are only listed once per run
+	volumes *volumeCache
+	// failedImages are the images which could not be opened during prep. Their zvols must not be treated as orphans.
+	failedImages []imageSpec
 }
 
 func NewRbdPoolBackupTask(
 	jobConfig *config.RbdPoolJobProcessedConfig,
 	parentLog *logging.JobStatusLogger,
 ) *RbdPoolBackupTask {
-	log := parentLog.MakeOrReplaceChild(logging.LoggerKey(jobConfig.Id), false)
+	return newRbdPoolBackupTask(jobConfig, parentLog, false)
+}
+
+// newRbdPoolBackupTask is like NewRbdPoolBackupTask, but allows the log path to include the parent. This is used when
+// the pool task is part of a multi-pool job (see MultiPoolBackupTask).
+func newRbdPoolBackupTask(
+	jobConfig *config.RbdPoolJobProcessedConfig,
+	parentLog *logging.JobStatusLogger,
+	includeParent bool,
+) *RbdPoolBackupTask {
+	log := parentLog.MakeOrReplaceChild(logging.LoggerKey(jobConfig.TaskId()), includeParent)
 	out := &RbdPoolBackupTask{
 		cephConfig: jobConfig.ClusterConfig,
 		jobConfig:  jobConfig,
@@ -41,10 +60,15 @@ func NewRbdPoolBackupTask(
 		children:   []*ImageBackupTask{},
 		childMap:   map[string]*ImageBackupTask{},
 	}
+	out.reservation = &spaceReservation{}
+	out.volumes = &volumeCache{}
 	out.mt = task.NewManagedTask(log, out.prep, out.run)
 	if jobConfig.Cron != nil {
 		log.SetFixedExtraData("cron", jobConfig.Cron)
 	}
+	if jobConfig.PruneCron != nil {
+		log.SetFixedExtraData("pruneCron", jobConfig.PruneCron)
+	}
 	return out
 }
 
@@ -58,32 +82,152 @@ func (t *RbdPoolBackupTask) Children() []task.Task {
 	})
 }
 
-func (t *RbdPoolBackupTask) includeImage(name string) bool {
+// includeImage and excludeImage match against the image spec (see imageSpec.String), so for images outside the
+// default namespace, the regexes see "namespace/image".
+func (t *RbdPoolBackupTask) includeImage(spec imageSpec) bool {
 	j := t.jobConfig
 	if j.ImageIncludeRegex == nil {
 		return true
 	} else {
-		return j.ImageIncludeRegex.MatchString(name)
+		return j.ImageIncludeRegex.MatchString(spec.String())
 	}
 }
 
-func (t *RbdPoolBackupTask) excludeImage(name string) bool {
+func (t *RbdPoolBackupTask) excludeImage(spec imageSpec) bool {
 	j := t.jobConfig
 	if j.ImageExcludeRegex == nil {
 		return false
 	} else {
-		return j.ImageExcludeRegex.MatchString(name)
+		return j.ImageExcludeRegex.MatchString(spec.String())
 	}
 }
 
-func (t *RbdPoolBackupTask) shouldBackupImage(name string) bool {
+// includeImageMetadata requires every include selector to match.
+func (t *RbdPoolBackupTask) includeImageMetadata(meta map[string]string) (bool, *config.MetadataSelector) {
+	for _, sel := range t.jobConfig.ImageIncludeMetadata {
+		if !sel.Matches(meta) {
+			return false, sel
+		}
+	}
+	return true, nil
+}
+
+// excludeImageMetadata excludes the image if any of the exclude selectors match.
+func (t *RbdPoolBackupTask) excludeImageMetadata(meta map[string]string) (bool, *config.MetadataSelector) {
+	for _, sel := range t.jobConfig.ImageExcludeMetadata {
+		if sel.Matches(meta) {
+			return true, sel
+		}
+	}
+	return false, nil
+}
+
+// shouldBackupImage decides whether an image should be backed up, and returns a human-readable reason for the
+// decision. meta is the image's RBD metadata, which is only needed if the job has metadata selectors.
+func (t *RbdPoolBackupTask) shouldBackupImage(spec imageSpec, meta map[string]string) (bool, string) {
 	// if only "include" is specified, only things matching the include pattern are included
 	// if only "exclude" is specified, then only things not matching the exclude pattern are included
 	// if both are specified, then items must match the include pattern *and not* match the exclude pattern
-	if t.excludeImage(name) {
-		return false
+	// Metadata selectors work the same way, and are combined with the regexes: an image must pass both.
+	if t.excludeImage(spec) {
+		return false, "matches imageExcludeRegex"
+	}
+	if excluded, sel := t.excludeImageMetadata(meta); excluded {
+		return false, fmt.Sprintf("metadata matches exclude selector %v", sel)
+	}
+	if !t.includeImage(spec) {
+		return false, "does not match imageIncludeRegex"
+	}
+	if included, sel := t.includeImageMetadata(meta); !included {
+		return false, fmt.Sprintf("metadata does not match include selector %v", sel)
+	}
+	if t.jobConfig.ImageIncludeRegex == nil && len(t.jobConfig.ImageIncludeMetadata) == 0 {
+		return true, "not excluded"
+	}
+	return true, "matches include selectors"
+}
+
+// imageInfo opens an image once to fetch its RBD image ID (which unlike the name, is stable across renames), and its
+// metadata if withMetadata is set
+func imageInfo(context *rados.IOContext, spec imageSpec, withMetadata bool) (id string, meta map[string]string, err error) {
+	context.SetNamespace(spec.namespace)
+	img, err := rbd.OpenImageReadOnly(context, spec.name, rbd.NoSnapshot)
+	if err != nil {
+		return "", nil, util.WrapFmt(err, "error opening image %v", spec)
+	}
+	defer img.Close()
+	id, err = img.GetId()
+	if err != nil {
+		return "", nil, util.WrapFmt(err, "error getting ID of image %v", spec)
+	}
+	if withMetadata {
+		meta, err = img.ListMetadata()
+		if err != nil {
+			return "", nil, util.WrapFmt(err, "error listing metadata for image %v", spec)
+		}
 	}
-	return t.includeImage(name)
+	return id, meta, nil
+}
+
+// ImageSelection records why an image was or was not included in the job. These are reported in the pool task's
+// detail data.
+type ImageSelection struct {
+	Image    string `json:"image"`
+	Included bool   `json:"included"`
+	Reason   string `json:"reason"`
+	// Error is set if the image could not be opened, in which case it is neither included nor excluded
+	Error string `json:"error,omitempty"`
+}
+
+// namespaces returns the list of RBD namespaces that this job covers. The default namespace is represented by the
+// empty string.
+func (t *RbdPoolBackupTask) namespaces(context *rados.IOContext) ([]string, error) {
+	if !t.jobConfig.AllNamespaces {
+		return t.jobConfig.CephNamespaces, nil
+	}
+	names, err := rbd.NamespaceList(context)
+	if err != nil {
+		return nil, util.Wrap("error listing namespaces", err)
+	}
+	return append([]string{""}, names...), nil
+}
+
+// listImages enumerates the images in every namespace covered by this job.
+func (t *RbdPoolBackupTask) listImages(context *rados.IOContext) ([]imageSpec, error) {
+	namespaces, err := t.namespaces(context)
+	if err != nil {
+		return nil, err
+	}
+	var out []imageSpec
+	for _, ns := range namespaces {
+		context.SetNamespace(ns)
+		names, err := rbd.GetImageNames(context)
+		if err != nil {
+			return nil, util.WrapFmt(err, "error listing images in namespace '%v'", ns)
+		}
+		for _, name := range names {
+			out = append(out, imageSpec{namespace: ns, name: name})
+		}
+	}
+	return out, checkNamespaceCollisions(out)
+}
+
+// checkNamespaceCollisions makes sure that no namespace has the same name as an image in the default namespace. The
+// images in a namespace are stored under a dataset named after the namespace, which would be the zvol of that image.
+func checkNamespaceCollisions(specs []imageSpec) error {
+	defaultImages := map[string]bool{}
+	for _, spec := range specs {
+		if spec.namespace == "" {
+			defaultImages[spec.name] = true
+		}
+	}
+	for _, spec := range specs {
+		if spec.namespace != "" && defaultImages[spec.namespace] {
+			return fmt.Errorf("namespace '%v' has the same name as an image in the default namespace, so its images "+
+				"cannot be stored under dataset %v", spec.namespace, zfssupport.EscapeNameComponent(spec.namespace))
+		}
+	}
+	return nil
 }
 
 // prep contains only the
@@ -102,7 +246,7 @@ func (t *RbdPoolBackupTask) prep() (err error) {
 	}
 	defer func() { go context.Destroy() }()
 	t.log.SetStatus(status.MakeStatus(status.Preparing, "Enumerating Images"))
-	names, err := rbd.GetImageNames(context)
+	specs, err := t.listImages(context)
 	if err != nil {
 		return err
 	}
@@ -110,25 +254,60 @@ func (t *RbdPoolBackupTask) prep() (err error) {
 	if err != nil {
 		return err
 	}
+	t.volumes.reset(zfsContext)
 	var children []*ImageBackupTask
 	var included []string
+	var includedPaths []string
 	var excluded []string
-	for _, name := range names {
-		if t.shouldBackupImage(name) {
-			t.log.Log("Image %v included", name)
-			tsk := t.childMap[name]
+	var selections []ImageSelection
+	var failed []imageSpec
+	includedIds := map[string]bool{}
+	for _, spec := range specs {
+		key := spec.String()
+		// An image which can't be opened (e.g. a transient error, or it was deleted after being listed) doesn't fail
+		// the whole pool, but the pool reports an error once the other images have been backed up
+		id, meta, err := imageInfo(context, spec, t.jobConfig.NeedsImageMetadata())
+		if err != nil {
+			t.log.Warn("Error opening image %v: %v", key, err)
+			selections = append(selections, ImageSelection{Image: key, Included: false, Error: err.Error()})
+			failed = append(failed, spec)
+			continue
+		}
+		shouldBackup, reason := t.shouldBackupImage(spec, meta)
+		selections = append(selections, ImageSelection{Image: key, Included: shouldBackup, Reason: reason})
+		if shouldBackup {
+			t.log.Log("Image %v included (%v)", key, reason)
+			imageConfig := t.jobConfig.ImageConfigFor(key, meta)
+			tsk := t.childMap[key]
 			if tsk == nil {
-				tsk = NewImageBackupTask(name, t.cephConfig, t.poolName, zfsContext, t.log, t.jobConfig)
-				t.childMap[name] = tsk
+				tsk = NewImageBackupTask(spec, t.cephConfig, t.poolName, zfsContext, t.log, t.jobConfig, imageConfig, t.reservation, t.volumes)
+				t.childMap[key] = tsk
+			} else {
+				tsk.setImageConfig(imageConfig)
 			}
 			children = append(children, tsk)
-			included = append(included, name)
+			included = append(included, key)
+			includedPaths = append(includedPaths, spec.DatasetPath())
+			includedIds[id] = true
 		} else {
-			excluded = append(excluded, name)
+			excluded = append(excluded, key)
 		}
 	}
 
 	t.children = children
+	t.failedImages = failed
+	t.log.SetDetailData("imageSelection", selections)
+	t.log.SetExtraData("failedImageCount", len(failed))
+	t.log.SetExtraData("space", t.SpaceUsage())
+
+	t.log.SetStatus(status.MakeStatus(status.Preparing, "Looking for orphaned zvols"))
+	// The zvols of images which failed to open are not orphans, they just can't be backed up this time
+	orphans, _, err := t.listOrphans(zfsContext, append(includedPaths, t.failedImagePaths()...), includedIds)
+	if err != nil {
+		return err
+	}
+	t.log.SetDetailData("orphans", orphans)
+	t.log.SetExtraData("orphanCount", len(orphans))
 
 	if len(children) == 0 {
 		t.log.SetStatus(status.MakeStatus(status.Failed, "No images found to back up"))
@@ -137,9 +316,27 @@ func (t *RbdPoolBackupTask) prep() (err error) {
 
 	t.log.Log("Included: %v", included)
 	t.log.Log("Excluded: %v", excluded)
+	if len(failed) > 0 {
+		t.log.Log("Failed to open: %v", failed)
+	}
 	return nil
 }
 
+// failedImagePaths returns the dataset paths of the images which could not be opened during prep
+func (t *RbdPoolBackupTask) failedImagePaths() []string {
+	return util.Map(t.failedImages, func(in imageSpec) string {
+		return in.DatasetPath()
+	})
+}
+
+// failedImagesError reports the images which could not be opened during prep, if there are any
+func (t *RbdPoolBackupTask) failedImagesError() error {
+	if len(t.failedImages) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%v image(s) could not be opened: %v", len(t.failedImages), t.failedImages)
+}
+
 func (t *RbdPoolBackupTask) run() (err error) {
 	// Ceph does not like it when you switch between threads
 	runtime.LockOSThread()
@@ -164,42 +361,94 @@ func (t *RbdPoolBackupTask) run() (err error) {
 	}
 
 	t.log.SetStatus(status.MakeStatus(status.InProgress, "Running Children"))
-	childrenFailed := 0
+	t.runChildren(func(child *ImageBackupTask) error {
+		return child.Run()
+	})
+	t.log.SetExtraData("space", t.SpaceUsage())
 
+	// Only look at orphans once the children have finished, since the children may create new zvols.
+	t.log.SetStatus(status.MakeStatus(status.Finishing, "Handling orphaned zvols"))
+	err = t.handleOrphans()
+	if err != nil {
+		t.log.Log("Error handling orphans: %v", err)
+	}
+	return errors.Join(err, t.failedImagesError())
+}
+
+// runChildren calls f for every image, in order of priority, while respecting the concurrency limit. It returns once
+// all calls have finished.
+func (t *RbdPoolBackupTask) runChildren(f func(child *ImageBackupTask) error) {
 	// Wait for all children to finish
 	wg := &sync.WaitGroup{}
 	// Limit concurrency
 	// TODO: move this and put the semaphore logic in the child
 	sem := semaphore.NewWeighted(int64(t.jobConfig.MaxConcurrency))
 
+	// Start higher priority images first. The semaphore is acquired in this order before starting each child, so
+	// that the concurrency limit doesn't let a lower priority image jump the queue.
+	children := slices.Clone(t.children)
+	slices.SortStableFunc(children, func(a, b *ImageBackupTask) int {
+		return b.Priority() - a.Priority()
+	})
+	for i, child := range children {
+		if i >= t.jobConfig.MaxConcurrency {
+			child.log.SetStatus(status.MakeStatus(status.Waiting, "Waiting for concurrency limit"))
+		}
+	}
+
 	for _, child := range children {
+		err := sem.Acquire(context2.TODO(), 1)
+		if err != nil {
+			child.log.SetStatus(status.MakeStatus(status.Failed, "Failed to acquire semaphore"))
+			continue
+		}
 		wg.Add(1)
 		go func() {
-			acquire := sem.TryAcquire(1)
-			if !acquire {
-				child.log.SetStatus(status.MakeStatus(status.Waiting, "Waiting for concurrency limit"))
-				err := sem.Acquire(context2.TODO(), 1)
-				if err != nil {
-					child.log.SetStatus(status.MakeStatus(status.Failed, "Failed to acquire semaphore"))
-				}
-			}
 			defer sem.Release(1)
 			defer wg.Done()
 			defer func() {
 				rec := recover()
 				if rec != nil {
-					childrenFailed++
 					child.log.SetStatus(status.MakeStatus(status.Failed, fmt.Sprintf("Recovered from panic: %v", rec)))
 				}
 			}()
-			childErr := child.Run()
-			if childErr != nil {
-				childrenFailed++
-			}
+			// Failures are reported by the child's status
+			_ = f(child)
 		}()
 	}
 	wg.Wait()
-	return err
+}
+
+// Prune prunes every image in the pool without backing them up, see ImageBackupTask.Prune. Orphaned zvols are only
+// handled by backups.
+func (t *RbdPoolBackupTask) Prune(dryRun bool) error {
+	return t.mt.RunFunc(func() error {
+		if len(t.children) == 0 {
+			t.log.SetStatus(status.MakeStatus(status.Failed, "No images found to prune"))
+			return nil
+		}
+		if dryRun {
+			t.log.SetStatus(status.MakeStatus(status.InProgress, "Pruning Children (dry run)"))
+		} else {
+			t.log.SetStatus(status.MakeStatus(status.InProgress, "Pruning Children"))
+		}
+		t.runChildren(func(child *ImageBackupTask) error {
+			return child.Prune(dryRun)
+		})
+		t.log.SetExtraData("space", t.SpaceUsage())
+		return nil
+	}, nil)
+}
+
+// ReleaseQuarantine releases quarantined snapshots of every image in the pool, see ImageBackupTask.ReleaseQuarantine
+func (t *RbdPoolBackupTask) ReleaseQuarantine(snapshot string) error {
+	return t.mt.RunFunc(func() error {
+		t.log.SetStatus(status.MakeStatus(status.InProgress, "Releasing Children"))
+		t.runChildren(func(child *ImageBackupTask) error {
+			return child.ReleaseQuarantine(snapshot)
+		})
+		return nil
+	}, nil)
 }
 
 func (t *RbdPoolBackupTask) Run() error {
@@ -211,7 +460,7 @@ func (t *RbdPoolBackupTask) Prepare() (err error) {
 }
 
 func (t *RbdPoolBackupTask) Id() string {
-	return t.jobConfig.Id
+	return t.jobConfig.TaskId()
 }
 
 func (t *RbdPoolBackupTask) Label() string {
@@ -219,3 +468,5 @@ func (t *RbdPoolBackupTask) Label() string {
 }
 
 var _ task.PreparableTask = &RbdPoolBackupTask{}
+var _ task.PrunableTask = &RbdPoolBackupTask{}
+var _ task.ReleasableTask = &RbdPoolBackupTask{}
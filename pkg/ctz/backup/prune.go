@@ -0,0 +1,356 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ceph/go-ceph/rbd"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/cephsupport"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/config"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/pruning"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/status"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/task"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/util"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/zfssupport"
+	"runtime"
+	"time"
+)
+
+// pruneResult counts the snapshots deleted by prune (or which would have been deleted, for a dry run)
+type pruneResult struct {
+	dryRun     bool
+	cephPruned int
+	zfsPruned  int
+	// cephQuarantined and zfsQuarantined count the snapshots which were newly quarantined, see pruning.QuarantinePlan
+	cephQuarantined int
+	zfsQuarantined  int
+	// errors are the failures to delete individual snapshots. These don't stop the other snapshots being pruned.
+	errors []error
+}
+
+func (r *pruneResult) String() string {
+	var out string
+	if r.dryRun {
+		out = fmt.Sprintf("Dry run: would prune %v ceph and %v ZFS snapshots", r.cephPruned, r.zfsPruned)
+	} else {
+		out = fmt.Sprintf("Pruned %v ceph and %v ZFS snapshots", r.cephPruned, r.zfsPruned)
+	}
+	if r.cephQuarantined > 0 || r.zfsQuarantined > 0 {
+		out += fmt.Sprintf(", quarantined %v ceph and %v ZFS snapshots", r.cephQuarantined, r.zfsQuarantined)
+	}
+	return out
+}
+
+// planQuarantine wraps pruning.PlanQuarantine. If quarantine is disabled (period is zero), everything chosen by the
+// rules is destroyed straight away, although snapshots quarantined while it was enabled are still released if the
+// rules no longer choose them.
+func planQuarantine[T models.QuarantinedSnapshot](snaps []T, destroy []T, period time.Duration, now time.Time) *pruning.QuarantinePlan[T] {
+	plan := pruning.PlanQuarantine(snaps, destroy, now)
+	if period <= 0 {
+		plan.Destroy = append(append(plan.Destroy, plan.Waiting...), plan.Quarantine...)
+		plan.Waiting = nil
+		plan.Quarantine = nil
+	}
+	return plan
+}
+
+// quarantineTimes maps the name of each snapshot which will be quarantined after pruning to the end of its grace
+// period, for the snapshot report
+func quarantineTimes[T models.QuarantinedSnapshot](plan *pruning.QuarantinePlan[T], until time.Time) map[string]time.Time {
+	out := make(map[string]time.Time, len(plan.Quarantine)+len(plan.Waiting))
+	for _, snap := range plan.Quarantine {
+		out[snap.Name()] = until
+	}
+	for _, snap := range plan.Waiting {
+		out[snap.Name()] = snap.PruneAfter()
+	}
+	return out
+}
+
+// prune applies the pruning rules to both sides, and records the snapshot report. Unless dryRun is set, the snapshots
+// are then deleted, or quarantined if the config has a quarantine period. Status messages use the given status type,
+// since pruning is either the last phase of a backup, or the whole of a prune-only run.
+func (t *ImageBackupTask) prune(cephImage *cephsupport.CephImageView, zv *zfssupport.ZvolDestination, phase status.StatusType, dryRun bool) (*pruneResult, error) {
+	t.log.SetStatus(status.MakeStatus(phase, "Planning snapshot pruning"))
+	// After a backup, this is the same (cached) list that was used to find the most recent common snapshot, so it
+	// already includes the snapshot that was just copied.
+	cephSnaps, err := cephImage.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	// Not cached, so this includes the snapshot that was just created
+	zvolSnaps, err := zv.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	period := t.imageConfig.Pruning.QuarantinePeriod()
+	until := now.Add(period)
+
+	// The receiver's snapshots are needed by the notReplicated rule
+	srcContext := &pruning.PruneContext{ReceiverNames: util.Map(zvolSnaps, (*zfssupport.ZvolSnapshot).Name)}
+	srcDestroy, srcReasons := t.imageConfig.SrcPruning.Explain(cephSnaps, srcContext)
+	srcChosen, srcInUse := excludeInUse(t, "ceph", t.imageConfig.Pruning.InUsePolicy() == config.InUseWarn, srcDestroy)
+	srcPlan := planQuarantine(cephSnaps, srcChosen, period, now)
+	srcSnaps := len(cephSnaps)
+	srcToDestroy := len(srcPlan.Destroy)
+	srcQuarantined := len(srcPlan.Quarantine) + len(srcPlan.Waiting)
+	srcToKeep := srcSnaps - srcToDestroy - srcQuarantined
+	if t.imageConfig.Pruning.InUsePolicy() == config.InUseWarn {
+		srcToKeep -= len(srcInUse)
+	}
+	t.log.SetExtraData("srcSnaps", srcSnaps)
+	t.log.SetExtraData("srcSnapsToDestroy", srcToDestroy)
+	t.log.SetExtraData("srcSnapsToKeep", srcToKeep)
+	t.log.SetExtraData("srcSnapsInUse", len(srcInUse))
+	t.log.SetExtraData("srcSnapsQuarantined", srcQuarantined)
+
+	pruneContext, err := t.pruneContext(zv)
+	if err != nil {
+		return nil, err
+	}
+	rcvDestroy, rcvReasons := t.imageConfig.RcvPruning.Explain(zvolSnaps, pruneContext)
+	// Held snapshots can't be destroyed, e.g. the replication base (see moveBase)
+	rcvChosen, rcvInUse := excludeInUse(t, "ZFS", false, rcvDestroy)
+	rcvPlan := planQuarantine(zvolSnaps, rcvChosen, period, now)
+	rcvSnaps := len(zvolSnaps)
+	rcvToDestroy := len(rcvPlan.Destroy)
+	rcvQuarantined := len(rcvPlan.Quarantine) + len(rcvPlan.Waiting)
+	rcvToKeep := rcvSnaps - rcvToDestroy - rcvQuarantined
+	t.log.SetExtraData("rcvSnaps", rcvSnaps)
+	t.log.SetExtraData("rcvSnapsToDestroy", rcvToDestroy)
+	t.log.SetExtraData("rcvSnapsToKeep", rcvToKeep)
+	t.log.SetExtraData("rcvSnapsQuarantined", rcvQuarantined)
+	t.log.SetExtraData("rcvSnapsInUse", len(rcvInUse))
+
+	snapReport := t.makeSnapshotReport(cephSnaps, srcPlan.Destroy, srcInUse, quarantineTimes(srcPlan, until), srcReasons, zvolSnaps, rcvPlan.Destroy, rcvInUse, quarantineTimes(rcvPlan, until), rcvReasons)
+	snapReport.DryRun = dryRun
+	t.log.SetDetailData("snapshotReport", snapReport)
+	if dryRun {
+		t.log.Log("Dry run: snapshots marked as pruned or quarantined will not be changed")
+	}
+	for _, snapshot := range snapReport.Snapshots {
+		t.log.Log(snapshot.String())
+	}
+
+	result := &pruneResult{dryRun: dryRun}
+	if dryRun {
+		t.log.SetExtraData("pruneDryRun", true)
+		result.cephPruned = srcToDestroy
+		result.zfsPruned = rcvToDestroy
+		result.cephQuarantined = len(srcPlan.Quarantine)
+		result.zfsQuarantined = len(rcvPlan.Quarantine)
+		return result, nil
+	}
+
+	for _, snapshot := range srcPlan.Release {
+		t.log.Log("Releasing ceph snapshot %v from quarantine, since it is no longer chosen for pruning", snapshot.Name())
+		err := cephImage.ReleaseSnapshot(snapshot)
+		if err != nil {
+			result.errors = append(result.errors, err)
+		}
+	}
+	for _, snapshot := range srcPlan.Quarantine {
+		t.log.Log("Quarantining ceph snapshot %v until %v", snapshot.Name(), until)
+		err := cephImage.QuarantineSnapshot(snapshot, until)
+		if err != nil {
+			result.errors = append(result.errors, err)
+		} else {
+			result.cephQuarantined++
+		}
+	}
+	t.log.SetStatus(status.MakeStatus(phase, fmt.Sprintf("Pruning %v ceph snapshots", srcToDestroy)))
+	for _, snapshot := range srcPlan.Destroy {
+		t.log.Log("Pruning ceph snapshot %v", snapshot.Name())
+		err := cephImage.DeleteSnapshot(snapshot)
+		if err != nil {
+			result.errors = append(result.errors, err)
+		} else {
+			result.cephPruned++
+		}
+	}
+	t.log.SetStatus(status.MakeStatus(phase, fmt.Sprintf("Pruned %v ceph snapshots", result.cephPruned)))
+
+	for _, snapshot := range rcvPlan.Release {
+		t.log.Log("Releasing ZFS snapshot %v from quarantine, since it is no longer chosen for pruning", snapshot.Name())
+		err := zv.ReleaseSnapshot(snapshot)
+		if err != nil {
+			result.errors = append(result.errors, err)
+		}
+	}
+	for _, snapshot := range rcvPlan.Quarantine {
+		t.log.Log("Quarantining ZFS snapshot %v until %v", snapshot.Name(), until)
+		err := zv.QuarantineSnapshot(snapshot, until)
+		if err != nil {
+			result.errors = append(result.errors, err)
+		} else {
+			result.zfsQuarantined++
+		}
+	}
+	t.log.SetStatus(status.MakeStatus(phase, fmt.Sprintf("Pruning %v ZFS snapshots", rcvToDestroy)))
+	for _, snapshot := range rcvPlan.Destroy {
+		t.log.Log("Pruning ZFS snapshot %v", snapshot.Name())
+		err := zv.DeleteSnapshot(snapshot)
+		if err != nil {
+			result.errors = append(result.errors, err)
+		} else {
+			result.zfsPruned++
+		}
+	}
+	t.log.SetStatus(status.MakeStatus(phase, fmt.Sprintf("Pruned %v ZFS snapshots", result.zfsPruned)))
+	return result, nil
+}
+
+// Prune applies the pruning rules to the image's existing snapshots without backing it up first, e.g. because backups
+// keep failing, or to apply a changed policy straight away. The zvol must already exist.
+func (t *ImageBackupTask) Prune(dryRun bool) error {
+	return t.mt.RunFunc(func() error {
+		return t.pruneOnly(dryRun)
+	}, func() string {
+		if t.pruneResult == nil {
+			return "FAIL: task did not report data"
+		}
+		return t.pruneResult.String()
+	})
+}
+
+func (t *ImageBackupTask) pruneOnly(dryRun bool) error {
+	t.pruneResult = nil
+	return t.withExistingZvol(func(cephImage *cephsupport.CephImageView, zv *zfssupport.ZvolDestination, size uint64) error {
+		result, err := t.prune(cephImage, zv, status.InProgress, dryRun)
+		if err != nil {
+			return err
+		}
+		if !dryRun {
+			t.log.SetStatus(status.MakeStatus(status.Finishing, "Collecting space usage"))
+			t.collectSpaceUsage(cephImage, zv, size)
+		}
+		if len(result.errors) > 0 {
+			return errors.Join(result.errors...)
+		}
+		t.pruneResult = result
+		return nil
+	})
+}
+
+// withExistingZvol opens the image and finds its zvol, and passes them to f along with the size of the image. Unlike a
+// backup, this doesn't create the zvol or follow renames, so that nothing is changed apart from what f does.
+func (t *ImageBackupTask) withExistingZvol(f func(cephImage *cephsupport.CephImageView, zv *zfssupport.ZvolDestination, size uint64) error) error {
+	// Ceph does not like it when you switch between threads
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	t.log.SetStatus(status.MakeStatus(status.Preparing, "Opening ceph image"))
+	conn, err := cephsupport.Connect(t.cephConfig)
+	if err != nil {
+		return util.Wrap("failed to connect to ceph cluster", err)
+	}
+	defer func() { go conn.Shutdown() }()
+	context, err := conn.OpenIOContext(t.poolName)
+	if err != nil {
+		return util.Wrap("error opening IOContext", err)
+	}
+	context.SetNamespace(t.spec.namespace)
+	img, err := rbd.OpenImage(context, t.spec.name, "")
+	if err != nil {
+		return util.Wrap("error opening image", err)
+	}
+	defer img.Close()
+	cephImage := cephsupport.NewCephImageView(context, img)
+	imageId, err := img.GetId()
+	if err != nil {
+		return util.Wrap("error getting image ID", err)
+	}
+	size, err := cephImage.Size()
+	if err != nil {
+		return util.Wrap("error getting ceph image size", err)
+	}
+
+	t.log.SetStatus(status.MakeStatus(status.Preparing, "Finding zvol"))
+	volumes, err := t.volumes.get()
+	if err != nil {
+		return err
+	}
+	zv, found := volumes[t.spec.DatasetPath()]
+	if !found {
+		// The list may be from before the zvol was created
+		t.volumes.invalidate()
+		volumes, err = t.volumes.get()
+		if err != nil {
+			return err
+		}
+		zv, found = volumes[t.spec.DatasetPath()]
+	}
+	if !found {
+		return fmt.Errorf("zvol %v/%v does not exist, the image must be backed up first", t.zfsContext.Name(), t.spec.DatasetPath())
+	}
+	taggedId, err := zv.GetProperty(zfssupport.RbdImageIdProperty)
+	if err != nil {
+		return util.Wrap("error reading image ID property", err)
+	}
+	if taggedId != "-" && taggedId != "" && taggedId != imageId {
+		return fmt.Errorf("zvol %v is a copy of image ID %v, but the image ID is now %v, the image must be backed up first", zv.Name(), taggedId, imageId)
+	}
+	t.log.SetExtraData("dataset", zv.Name())
+	return f(cephImage, zv, size)
+}
+
+// ReleaseQuarantine undoes pruning during the quarantine period, by removing the mark from quarantined snapshots on
+// both sides. If snapshot is empty, every quarantined snapshot is released. Released snapshots are also marked to be
+// kept (see models.QuarantinedSnapshot), so that later prunes don't quarantine them again, even if the pruning rules
+// still choose them.
+func (t *ImageBackupTask) ReleaseQuarantine(snapshot string) error {
+	released := 0
+	now := time.Now()
+	return t.mt.RunFunc(func() error {
+		return t.withExistingZvol(func(cephImage *cephsupport.CephImageView, zv *zfssupport.ZvolDestination, _ uint64) error {
+			t.log.SetStatus(status.MakeStatus(status.InProgress, "Releasing snapshots from quarantine"))
+			cephSnaps, err := cephImage.Snapshots()
+			if err != nil {
+				return err
+			}
+			zvolSnaps, err := zv.Snapshots()
+			if err != nil {
+				return err
+			}
+			var errs []error
+			for _, snap := range cephSnaps {
+				if snap.PruneAfter().IsZero() || (snapshot != "" && snap.Name() != snapshot) {
+					continue
+				}
+				t.log.Log("Releasing ceph snapshot %v from quarantine", snap.Name())
+				// Mark it first, so that it isn't destroyed if releasing fails
+				err := cephImage.KeepSnapshot(snap, now)
+				if err == nil {
+					err = cephImage.ReleaseSnapshot(snap)
+				}
+				if err != nil {
+					errs = append(errs, err)
+				} else {
+					released++
+				}
+			}
+			for _, snap := range zvolSnaps {
+				if snap.PruneAfter().IsZero() || (snapshot != "" && snap.Name() != snapshot) {
+					continue
+				}
+				t.log.Log("Releasing ZFS snapshot %v from quarantine", snap.Name())
+				err := zv.KeepSnapshot(snap, now)
+				if err == nil {
+					err = zv.ReleaseSnapshot(snap)
+				}
+				if err != nil {
+					errs = append(errs, err)
+				} else {
+					released++
+				}
+			}
+			return errors.Join(errs...)
+		})
+	}, func() string {
+		return fmt.Sprintf("Released %v snapshots from quarantine", released)
+	})
+}
+
+var _ task.PrunableTask = &ImageBackupTask{}
+var _ task.ReleasableTask = &ImageBackupTask{}
@@ -0,0 +1,56 @@
+package backup
+
+import (
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/util"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/zfssupport"
+)
+
+// followRename handles the image having been renamed in Ceph since the last backup. If the zvol for the image's
+// current name does not exist, but another zvol is tagged with the same RBD image ID, then that zvol is renamed to
+// match, so that the image can continue to be backed up incrementally.
+func (t *ImageBackupTask) followRename(imageId string) error {
+	expected := t.zfsContext.Name() + "/" + t.spec.DatasetPath()
+	existing, err := t.zfsContext.FindChildByProperty(zfssupport.RbdImageIdProperty, imageId)
+	if err != nil {
+		return util.Wrap("error looking up zvol by image ID", err)
+	}
+	if existing == nil || existing.Name() == expected {
+		return nil
+	}
+	volumes, err := t.volumes.get()
+	if err != nil {
+		return err
+	}
+	if current, found := volumes[t.spec.DatasetPath()]; found {
+		// Don't clobber anything - this would need manual intervention.
+		id, err := current.GetProperty(zfssupport.RbdImageIdProperty)
+		if err != nil {
+			return err
+		}
+		t.log.Log("WARNING: image ID %v was previously backed up to %v, but %v already exists (image ID %v)", imageId, existing.Name(), expected, id)
+		return nil
+	}
+	t.log.Log("Image was renamed, renaming zvol %v to %v", existing.Name(), expected)
+	t.log.SetExtraData("renamedFrom", existing.Name())
+	t.volumes.invalidate()
+	err = existing.Rename(expected)
+	if err != nil {
+		return err
+	}
+	return t.tagImageName(existing)
+}
+
+// tagImageId records the RBD image ID on the zvol, see followRename
+func (t *ImageBackupTask) tagImageId(zv *zfssupport.ZvolDestination, imageId string) error {
+	current, err := zv.GetProperty(zfssupport.RbdImageIdProperty)
+	if err != nil {
+		return util.Wrap("error reading image ID property", err)
+	}
+	if current == imageId {
+		return nil
+	}
+	if current != "-" && current != "" {
+		t.log.Log("Zvol was previously a copy of image ID %v, now %v", current, imageId)
+	}
+	return zv.SetUserProperty(zfssupport.RbdImageIdProperty, imageId)
+}
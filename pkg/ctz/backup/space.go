@@ -0,0 +1,166 @@
+package backup
+
+import (
+	"fmt"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/cephsupport"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/pruning"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/task"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/util"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/zfssupport"
+	"strconv"
+	"sync"
+)
+
+// spaceReservation tracks the bytes which running image backups expect to write. It is shared by the images of a pool
+// task, so that images which are backed up concurrently don't all count the same available space.
+type spaceReservation struct {
+	lock     sync.Mutex
+	reserved uint64
+}
+
+// checkSpace compares the estimated number of bytes to be written with the space available to the zvol, minus the
+// space reserved by the other images of the pool which are currently being backed up. If there is not enough space
+// (after leaving the configured reserve), it returns either an error or a task.DeferredError, depending on the config.
+// Otherwise, the estimate is reserved until releaseSpace is called.
+//
+// The estimate does not account for compression, zero detection or compare-before-write, so it errs on the side of
+// caution.
+func (t *ImageBackupTask) checkSpace(zv *zfssupport.ZvolDestination, estimate uint64) error {
+	t.log.SetExtraData("estimatedBytes", estimate)
+	cfg := t.spaceCheck
+	if cfg == nil {
+		return nil
+	}
+	availableProp, err := zv.GetProperty("available")
+	if err != nil {
+		return util.Wrap("error getting available space", err)
+	}
+	available, err := strconv.ParseUint(availableProp, 10, 64)
+	if err != nil {
+		return util.WrapFmt(err, "error parsing available space '%v'", availableProp)
+	}
+	t.log.SetExtraData("availableBytes", available)
+	t.reservation.lock.Lock()
+	defer t.reservation.lock.Unlock()
+	reserved := t.reservation.reserved
+	t.log.SetExtraData("reservedBytes", reserved)
+	if estimate+cfg.Reserve+reserved <= available {
+		t.reservation.reserved += estimate
+		t.reservedBytes = estimate
+		return nil
+	}
+	reason := fmt.Sprintf("need %v bytes plus %v reserve, but only %v bytes are available, and %v of those are reserved "+
+		"by other images", estimate, cfg.Reserve, available, reserved)
+	if cfg.Defer {
+		return &task.DeferredError{Reason: reason}
+	}
+	return fmt.Errorf("insufficient space: %v", reason)
+}
+
+// releaseSpace releases the space reserved by checkSpace, once the image has finished writing to the zvol
+func (t *ImageBackupTask) releaseSpace() {
+	t.reservation.lock.Lock()
+	defer t.reservation.lock.Unlock()
+	t.reservation.reserved -= t.reservedBytes
+	t.reservedBytes = 0
+}
+
+// SpaceReporter is implemented by tasks which can report the space used by their backups. For tasks with children,
+// this is the sum of the children's usage.
+type SpaceReporter interface {
+	SpaceUsage() *models.SpaceUsage
+}
+
+// sumSpaceUsage adds up the space usage of any children which report it
+func sumSpaceUsage[T task.Task](children []T) *models.SpaceUsage {
+	out := &models.SpaceUsage{}
+	for _, child := range children {
+		if reporter, ok := any(child).(SpaceReporter); ok {
+			out.Add(reporter.SpaceUsage())
+		}
+	}
+	return out
+}
+
+// collectSpaceUsage records the space used by the image on both sides. Failures are only logged, since the backup
+// itself has already succeeded. The RBD usage is left at zero for images without the fast-diff feature, since it would
+// take a scan of every object in the image.
+func (t *ImageBackupTask) collectSpaceUsage(cephImage *cephsupport.CephImageView, zv *zfssupport.ZvolDestination, size uint64) {
+	usage := &models.SpaceUsage{RbdProvisioned: size, Images: 1}
+	err := zv.SpaceUsage(usage)
+	if err != nil {
+		t.log.Log("Error getting zvol space usage: %v", err)
+		return
+	}
+	fastDiff, err := cephImage.HasFastDiff()
+	if err != nil {
+		t.log.Log("Error getting RBD space usage: %v", err)
+		return
+	}
+	if fastDiff {
+		usage.RbdUsed, err = cephImage.UsedBytes(size)
+		if err != nil {
+			t.log.Log("Error getting RBD space usage: %v", err)
+			return
+		}
+	} else {
+		t.log.Log("Not getting RBD space usage, since the image does not have the fast-diff feature")
+	}
+	t.space = usage
+	t.log.SetExtraData("space", usage)
+}
+
+// pruneContext gathers the information needed by spaceBudget rules, i.e. the space used by the zvol's snapshots, and
+// for job-scoped rules, by the snapshots of every other dataset under the job's destination. Other images may be
+// pruning at the same time, so this is only a snapshot in time.
+func (t *ImageBackupTask) pruneContext(zv *zfssupport.ZvolDestination) (*pruning.PruneContext, error) {
+	if !t.imageConfig.Pruning.HasSpaceBudget() {
+		return nil, nil
+	}
+	out := &pruning.PruneContext{}
+	if !t.imageConfig.Pruning.HasJobSpaceBudget() {
+		value, err := zv.GetProperty("usedbysnapshots")
+		if err != nil {
+			return nil, util.Wrap("error getting snapshot space usage", err)
+		}
+		out.UsedBySnapshots, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, util.WrapFmt(err, "invalid usedbysnapshots for %v", zv.Name())
+		}
+		return out, nil
+	}
+	usage, err := t.zfsContext.GetPropertyRecursive("usedbysnapshots")
+	if err != nil {
+		return nil, util.Wrap("error getting snapshot space usage for job", err)
+	}
+	for name, value := range usage {
+		used, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, util.WrapFmt(err, "invalid usedbysnapshots for %v", name)
+		}
+		if name == zv.Name() {
+			out.UsedBySnapshots = used
+		} else {
+			out.OtherUsage += used
+		}
+	}
+	return out, nil
+}
+
+// SpaceUsage is the space usage as of the last successful run, or nil if it is not known
+func (t *ImageBackupTask) SpaceUsage() *models.SpaceUsage {
+	return t.space
+}
+
+func (t *RbdPoolBackupTask) SpaceUsage() *models.SpaceUsage {
+	return sumSpaceUsage(t.children)
+}
+
+func (t *MultiPoolBackupTask) SpaceUsage() *models.SpaceUsage {
+	return sumSpaceUsage(t.children)
+}
+
+func (t *TopLevelTask) SpaceUsage() *models.SpaceUsage {
+	return sumSpaceUsage(t.children)
+}
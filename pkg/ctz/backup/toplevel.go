@@ -14,8 +14,8 @@ import (
 type TopLevelTask struct {
 	cfg      *config.TopLevelProcessedConfig
 	log      *logging.JobStatusLogger
-	children []*RbdPoolBackupTask
-	childMap map[string]*RbdPoolBackupTask
+	children []task.PreparableTask
+	childMap map[string]task.PreparableTask
 	mt       *task.ManagedTask
 }
 
@@ -24,11 +24,11 @@ func NewTopLevelTask(cfg *config.TopLevelProcessedConfig) (*TopLevelTask, error)
 	out := &TopLevelTask{
 		cfg:      cfg,
 		log:      log,
-		childMap: make(map[string]*RbdPoolBackupTask),
+		childMap: make(map[string]task.PreparableTask),
 	}
 	out.mt = task.NewManagedTask(log, out.prep, out.run)
 	t := out
-	var children []*RbdPoolBackupTask
+	var children []task.PreparableTask
 	var sched gocron.Scheduler
 	cronEnabled := !cfg.Globals.DisableAllCron
 	if cronEnabled {
@@ -44,22 +44,24 @@ func NewTopLevelTask(cfg *config.TopLevelProcessedConfig) (*TopLevelTask, error)
 	for _, jobCfg := range t.cfg.Jobs {
 		child := t.childMap[jobCfg.Label]
 		if child == nil {
-			child = NewRbdPoolBackupTask(jobCfg, t.log)
+			if jobCfg.IsMultiPool() {
+				child = NewMultiPoolBackupTask(jobCfg, t.log)
+			} else {
+				child = NewRbdPoolBackupTask(jobCfg, t.log)
+			}
 			t.childMap[jobCfg.Label] = child
-			if jobCfg.Cron != nil {
-				cj := gocron.CronJob(*jobCfg.Cron, false)
-				if cronEnabled {
-					_, err := sched.NewJob(cj, gocron.NewTask(func() {
-						child.log.Log("job triggered by cron '%v'", *jobCfg.Cron)
-						s := child.log.Status()
-						childStatusType := s.Type()
-						// Only run child if it is not active
-						if childStatusType == status.Ready || childStatusType.IsTerminal() {
-							child.Run()
-						} else {
-							child.log.Log("skipping cron: job status is currently '%v'", s)
-						}
-					}))
+			if cronEnabled {
+				if jobCfg.Cron != nil {
+					err := schedule(sched, child, *jobCfg.Cron, "job", child.Run)
+					if err != nil {
+						return nil, err
+					}
+				}
+				if jobCfg.PruneCron != nil {
+					prunable := child.(task.PrunableTask)
+					err := schedule(sched, child, *jobCfg.PruneCron, "pruning", func() error {
+						return prunable.Prune(false)
+					})
 					if err != nil {
 						return nil, err
 					}
@@ -78,26 +80,46 @@ func NewTopLevelTask(cfg *config.TopLevelProcessedConfig) (*TopLevelTask, error)
 	return out, nil
 }
 
+// schedule calls f whenever the cron triggers, unless the child is already active. action describes f in the log.
+func schedule(sched gocron.Scheduler, child task.Task, cron string, action string, f func() error) error {
+	cj := gocron.CronJob(cron, false)
+	_, err := sched.NewJob(cj, gocron.NewTask(func() {
+		childLog := child.StatusLog()
+		childLog.Log("%v triggered by cron '%v'", action, cron)
+		s := childLog.Status()
+		childStatusType := s.Type()
+		// Only run child if it is not active
+		if childStatusType == status.Ready || childStatusType.IsTerminal() {
+			_ = f()
+		} else {
+			childLog.Log("skipping cron: job status is currently '%v'", s)
+		}
+	}))
+	return err
+}
+
 func (t *TopLevelTask) StatusLog() *logging.JobStatusLogger {
 	return t.log
 }
 
 func (t *TopLevelTask) Children() []task.Task {
-	return util.Map(t.children, func(in *RbdPoolBackupTask) task.Task {
+	return util.Map(t.children, func(in task.PreparableTask) task.Task {
 		return in
 	})
 }
 
 func (t *TopLevelTask) prep() error {
-	_ = task.RunParallel(t.children, func(bt *RbdPoolBackupTask) error { return bt.Prepare() })
+	_ = task.RunParallel(t.children, func(bt task.PreparableTask) error { return bt.Prepare() })
+	t.log.SetExtraData("space", t.SpaceUsage())
 	return nil
 }
 
 func (t *TopLevelTask) run() error {
 	t.log.SetStatus(status.MakeStatus(status.InProgress, "Running Children"))
 	wg := &sync.WaitGroup{}
-	_ = task.RunParallel(t.children, func(bt *RbdPoolBackupTask) error { return bt.Run() })
+	_ = task.RunParallel(t.children, func(bt task.PreparableTask) error { return bt.Run() })
 	wg.Wait()
+	t.log.SetExtraData("space", t.SpaceUsage())
 	return nil
 }
 
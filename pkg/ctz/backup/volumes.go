@@ -0,0 +1,48 @@
+package backup
+
+import (
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/util"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/zfssupport"
+	"sync"
+)
+
+// volumeCache lists the zvols under a job's zfsDestination once, and shares the list between the pool task and its
+// images, rather than each image listing them again. The pool task resets it on every prep. Anything which renames a
+// zvol must call invalidate, and anything which needs to see newly created zvols (e.g. handleOrphans) must call it
+// first.
+type volumeCache struct {
+	mut        sync.Mutex
+	zfsContext *zfssupport.ZfsContext
+	volumes    map[string]*zfssupport.ZvolDestination
+}
+
+// reset points the cache at zfsContext, and forgets the current list
+func (c *volumeCache) reset(zfsContext *zfssupport.ZfsContext) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.zfsContext = zfsContext
+	c.volumes = nil
+}
+
+// invalidate forgets the current list, so that the next call to get lists the zvols again
+func (c *volumeCache) invalidate() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.volumes = nil
+}
+
+// get returns the zvols keyed by their path relative to zfsDestination, see zfssupport.ZfsContext.ChildVolumes. The
+// map must not be modified.
+func (c *volumeCache) get() (map[string]*zfssupport.ZvolDestination, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.volumes != nil {
+		return c.volumes, nil
+	}
+	volumes, err := c.zfsContext.ChildVolumes()
+	if err != nil {
+		return nil, util.Wrap("error listing zvols", err)
+	}
+	c.volumes = volumes
+	return volumes, nil
+}
@@ -1,18 +1,67 @@
 package cephsupport
 
 import (
+	"errors"
 	"fmt"
 	"github.com/ceph/go-ceph/rados"
 	"github.com/ceph/go-ceph/rbd"
 	"github.com/mattventura/ceph-to-zfs/pkg/ctz/config"
 	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
 	"github.com/mattventura/ceph-to-zfs/pkg/ctz/util"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// snapshotMetadataConcurrency is the maximum number of snapshots whose metadata is fetched at once
+const snapshotMetadataConcurrency = 8
+
+// snapNamespaceTypeMirror is RBD_SNAP_NAMESPACE_TYPE_MIRROR, which go-ceph does not define
+const snapNamespaceTypeMirror rbd.SnapNamespaceType = 3
+
+func snapNamespaceName(nsType rbd.SnapNamespaceType) string {
+	switch nsType {
+	case rbd.SnapNamespaceTypeUser:
+		return models.SnapNamespaceUser
+	case rbd.SnapNamespaceTypeGroup:
+		return "group"
+	case rbd.SnapNamespaceTypeTrash:
+		return "trash"
+	case snapNamespaceTypeMirror:
+		return "mirror"
+	default:
+		return fmt.Sprintf("unknown (%d)", nsType)
+	}
+}
+
+// PruneAfterMetadataPrefix is the prefix of the image metadata keys which record (as a unix timestamp) when a
+// quarantined snapshot may be deleted. RBD snapshots can't have metadata of their own, so the snapshot name is
+// appended to the prefix.
+const PruneAfterMetadataPrefix = "ctz.pruneafter."
+
+// KeepMetadataPrefix is the prefix of the image metadata keys which record (as a unix timestamp) when a snapshot was
+// released from quarantine by hand. Like PruneAfterMetadataPrefix, the snapshot name is appended to the prefix. Pruning
+// never quarantines or deletes a snapshot with this key.
+const KeepMetadataPrefix = "ctz.keep."
+
+// BaseMetadataPrefix is the prefix of the image metadata keys which record the replication base of each job, i.e.
+// the snapshot which ctz protected because the next incremental backup needs it. The job's hold tag is appended to
+// the prefix, and the value is the snapshot name.
+const BaseMetadataPrefix = "ctz.base."
+
+// BaseProtectedMetadataPrefix is the prefix of the image metadata keys which record that ctz protected a snapshot when
+// making it a replication base. The snapshot name is appended to the prefix. Snapshots which were already protected
+// (e.g. because they have clones) don't get this key, so ctz never unprotects them.
+const BaseProtectedMetadataPrefix = "ctz.baseprotected."
+
 // CephImageView is a wrapper over an RBD image.
 type CephImageView struct {
+	ioctx *rados.IOContext
 	image *rbd.Image
+	// snapshots caches the result of Snapshots. It is updated when snapshots are created or deleted through the view.
+	snapshots []*models.CephSnapshot
 }
 
 func (i *CephImageView) Name() string {
@@ -23,31 +72,107 @@ func (i *CephImageView) Size() (uint64, error) {
 	return i.image.GetSize()
 }
 
+// HasFeature indicates whether an RBD feature (e.g. rbd.FeatureFastDiff) is enabled on the image
+func (i *CephImageView) HasFeature(feature uint64) (bool, error) {
+	features, err := i.image.GetFeatures()
+	if err != nil {
+		return false, util.Wrap("error getting image features", err)
+	}
+	return features&feature != 0, nil
+}
+
+// HasFastDiff indicates whether the image has the fast-diff feature, which makes UsedBytes cheap
+func (i *CephImageView) HasFastDiff() (bool, error) {
+	return i.HasFeature(rbd.FeatureFastDiff)
+}
+
 func (i *CephImageView) SnapNames() ([]string, error) {
-	snaps, err := i.image.GetSnapshotNames()
+	snaps, err := i.Snapshots()
 	if err != nil {
 		return nil, err
 	}
-	snapNames := util.Map(snaps, func(in rbd.SnapInfo) string {
-		return in.Name
-	})
-	return snapNames, nil
+	return util.Map(snaps, func(in *models.CephSnapshot) string {
+		return in.Name()
+	}), nil
 }
 
+// Snapshots lists the snapshots of the image, in creation order, along with their timestamp, protection state and
+// number of children. The metadata is fetched concurrently, and the result is cached for the lifetime of the view.
 func (i *CephImageView) Snapshots() ([]*models.CephSnapshot, error) {
+	if i.snapshots != nil {
+		return i.snapshots, nil
+	}
 	snaps, err := i.image.GetSnapshotNames()
 	if err != nil {
 		return nil, err
 	}
 	out := make([]*models.CephSnapshot, len(snaps))
-	// TODO: this is slow to do in serial
+	errs := make([]error, len(snaps))
+	sem := make(chan struct{}, snapshotMetadataConcurrency)
+	wg := sync.WaitGroup{}
 	for j, snap := range snaps {
-		timestamp, err := i.image.GetSnapTimestamp(snap.Id)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			out[j], errs[j] = i.snapshotMetadata(snap)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
 		if err != nil {
 			return nil, err
 		}
-		out[j] = models.NewCephSnapshot(snap.Name, time.Unix(timestamp.Sec, timestamp.Nsec), snap.Id)
 	}
+	meta, err := i.image.ListMetadata()
+	if err != nil {
+		return nil, util.Wrap("error listing image metadata", err)
+	}
+	for _, snap := range out {
+		_, kept := meta[KeepMetadataPrefix+snap.Name()]
+		snap.SetKept(kept)
+		raw, found := meta[PruneAfterMetadataPrefix+snap.Name()]
+		if !found {
+			continue
+		}
+		unix, err := strconv.ParseInt(raw, 10, 64)
+		if err == nil {
+			snap.SetPruneAfter(time.Unix(unix, 0))
+		}
+	}
+	i.snapshots = out
+	return out, nil
+}
+
+// snapshotMetadata fetches the metadata for a single snapshot. It uses its own read-only handle, opened at the
+// snapshot, since listing children depends on the handle's current snapshot.
+func (i *CephImageView) snapshotMetadata(snap rbd.SnapInfo) (*models.CephSnapshot, error) {
+	img, err := rbd.OpenImageReadOnly(i.ioctx, i.image.GetName(), snap.Name)
+	if err != nil {
+		return nil, util.WrapFmt(err, "error opening snapshot %s", snap.Name)
+	}
+	defer img.Close()
+	timestamp, err := img.GetSnapTimestamp(snap.Id)
+	if err != nil {
+		return nil, util.WrapFmt(err, "error getting timestamp of snapshot %s", snap.Name)
+	}
+	protected, err := img.GetSnapshot(snap.Name).IsProtected()
+	if err != nil {
+		return nil, util.WrapFmt(err, "error checking if snapshot %s is protected", snap.Name)
+	}
+	_, children, err := img.ListChildren()
+	if err != nil {
+		return nil, util.WrapFmt(err, "error listing children of snapshot %s", snap.Name)
+	}
+	nsType, err := img.GetSnapNamespaceType(snap.Id)
+	if err != nil {
+		return nil, util.WrapFmt(err, "error getting namespace of snapshot %s", snap.Name)
+	}
+	out := models.NewCephSnapshot(snap.Name, time.Unix(timestamp.Sec, timestamp.Nsec), snap.Id)
+	out.Protected = protected
+	out.Children = len(children)
+	out.Namespace = snapNamespaceName(nsType)
 	return out, nil
 }
 
@@ -56,6 +181,7 @@ func (i *CephImageView) SnapAndActivate(snapName string) error {
 	if err != nil {
 		return util.WrapFmt(err, "error creating snapshot %s", snapName)
 	}
+	i.snapshots = nil
 	err = i.image.SetSnapshot(snapName)
 	if err != nil {
 		return util.WrapFmt(err, "error setting snapshot %s", snapName)
@@ -63,6 +189,20 @@ func (i *CephImageView) SnapAndActivate(snapName string) error {
 	return nil
 }
 
+// DiscardActiveSnapshot reverses SnapAndActivate, i.e. it switches back to the image head and removes the snapshot.
+func (i *CephImageView) DiscardActiveSnapshot(snapName string) error {
+	err := i.image.SetSnapshot(rbd.NoSnapshot)
+	if err != nil {
+		return util.Wrap("error switching back to image head", err)
+	}
+	err = i.image.GetSnapshot(snapName).Remove()
+	if err != nil {
+		return util.WrapFmt(err, "error deleting ceph snapshot %s", snapName)
+	}
+	i.forgetSnapshot(snapName)
+	return nil
+}
+
 func (i *CephImageView) ObjSize() (uint64, error) {
 	stat, err := i.image.Stat()
 	if err != nil {
@@ -88,6 +228,29 @@ func (i *CephImageView) DiffIter(snapName string, callback rbd.DiffIterateCallba
 	return nil
 }
 
+// UsedBytes is the amount of data allocated in the image (or the currently set snapshot), which is size bytes long.
+// This is cheap if the fast-diff feature is enabled, otherwise every object needs to be checked, see HasFeature.
+func (i *CephImageView) UsedBytes(size uint64) (uint64, error) {
+	var used uint64
+	err := i.image.DiffIterate(rbd.DiffIterateConfig{
+		Offset:        0,
+		Length:        size,
+		SnapName:      rbd.NoSnapshot,
+		IncludeParent: rbd.IncludeParent,
+		WholeObject:   rbd.EnableWholeObject,
+		Callback: func(offset uint64, length uint64, exists int, _ interface{}) int {
+			if exists > 0 {
+				used += length
+			}
+			return 0
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return used, nil
+}
+
 func (i *CephImageView) Read(offset uint64, length uint64) ([]byte, error) {
 	out := make([]byte, length)
 	_, err := i.image.ReadAt(out, int64(offset))
@@ -99,6 +262,7 @@ func (i *CephImageView) Read(offset uint64, length uint64) ([]byte, error) {
 
 func (i *CephImageView) DeleteSnapshot(snap *models.CephSnapshot) error {
 	snapshot := i.image.GetSnapshot(snap.Name())
+	// Re-check rather than relying on snap.Protected, since the snapshot may have been protected since it was listed
 	protected, err := snapshot.IsProtected()
 	if err != nil {
 		return util.WrapFmt(err, "error checking if snapshot %s is protected", snap.Name())
@@ -110,11 +274,177 @@ func (i *CephImageView) DeleteSnapshot(snap *models.CephSnapshot) error {
 	if err != nil {
 		return util.WrapFmt(err, "error deleting ceph snapshot %s", snap.Name())
 	}
+	i.forgetSnapshot(snap.Name())
+	if !snap.PruneAfter().IsZero() {
+		return i.ReleaseSnapshot(snap)
+	}
 	return nil
 }
 
-func NewCephImageView(image *rbd.Image) *CephImageView {
-	return &CephImageView{image: image}
+// QuarantineSnapshot marks the snapshot to be deleted after the given time, see PruneAfterMetadataPrefix
+func (i *CephImageView) QuarantineSnapshot(snap *models.CephSnapshot, until time.Time) error {
+	err := i.image.SetMetadata(PruneAfterMetadataPrefix+snap.Name(), strconv.FormatInt(until.Unix(), 10))
+	if err != nil {
+		return util.WrapFmt(err, "error quarantining ceph snapshot %s", snap.Name())
+	}
+	snap.SetPruneAfter(until)
+	return nil
+}
+
+// ReleaseSnapshot reverses QuarantineSnapshot. It is also used to clean up after a quarantined snapshot is deleted.
+func (i *CephImageView) ReleaseSnapshot(snap *models.CephSnapshot) error {
+	err := i.image.RemoveMetadata(PruneAfterMetadataPrefix + snap.Name())
+	if err != nil {
+		return util.WrapFmt(err, "error releasing ceph snapshot %s from quarantine", snap.Name())
+	}
+	snap.SetPruneAfter(time.Time{})
+	return nil
+}
+
+// KeepSnapshot marks the snapshot so that pruning leaves it alone from now on, see KeepMetadataPrefix. The mark can
+// only be removed by hand, with "rbd image-meta remove".
+func (i *CephImageView) KeepSnapshot(snap *models.CephSnapshot, when time.Time) error {
+	err := i.image.SetMetadata(KeepMetadataPrefix+snap.Name(), strconv.FormatInt(when.Unix(), 10))
+	if err != nil {
+		return util.WrapFmt(err, "error marking ceph snapshot %s to be kept", snap.Name())
+	}
+	snap.SetKept(true)
+	return nil
+}
+
+// ProtectBase protects the named snapshot (unless it is already protected, see BaseProtectedMetadataPrefix), and
+// records it as the replication base for tag, see BaseMetadataPrefix. It returns the previous base for tag, which is not unprotected, so that the caller can
+// do that once the new base is in place on both sides (see UnprotectBase). Snapshots can only be protected if the
+// image has the layering feature, so without it, only the record is kept.
+func (i *CephImageView) ProtectBase(name string, tag string) (previous string, err error) {
+	previous, err = i.base(tag)
+	if err != nil {
+		return "", err
+	}
+	layering, err := i.HasFeature(rbd.FeatureLayering)
+	if err != nil {
+		return "", err
+	}
+	if layering {
+		snapshot := i.image.GetSnapshot(name)
+		protected, err := snapshot.IsProtected()
+		if err != nil {
+			return "", util.WrapFmt(err, "error checking if snapshot %s is protected", name)
+		}
+		if !protected {
+			// Recorded first, so that a failure can't leave behind a protection which ctz doesn't know it made
+			err = i.image.SetMetadata(BaseProtectedMetadataPrefix+name, strconv.FormatInt(time.Now().Unix(), 10))
+			if err != nil {
+				return "", util.WrapFmt(err, "error recording protection of ceph snapshot %s", name)
+			}
+			err = snapshot.Protect()
+			if err != nil {
+				return "", util.WrapFmt(err, "error protecting ceph snapshot %s", name)
+			}
+		}
+		i.setCachedProtected(name, true)
+	}
+	err = i.image.SetMetadata(BaseMetadataPrefix+tag, name)
+	if err != nil {
+		return "", util.WrapFmt(err, "error recording ceph snapshot %s as replication base", name)
+	}
+	return previous, nil
+}
+
+// ClearBase removes the record of the replication base for tag, and returns the snapshot it named (or "" if there was
+// none). Like ProtectBase, the snapshot is left protected.
+func (i *CephImageView) ClearBase(tag string) (previous string, err error) {
+	previous, err = i.base(tag)
+	if err != nil || previous == "" {
+		return "", err
+	}
+	err = i.image.RemoveMetadata(BaseMetadataPrefix + tag)
+	if err != nil {
+		return "", util.WrapFmt(err, "error removing replication base record for %s", tag)
+	}
+	return previous, nil
+}
+
+// UnprotectBase unprotects a former replication base, unless it is still the replication base for any tag (i.e. for
+// another job). Only snapshots which ctz protected itself are unprotected, see BaseProtectedMetadataPrefix. Snapshots
+// which no longer exist, and images without the layering feature, are ignored.
+func (i *CephImageView) UnprotectBase(name string) error {
+	meta, err := i.image.ListMetadata()
+	if err != nil {
+		return util.Wrap("error listing image metadata", err)
+	}
+	for key, value := range meta {
+		if strings.HasPrefix(key, BaseMetadataPrefix) && value == name {
+			return nil
+		}
+	}
+	if _, ok := meta[BaseProtectedMetadataPrefix+name]; !ok {
+		return nil
+	}
+	snapNames, err := i.SnapNames()
+	if err != nil {
+		return err
+	}
+	layering, err := i.HasFeature(rbd.FeatureLayering)
+	if err != nil {
+		return err
+	}
+	if layering && slices.Contains(snapNames, name) {
+		snapshot := i.image.GetSnapshot(name)
+		protected, err := snapshot.IsProtected()
+		if err != nil {
+			return util.WrapFmt(err, "error checking if snapshot %s is protected", name)
+		}
+		if protected {
+			err = snapshot.Unprotect()
+			if err != nil {
+				return util.WrapFmt(err, "error unprotecting ceph snapshot %s", name)
+			}
+		}
+		i.setCachedProtected(name, false)
+	}
+	err = i.image.RemoveMetadata(BaseProtectedMetadataPrefix + name)
+	if err != nil {
+		return util.WrapFmt(err, "error removing protection record of ceph snapshot %s", name)
+	}
+	return nil
+}
+
+// base returns the replication base for tag, or "" if there is none
+func (i *CephImageView) base(tag string) (string, error) {
+	name, err := i.image.GetMetadata(BaseMetadataPrefix + tag)
+	if errors.Is(err, rbd.ErrNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", util.WrapFmt(err, "error reading replication base record for %s", tag)
+	}
+	return name, nil
+}
+
+// setCachedProtected updates the cached snapshot list after protecting or unprotecting a snapshot, so that pruning
+// sees the change
+func (i *CephImageView) setCachedProtected(name string, protected bool) {
+	for _, snap := range i.snapshots {
+		if snap.Name() == name {
+			snap.Protected = protected
+		}
+	}
+}
+
+// forgetSnapshot removes a deleted snapshot from the cached snapshot list
+func (i *CephImageView) forgetSnapshot(name string) {
+	if i.snapshots == nil {
+		return
+	}
+	i.snapshots = slices.DeleteFunc(slices.Clone(i.snapshots), func(snap *models.CephSnapshot) bool {
+		return snap.Name() == name
+	})
+}
+
+// NewCephImageView wraps an image. ioctx must be the IOContext (including namespace) that the image was opened with.
+func NewCephImageView(ioctx *rados.IOContext, image *rbd.Image) *CephImageView {
+	return &CephImageView{ioctx: ioctx, image: image}
 }
 
 func Connect(cfg *config.CephClusterConfig) (*rados.Conn, error) {
@@ -9,7 +9,20 @@ import (
 	"os"
 )
 
+// subcommands are run instead of the main program if they are given as the first argument. They receive the remaining
+// arguments and return the exit code.
+var subcommands = map[string]func(args []string) int{
+	"simulate-pruning": simulatePruning,
+	"prune":            prune,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		subcommand, ok := subcommands[os.Args[1]]
+		if ok {
+			os.Exit(subcommand(os.Args[2:]))
+		}
+	}
 	webEnable := flag.Bool("web", false, "enable web interface")
 	webPort := flag.Int("webport", 9999, "web interface port")
 	oneShot := flag.Bool("oneshot", false, "run all jobs once and exit")
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/backup"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/config/builder"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/task"
+)
+
+// prune implements the prune subcommand, which prunes a job or a single image without backing it up, and returns the
+// exit code
+func prune(args []string) int {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	configFile := flags.String("config", "./config.yaml", "config file")
+	jobId := flags.String("job", "", "ID of the job to prune")
+	image := flags.String("image", "", "ID of a single image to prune, e.g. 'image' or 'namespace:image', prefixed with 'pool/' for multi-pool jobs (optional)")
+	dryRun := flags.Bool("dry-run", false, "only report what would be pruned")
+	_ = flags.Parse(args)
+
+	if *jobId == "" {
+		fmt.Println("-job must be specified")
+		return 1
+	}
+	cfg, err := builder.FromYamlFile(*configFile)
+	if err != nil {
+		fmt.Printf("Error reading config file: %v\n", err)
+		return 1
+	}
+	cfg.Globals.DisableAllCron = true
+	top, err := backup.NewTopLevelTask(cfg)
+	if err != nil {
+		fmt.Printf("Error creating top level task: %v\n", err)
+		return 1
+	}
+	job := task.Find(top, *jobId)
+	if job == nil {
+		fmt.Printf("Job '%v' not found\n", *jobId)
+		return 1
+	}
+	target := job
+	if *image != "" {
+		// Images are only known once the job has enumerated them
+		err = job.(task.PreparableTask).Prepare()
+		if err != nil {
+			fmt.Printf("Error preparing job: %v\n", err)
+			return 1
+		}
+		target = task.Find(job, *image)
+		if target == nil {
+			fmt.Printf("Image '%v' not found in job '%v'\n", *image, *jobId)
+			return 1
+		}
+	}
+	prunable, ok := target.(task.PrunableTask)
+	if !ok {
+		fmt.Printf("'%v' can't be pruned\n", target.Label())
+		return 1
+	}
+	err = prunable.Prune(*dryRun)
+	if err != nil {
+		fmt.Printf("Pruning failed: %v\n", err)
+		return 1
+	}
+	if target.StatusLog().Status().Type().IsBad() {
+		fmt.Printf("Pruning failed: %v\n", target.StatusLog().Status().Msg())
+		return 1
+	}
+	fmt.Println("Pruning completed successfully")
+	return 0
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/config/builder"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/pruning"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/simulate"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/util"
+	"strings"
+	"time"
+)
+
+// simulatePruning implements the simulate-pruning subcommand, and returns the exit code
+func simulatePruning(args []string) int {
+	flags := flag.NewFlagSet("simulate-pruning", flag.ExitOnError)
+	configFile := flags.String("config", "./config.yaml", "config file")
+	jobId := flags.String("job", "", "ID of the job whose pruning config should be simulated")
+	image := flags.String("image", "", "image name, to apply any overrides matching it by imageRegex (optional)")
+	cron := flags.String("cron", "", "schedule to simulate (default: the job's cron)")
+	span := flags.String("span", "90d", "how long to simulate for, e.g. 90d or 52w")
+	start := flags.String("start", "", "time of the first run, in RFC3339 format (default: now)")
+	written := flags.String("written", "0", "space used by each receiver snapshot, for spaceBudget rules, e.g. 2G")
+	timeline := flags.Bool("timeline", false, "print the snapshot counts after every run")
+	_ = flags.Parse(args)
+
+	cfg, err := builder.FromYamlFile(*configFile)
+	if err != nil {
+		fmt.Printf("Error reading config file: %v\n", err)
+		return 1
+	}
+	var opts simulate.Options
+	for _, job := range cfg.Jobs {
+		if job.Id != *jobId {
+			continue
+		}
+		imageConfig := job.ImageConfigFor(*image, nil)
+		opts.Job = job.Id
+		opts.SnapshotTemplate = imageConfig.SnapshotTemplate
+		opts.SrcPruning = imageConfig.SrcPruning
+		opts.RcvPruning = imageConfig.RcvPruning
+		if job.Cron != nil {
+			opts.Cron = *job.Cron
+		}
+		for _, o := range imageConfig.AppliedOverrides {
+			fmt.Printf("Applied override %v\n", o)
+		}
+	}
+	if opts.SrcPruning == nil {
+		fmt.Printf("Job '%v' not found\n", *jobId)
+		return 1
+	}
+	if *cron != "" {
+		opts.Cron = *cron
+	}
+	if opts.Cron == "" {
+		fmt.Println("The job has no cron, so -cron must be specified")
+		return 1
+	}
+	opts.Span, err = pruning.ParseDuration(*span)
+	if err != nil {
+		fmt.Printf("Invalid span: %v\n", err)
+		return 1
+	}
+	opts.Start = time.Now()
+	if *start != "" {
+		opts.Start, err = time.Parse(time.RFC3339, *start)
+		if err != nil {
+			fmt.Printf("Invalid start time: %v\n", err)
+			return 1
+		}
+	}
+	opts.WrittenPerSnapshot, err = util.ParseSize(*written)
+	if err != nil {
+		fmt.Printf("Invalid snapshot size: %v\n", err)
+		return 1
+	}
+
+	result, err := simulate.Run(opts)
+	if err != nil {
+		fmt.Printf("Simulation failed: %v\n", err)
+		return 1
+	}
+	if len(result.Steps) == 0 {
+		fmt.Println("The cron does not trigger within the simulated span")
+		return 1
+	}
+	if *timeline {
+		for _, step := range result.Steps {
+			fmt.Printf("%v  sender: %4d  receiver: %4d", step.Time.Format(time.DateTime), step.SenderCount, step.ReceiverCount)
+			if len(step.SenderDestroyed) > 0 {
+				fmt.Printf("  pruned from sender: %v", strings.Join(step.SenderDestroyed, ", "))
+			}
+			if len(step.ReceiverDestroyed) > 0 {
+				fmt.Printf("  pruned from receiver: %v", strings.Join(step.ReceiverDestroyed, ", "))
+			}
+			fmt.Println()
+		}
+		fmt.Println()
+	}
+	fmt.Printf("Simulated %v runs from %v to %v\n", len(result.Steps), result.Steps[0].Time.Format(time.DateTime), result.End.Format(time.DateTime))
+	printSide("Sender", result.Sender, result.End)
+	printSide("Receiver", result.Receiver, result.End)
+	return 0
+}
+
+func printSide(label string, summary simulate.SideSummary, end time.Time) {
+	fmt.Printf("\n%v: at most %v snapshots, oldest snapshot at most %v old\n", label, summary.MaxCount, formatAge(summary.MaxOldestAge))
+	fmt.Printf("%v surviving snapshots:\n", len(summary.Survivors))
+	for _, snap := range summary.Survivors {
+		printSurvivor(snap, end)
+	}
+}
+
+func printSurvivor(snap models.Snapshot, end time.Time) {
+	fmt.Printf("  %v (%v old)\n", snap.Name(), formatAge(end.Sub(snap.When())))
+}
+
+// formatAge formats a duration as days, hours and minutes, since time.Duration.String only goes up to hours
+func formatAge(d time.Duration) string {
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	hours := d / time.Hour
+	d -= hours * time.Hour
+	minutes := d / time.Minute
+	if days > 0 {
+		return fmt.Sprintf("%dd%dh%dm", days, hours, minutes)
+	}
+	if hours > 0 {
+		return fmt.Sprintf("%dh%dm", hours, minutes)
+	}
+	return fmt.Sprintf("%dm", minutes)
+}
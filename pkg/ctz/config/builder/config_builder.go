@@ -7,10 +7,13 @@ import (
 	"github.com/mattventura/ceph-to-zfs/pkg/ctz/config"
 	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
 	"github.com/mattventura/ceph-to-zfs/pkg/ctz/pruning"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/util"
 	"github.com/mattventura/ceph-to-zfs/pkg/ctz/zfssupport"
 	"gopkg.in/yaml.v3"
 	"os"
 	"regexp"
+	"strings"
+	"time"
 )
 
 var idPattern = regexp.MustCompile("^[a-zA-Z0-9._-]+$")
@@ -79,15 +82,58 @@ func FromYamlFile(path string) (*config.TopLevelProcessedConfig, error) {
 				return nil, err
 			}
 		}
-		if rawJob.CephPoolName == "" {
-			return nil, errors.New(fmt.Sprintf("name is missing in job config '%v'", i))
+		includeMeta, err := config.MetadataSelectorsFromConfig(rawJob.ImageIncludeMetadata)
+		if err != nil {
+			return nil, err
 		}
-		if rawJob.CephPoolName == "" {
-			return nil, errors.New(fmt.Sprintf("cephPoolName is missing in job config '%v'", rawJob.Label))
+		excludeMeta, err := config.MetadataSelectorsFromConfig(rawJob.ImageExcludeMetadata)
+		if err != nil {
+			return nil, err
+		}
+		poolSelectors := 0
+		if rawJob.CephPoolName != "" {
+			poolSelectors++
+		}
+		if len(rawJob.CephPoolNames) > 0 {
+			poolSelectors++
+		}
+		var poolRegex *regexp.Regexp
+		if rawJob.CephPoolRegex != "" {
+			poolSelectors++
+			poolRegex, err = regexp.Compile(rawJob.CephPoolRegex)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if poolSelectors == 0 {
+			return nil, errors.New(fmt.Sprintf("one of cephPoolName, cephPoolNames or cephPoolRegex is required in job config '%v'", rawJob.Label))
+		}
+		if poolSelectors > 1 {
+			return nil, errors.New(fmt.Sprintf("only one of cephPoolName, cephPoolNames or cephPoolRegex may be specified in job config '%v'", rawJob.Label))
 		}
 		if rawJob.ZfsDestination == "" {
 			return nil, errors.New(fmt.Sprintf("zfsDestination is missing in job config '%v'", rawJob.Label))
 		}
+		var namespaces []string
+		allNamespaces := false
+		for _, ns := range rawJob.CephNamespaces {
+			if ns == config.AllNamespacesWildcard {
+				allNamespaces = true
+			} else if strings.Contains(ns, "/") {
+				return nil, errors.New(fmt.Sprintf("invalid namespace '%v' in job config '%v'", ns, rawJob.Label))
+			} else {
+				namespaces = append(namespaces, ns)
+			}
+		}
+		if allNamespaces {
+			if len(rawJob.CephNamespaces) > 1 {
+				return nil, errors.New(fmt.Sprintf("cephNamespaces '%v' cannot be combined with other namespaces in job config '%v'", config.AllNamespacesWildcard, rawJob.Label))
+			}
+			namespaces = nil
+		} else if len(namespaces) == 0 {
+			// Only the default namespace
+			namespaces = []string{""}
+		}
 		var conc int
 		if rawJob.MaxConcurrency != nil {
 			conc = *rawJob.MaxConcurrency
@@ -98,23 +144,9 @@ func FromYamlFile(path string) (*config.TopLevelProcessedConfig, error) {
 			conc = config.DEFAULT_MAX_CONC
 		}
 
-		var srcPrune pruning.Pruner[*models.CephSnapshot]
-		var rcvPrune pruning.Pruner[*zfssupport.ZvolSnapshot]
-		if rawJob.Pruning != nil {
-			srcRules, err := pruning.RulesFromConfig[*models.CephSnapshot](rawJob.Pruning.KeepSender)
-			if err != nil {
-				return nil, err
-			}
-			srcPrune = pruning.NewPruner[*models.CephSnapshot](srcRules)
-			rcvRules, err := pruning.RulesFromConfig[*zfssupport.ZvolSnapshot](rawJob.Pruning.KeepReceiver)
-			if err != nil {
-				return nil, err
-			}
-			rcvPrune = pruning.NewPruner[*zfssupport.ZvolSnapshot](rcvRules)
-
-		} else {
-			srcPrune = pruning.NoPruner[*models.CephSnapshot]()
-			rcvPrune = pruning.NoPruner[*zfssupport.ZvolSnapshot]()
+		srcPrune, rcvPrune, err := buildPruners(rawJob.Pruning)
+		if err != nil {
+			return nil, err
 		}
 		if rawJob.Cron != nil {
 			valid := gronx.IsValid(*rawJob.Cron)
@@ -122,18 +154,69 @@ func FromYamlFile(path string) (*config.TopLevelProcessedConfig, error) {
 				return nil, errors.New(fmt.Sprintf("cron is invalid (%v)", rawJob.Cron))
 			}
 		}
+		if rawJob.PruneCron != nil {
+			valid := gronx.IsValid(*rawJob.PruneCron)
+			if !valid {
+				return nil, errors.New(fmt.Sprintf("pruneCron is invalid (%v) in job config '%v'", *rawJob.PruneCron, rawJob.Label))
+			}
+		}
+		var snapTemplate *config.SnapshotTemplate
+		if rawJob.SnapshotTemplate != nil {
+			snapTemplate, err = buildSnapshotTemplate(*rawJob.SnapshotTemplate)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("snapshotTemplate is invalid in job config '%v': %v", rawJob.Label, err))
+			}
+		}
+		var overrides []*config.ImageOverride
+		for j, rawOverride := range rawJob.Overrides {
+			override, err := buildOverride(rawOverride, j)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("override #%v is invalid in job config '%v': %v", j, rawJob.Label, err))
+			}
+			overrides = append(overrides, override)
+		}
+		err = validateZvolProperties(rawJob.ZvolProperties)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("zvolProperties is invalid in job config '%v': %v", rawJob.Label, err))
+		}
+		spaceCheck, err := buildSpaceCheck(rawJob.SpaceCheck)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("spaceCheck is invalid in job config '%v': %v", rawJob.Label, err))
+		}
+		orphans, err := buildOrphanConfig(rawJob.Orphans)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("orphans config is invalid in job config '%v': %v", rawJob.Label, err))
+		}
 		job := &config.RbdPoolJobProcessedConfig{
-			Id:                rawJob.Id,
-			Label:             rawJob.Label,
-			ClusterConfig:     clusterConfig,
-			CephPoolName:      rawJob.CephPoolName,
-			ZfsDestination:    rawJob.ZfsDestination,
-			ImageIncludeRegex: include,
-			ImageExcludeRegex: exclude,
-			MaxConcurrency:    conc,
-			SrcPruning:        srcPrune,
-			RcvPruning:        rcvPrune,
-			Cron:              rawJob.Cron,
+			Id:                   rawJob.Id,
+			Label:                rawJob.Label,
+			ClusterConfig:        clusterConfig,
+			CephPoolName:         rawJob.CephPoolName,
+			CephPoolNames:        rawJob.CephPoolNames,
+			CephPoolRegex:        poolRegex,
+			CephNamespaces:       namespaces,
+			AllNamespaces:        allNamespaces,
+			ZfsDestination:       rawJob.ZfsDestination,
+			ImageIncludeRegex:    include,
+			ImageExcludeRegex:    exclude,
+			ImageIncludeMetadata: includeMeta,
+			ImageExcludeMetadata: excludeMeta,
+			MaxConcurrency:       conc,
+			SrcPruning:           srcPrune,
+			RcvPruning:           rcvPrune,
+			Cron:                 rawJob.Cron,
+			PruneCron:            rawJob.PruneCron,
+			Pruning:              rawJob.Pruning,
+			SnapshotTemplate:     snapTemplate,
+			Hooks:                rawJob.Hooks,
+			Priority:             rawJob.Priority,
+			Overrides:            overrides,
+			Orphans:              orphans,
+			ZvolProperties:       rawJob.ZvolProperties,
+			Copy:                 rawJob.Copy,
+			SpaceCheck:           spaceCheck,
+			HoldBase:             rawJob.HoldBase == nil || *rawJob.HoldBase,
+			HoldTag:              config.HoldTagPrefix + rawJob.Id,
 		}
 		jobs = append(jobs, job)
 	}
@@ -142,3 +225,196 @@ func FromYamlFile(path string) (*config.TopLevelProcessedConfig, error) {
 	}
 	return cfg, nil
 }
+
+func buildPruners(raw *config.PruningRaw) (pruning.Pruner[*models.CephSnapshot], pruning.Pruner[*zfssupport.ZvolSnapshot], error) {
+	if raw == nil {
+		return pruning.NoPruner[*models.CephSnapshot](), pruning.NoPruner[*zfssupport.ZvolSnapshot](), nil
+	}
+	switch raw.InUseSnapshots {
+	case "", config.InUseKeep, config.InUseWarn:
+	default:
+		return nil, nil, errors.New(fmt.Sprintf("inUseSnapshots '%v' is invalid - must be '%v' or '%v'", raw.InUseSnapshots, config.InUseKeep, config.InUseWarn))
+	}
+	if raw.Quarantine != nil && raw.Quarantine.Duration() <= 0 {
+		return nil, nil, errors.New(fmt.Sprintf("quarantine '%v' is invalid - must be positive", raw.Quarantine.Duration()))
+	}
+	srcRules, err := pruning.RulesFromConfig[*models.CephSnapshot](raw.KeepSender)
+	if err != nil {
+		return nil, nil, err
+	}
+	rcvRules, err := pruning.RulesFromConfig[*zfssupport.ZvolSnapshot](raw.KeepReceiver)
+	if err != nil {
+		return nil, nil, err
+	}
+	srcPruner, err := pruning.NewGuardedPruner[*models.CephSnapshot](srcRules, raw.CountSender)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("countSender is invalid: %v", err))
+	}
+	rcvPruner, err := pruning.NewGuardedPruner[*zfssupport.ZvolSnapshot](rcvRules, raw.CountReceiver)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("countReceiver is invalid: %v", err))
+	}
+	return srcPruner, rcvPruner, nil
+}
+
+// buildSnapshotTemplate parses the template, and renders it with dummy data to catch errors such as references to
+// unknown fields, or characters which are not allowed in snapshot names. It is rendered at two times which differ in
+// every field, since a template which doesn't depend on the time would produce the same name for every backup.
+func buildSnapshotTemplate(raw string) (*config.SnapshotTemplate, error) {
+	tmpl, err := config.NewSnapshotTemplate(raw)
+	if err != nil {
+		return nil, err
+	}
+	data := config.SnapshotTemplateData{Job: "job", Pool: "pool", Namespace: "namespace", Image: "image"}
+	data.Time = time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	first, err := tmpl.Render(data)
+	if err != nil {
+		return nil, err
+	}
+	data.Time = time.Date(2012, 11, 24, 15, 36, 47, 0, time.UTC)
+	second, err := tmpl.Render(data)
+	if err != nil {
+		return nil, err
+	}
+	if first == second {
+		return nil, errors.New(fmt.Sprintf("template produces the same snapshot name ('%v') at different times", first))
+	}
+	return tmpl, nil
+}
+
+func buildOverride(raw config.ImageOverrideRaw, index int) (*config.ImageOverride, error) {
+	out := &config.ImageOverride{
+		Pruning:  raw.Pruning,
+		Hooks:    raw.Hooks,
+		Priority: raw.Priority,
+	}
+	err := validateZvolProperties(raw.ZvolProperties)
+	if err != nil {
+		return nil, err
+	}
+	out.ZvolProperties = raw.ZvolProperties
+	var descParts []string
+	if raw.ImageRegex != "" {
+		re, err := regexp.Compile(raw.ImageRegex)
+		if err != nil {
+			return nil, err
+		}
+		out.ImageRegex = re
+		descParts = append(descParts, "imageRegex="+raw.ImageRegex)
+	}
+	meta, err := config.MetadataSelectorsFromConfig(raw.ImageMetadata)
+	if err != nil {
+		return nil, err
+	}
+	out.ImageMetadata = meta
+	for _, sel := range meta {
+		descParts = append(descParts, sel.String())
+	}
+	if len(descParts) == 0 {
+		return nil, errors.New("override must specify imageRegex and/or imageMetadata")
+	}
+	out.Description = fmt.Sprintf("#%v (%v)", index, strings.Join(descParts, ", "))
+	if raw.Pruning != nil {
+		out.SrcPruning, out.RcvPruning, err = buildPruners(raw.Pruning)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if raw.SnapshotTemplate != nil {
+		out.SnapshotTemplate, err = buildSnapshotTemplate(*raw.SnapshotTemplate)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func buildOrphanConfig(raw *config.OrphanRawConfig) (*config.OrphanConfig, error) {
+	if raw == nil {
+		return config.DefaultOrphanConfig, nil
+	}
+	out := &config.OrphanConfig{
+		Policy:         config.OrphanPolicy(raw.Policy),
+		ArchiveDataset: raw.ArchiveDataset,
+	}
+	if raw.GracePeriod != nil {
+		out.GracePeriod = raw.GracePeriod.Duration()
+		if out.GracePeriod < 0 {
+			return nil, errors.New("gracePeriod must not be negative")
+		}
+	}
+	switch out.Policy {
+	case "":
+		out.Policy = config.OrphanKeep
+	case config.OrphanKeep:
+	case config.OrphanPrune:
+		if len(raw.KeepReceiver) == 0 {
+			return nil, errors.New("policy 'prune' requires keepReceiver rules")
+		}
+		rules, err := pruning.RulesFromConfig[*zfssupport.ZvolSnapshot](raw.KeepReceiver)
+		if err != nil {
+			return nil, err
+		}
+		out.Pruning = pruning.NewPruner[*zfssupport.ZvolSnapshot](rules)
+	case config.OrphanArchive:
+		if raw.ArchiveDataset == "" {
+			return nil, errors.New("policy 'archive' requires archiveDataset")
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown policy '%v'", raw.Policy))
+	}
+	return out, nil
+}
+
+func buildSpaceCheck(raw *config.SpaceCheckRawConfig) (*config.SpaceCheckConfig, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	out := &config.SpaceCheckConfig{}
+	if raw.Reserve != "" {
+		reserve, err := util.ParseSize(raw.Reserve)
+		if err != nil {
+			return nil, err
+		}
+		out.Reserve = reserve
+	}
+	switch raw.OnInsufficientSpace {
+	case "", "fail":
+	case "defer":
+		out.Defer = true
+	default:
+		return nil, errors.New(fmt.Sprintf("onInsufficientSpace must be 'fail' or 'defer', not '%v'", raw.OnInsufficientSpace))
+	}
+	return out, nil
+}
+
+// validateZvolProperties catches mistakes which would otherwise only show up when "zfs create" fails. Values of
+// native properties other than volblocksize are left for ZFS to validate.
+func validateZvolProperties(props *config.ZvolPropertiesConfig) error {
+	if props == nil {
+		return nil
+	}
+	if props.VolBlockSize != "" {
+		size, err := util.ParseSize(props.VolBlockSize)
+		if err != nil {
+			return err
+		}
+		if size < 512 || size > 16*1024*1024 || size&(size-1) != 0 {
+			return errors.New(fmt.Sprintf("volblocksize '%v' must be a power of 2 between 512 and 16M", props.VolBlockSize))
+		}
+	}
+	if props.Encryption != "" && props.Encryption != "off" {
+		if props.KeyFormat == "" || props.KeyLocation == "" {
+			return errors.New("encryption requires keyformat and keylocation")
+		}
+	}
+	for name := range props.UserProperties {
+		if !strings.Contains(name, ":") {
+			return errors.New(fmt.Sprintf("user property name '%v' must contain a colon", name))
+		}
+		if strings.HasPrefix(name, "ctz:") {
+			return errors.New(fmt.Sprintf("user property '%v' is reserved for ctz", name))
+		}
+	}
+	return nil
+}
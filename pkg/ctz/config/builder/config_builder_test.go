@@ -9,6 +9,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"regexp"
 	"testing"
+	"time"
 )
 
 func TestYamlFileGood(t *testing.T) {
@@ -25,12 +26,16 @@ func TestYamlFileGood(t *testing.T) {
 			ClusterName: "ceph",
 		},
 		CephPoolName:      "vm-pool",
+		CephNamespaces:    []string{""},
 		ZfsDestination:    "tank3/ceph-rbd-backups",
 		ImageIncludeRegex: regexp.MustCompile("vm-\\d+-disk-.*"),
 		ImageExcludeRegex: nil,
 		MaxConcurrency:    3,
 		SrcPruning:        pruning.NoPruner[*models.CephSnapshot](),
 		RcvPruning:        pruning.NoPruner[*zfssupport.ZvolSnapshot](),
+		Orphans:           config.DefaultOrphanConfig,
+		HoldBase:          true,
+		HoldTag:           "ctz-Backup_VMs",
 	}, jobs[0])
 	assert.Equal(t, &config.RbdPoolJobProcessedConfig{
 		Id:    "Backup_Templates",
@@ -41,12 +46,16 @@ func TestYamlFileGood(t *testing.T) {
 			ClusterName: "ceph2",
 		},
 		CephPoolName:      "vm-pool",
+		CephNamespaces:    []string{""},
 		ZfsDestination:    "tank3/ceph-rbd-backups",
 		ImageIncludeRegex: regexp.MustCompile("base-\\d+-disk-.*"),
 		ImageExcludeRegex: nil,
 		MaxConcurrency:    config.DEFAULT_MAX_CONC,
 		SrcPruning:        pruning.NoPruner[*models.CephSnapshot](),
 		RcvPruning:        pruning.NoPruner[*zfssupport.ZvolSnapshot](),
+		Orphans:           config.DefaultOrphanConfig,
+		HoldBase:          true,
+		HoldTag:           "ctz-Backup_Templates",
 	}, jobs[1])
 	assert.Equal(t, &config.RbdPoolJobProcessedConfig{
 		Id:    "Empty",
@@ -57,12 +66,16 @@ func TestYamlFileGood(t *testing.T) {
 			ClusterName: "ceph",
 		},
 		CephPoolName:      "vm-pool",
+		CephNamespaces:    []string{""},
 		ZfsDestination:    "tank3/ceph-rbd-backups",
 		ImageIncludeRegex: nil,
 		ImageExcludeRegex: regexp.MustCompile("nothing"),
 		MaxConcurrency:    config.DEFAULT_MAX_CONC,
 		SrcPruning:        pruning.NoPruner[*models.CephSnapshot](),
 		RcvPruning:        pruning.NoPruner[*zfssupport.ZvolSnapshot](),
+		Orphans:           config.DefaultOrphanConfig,
+		HoldBase:          true,
+		HoldTag:           "ctz-Empty",
 	}, jobs[2])
 	assert.Equal(t, &config.RbdPoolJobProcessedConfig{
 		Id:    "Fails",
@@ -73,12 +86,16 @@ func TestYamlFileGood(t *testing.T) {
 			ClusterName: "ceph",
 		},
 		CephPoolName:      "nonexistent",
+		CephNamespaces:    []string{""},
 		ZfsDestination:    "tank3/ceph-rbd-backups",
 		ImageIncludeRegex: regexp.MustCompile("foo"),
 		ImageExcludeRegex: regexp.MustCompile("bar"),
 		MaxConcurrency:    config.DEFAULT_MAX_CONC,
 		SrcPruning:        pruning.NoPruner[*models.CephSnapshot](),
 		RcvPruning:        pruning.NoPruner[*zfssupport.ZvolSnapshot](),
+		Orphans:           config.DefaultOrphanConfig,
+		HoldBase:          true,
+		HoldTag:           "ctz-Fails",
 	}, jobs[3])
 
 	//assert.Equal(t, "Backup_VMs", jobs[0].Id)
@@ -98,6 +115,47 @@ func TestYamlFilePruneRaw(t *testing.T) {
 	require.Len(t, jobs[2].Pruning.KeepSender, 2)
 	require.IsType(t, pruning.PruningEnum{}, jobs[2].Pruning.KeepSender[0])
 	require.Nil(t, jobs[2].Pruning.KeepReceiver)
+	assert.Equal(t, config.InUseWarn, jobs[2].Pruning.InUsePolicy())
+	assert.Equal(t, config.InUseKeep, jobs[1].Pruning.InUsePolicy())
+	assert.Equal(t, config.InUseKeep, jobs[0].Pruning.InUsePolicy())
+
+	assert.Equal(t, &pruning.CountGuard{Min: 3}, jobs[2].Pruning.CountSender)
+	assert.Equal(t, &pruning.CountGuard{Min: 3, Max: 500, Regex: "ctz-.*"}, jobs[2].Pruning.CountReceiver)
+	assert.Nil(t, jobs[3].Pruning.CountSender)
+
+	assert.Equal(t, 7*24*time.Hour, jobs[2].Pruning.QuarantinePeriod())
+	assert.Equal(t, time.Duration(0), jobs[3].Pruning.QuarantinePeriod())
+	assert.Equal(t, time.Duration(0), jobs[0].Pruning.QuarantinePeriod())
+
+	require.Len(t, jobs[3].Pruning.KeepSender, 1)
+	require.IsType(t, &pruning.PruneKeepNotReplicated{}, jobs[3].Pruning.KeepSender[0].Ret)
+	require.Len(t, jobs[3].Pruning.KeepReceiver, 3)
+	maxAge := jobs[3].Pruning.KeepReceiver[1].Ret.(*pruning.PruneMaxAge)
+	assert.Equal(t, 30*24*time.Hour, maxAge.Age.Duration())
+	anyRule := jobs[3].Pruning.KeepReceiver[2].Ret.(*pruning.PruneAny)
+	require.Len(t, anyRule.Rules, 2)
+	allRule := anyRule.Rules[0].Ret.(*pruning.PruneAll)
+	require.Len(t, allRule.Rules, 2)
+	assert.IsType(t, &pruning.PruneGrid{}, allRule.Rules[0].Ret)
+	assert.Equal(t, &pruning.PruneKeepRegex{Type: "regex", Regex: "ctz-.*"}, allRule.Rules[1].Ret)
+	notRule := anyRule.Rules[1].Ret.(*pruning.PruneNot)
+	assert.Equal(t, &pruning.PruneKeepRegex{Type: "regex", Regex: "tmp-.*"}, notRule.Rule.Ret)
+
+	require.Len(t, jobs[4].Pruning.KeepSender, 1)
+	assert.Equal(t, &pruning.PruneCalendar{
+		Type:     "calendar",
+		Days:     14,
+		Weeks:    8,
+		Months:   12,
+		Years:    5,
+		Timezone: "Europe/Berlin",
+		Regex:    "ctz-.*",
+	}, jobs[4].Pruning.KeepSender[0].Ret)
+
+	require.Len(t, jobs[4].Pruning.KeepReceiver, 2)
+	assert.True(t, jobs[4].Pruning.HasJobSpaceBudget())
+	assert.False(t, jobs[3].Pruning.HasJobSpaceBudget())
+	assert.False(t, jobs[0].Pruning.HasJobSpaceBudget())
 }
 func TestYamlFilePrune(t *testing.T) {
 	cfg, err := FromYamlFile("../testdata/test.pruning.yaml")
@@ -114,3 +172,276 @@ func TestYamlFilePrune(t *testing.T) {
 	//require.IsType(t, pruning.PruningEnum{}, jobs[2].Pruning.KeepSender[0])
 	//require.Nil(t, jobs[2].Pruning.KeepReceiver)
 }
+
+func TestYamlFileBadQuarantine(t *testing.T) {
+	_, err := FromYamlFile("../testdata/test.bad.quarantine.yaml")
+	require.ErrorContains(t, err, "quarantine '-24h0m0s' is invalid - must be positive")
+}
+
+func TestYamlFileBadPruning(t *testing.T) {
+	_, err := FromYamlFile("../testdata/test.bad.pruning.yaml")
+	require.ErrorContains(t, err, "inUseSnapshots 'delete' is invalid")
+}
+
+func TestYamlFileBadCountGuard(t *testing.T) {
+	_, err := FromYamlFile("../testdata/test.bad.countguard.yaml")
+	require.ErrorContains(t, err, "countReceiver is invalid: min (10) must not be greater than max (5)")
+}
+
+func TestYamlFileBadNotReplicated(t *testing.T) {
+	_, err := FromYamlFile("../testdata/test.bad.notreplicated.yaml")
+	require.ErrorContains(t, err, "notReplicated can only be used for the sender")
+}
+
+func TestYamlFileNamespaces(t *testing.T) {
+	cfg, err := FromYamlFile("../testdata/test.namespaces.yaml")
+	require.NoErrorf(t, err, "Error reading from yaml file")
+	jobs := cfg.Jobs
+	require.Len(t, jobs, 4)
+
+	assert.Equal(t, []string{""}, jobs[0].CephNamespaces)
+	assert.False(t, jobs[0].AllNamespaces)
+
+	assert.Equal(t, []string{"tenant-a"}, jobs[1].CephNamespaces)
+	assert.False(t, jobs[1].AllNamespaces)
+
+	assert.Equal(t, []string{"tenant-a", "tenant-b", ""}, jobs[2].CephNamespaces)
+	assert.False(t, jobs[2].AllNamespaces)
+
+	assert.Nil(t, jobs[3].CephNamespaces)
+	assert.True(t, jobs[3].AllNamespaces)
+}
+
+func TestYamlFileBadNamespaces(t *testing.T) {
+	_, err := FromYamlFile("../testdata/test.bad.namespaces.yaml")
+	require.ErrorContains(t, err, "cephNamespaces '*' cannot be combined with other namespaces")
+}
+
+func TestYamlFilePools(t *testing.T) {
+	cfg, err := FromYamlFile("../testdata/test.pools.yaml")
+	require.NoErrorf(t, err, "Error reading from yaml file")
+	jobs := cfg.Jobs
+	require.Len(t, jobs, 3)
+
+	assert.False(t, jobs[0].IsMultiPool())
+
+	assert.True(t, jobs[1].IsMultiPool())
+	assert.True(t, jobs[1].MatchesPool("k8s-pool"))
+	assert.False(t, jobs[1].MatchesPool("other-pool"))
+
+	assert.True(t, jobs[2].IsMultiPool())
+	assert.True(t, jobs[2].MatchesPool("rbd-ssd"))
+	assert.False(t, jobs[2].MatchesPool("vm-pool"))
+
+	derived := jobs[2].ForPool("rbd-ssd")
+	assert.False(t, derived.IsMultiPool())
+	assert.Equal(t, "PoolRegex", derived.Id)
+	assert.Equal(t, "rbd-ssd", derived.TaskId())
+	assert.Equal(t, "rbd-ssd", derived.Label)
+	assert.Equal(t, "rbd-ssd", derived.CephPoolName)
+	assert.Equal(t, "tank3/ceph-rbd-backups/rbd-ssd", derived.ZfsDestination)
+	assert.Nil(t, derived.Cron)
+	assert.Nil(t, derived.PruneCron)
+	// Holds are tagged with the job's own ID, not the pool's
+	assert.Equal(t, "ctz-PoolRegex", derived.HoldTag)
+	assert.False(t, derived.HoldBase)
+	// The original must not be modified
+	assert.Equal(t, "PoolRegex", jobs[2].Id)
+	assert.Equal(t, "PoolRegex", jobs[2].TaskId())
+	assert.NotNil(t, jobs[2].Cron)
+	require.NotNil(t, jobs[2].PruneCron)
+	assert.Equal(t, "30 3 * * *", *jobs[2].PruneCron)
+	assert.Nil(t, jobs[0].PruneCron)
+	assert.True(t, jobs[0].HoldBase)
+	assert.Equal(t, "ctz-SinglePool", jobs[0].HoldTag)
+}
+
+func TestYamlFilePoolsSnapshotTemplate(t *testing.T) {
+	cfg, err := FromYamlFile("../testdata/test.pools.yaml")
+	require.NoErrorf(t, err, "Error reading from yaml file")
+	// The derived job must render the same names as simulate-pruning, which only knows the job's own ID
+	derived := cfg.Jobs[2].ForPool("rbd-ssd")
+	imageConfig := derived.ImageConfigFor("rbd-ssd/vm-1", nil)
+	name, err := imageConfig.SnapshotTemplate.Render(config.SnapshotTemplateData{
+		Time:  time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Job:   derived.Id,
+		Pool:  derived.CephPoolName,
+		Image: "vm-1",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "ctz-PoolRegex-rbd-ssd-20240102", name)
+}
+
+func TestYamlFileBadPruneCron(t *testing.T) {
+	_, err := FromYamlFile("../testdata/test.bad.prunecron.yaml")
+	require.ErrorContains(t, err, "pruneCron is invalid (0 0 * *)")
+}
+
+func TestYamlFileBadPools(t *testing.T) {
+	_, err := FromYamlFile("../testdata/test.bad.pools.yaml")
+	require.ErrorContains(t, err, "only one of cephPoolName, cephPoolNames or cephPoolRegex")
+}
+
+func TestYamlFileMetadataSelectors(t *testing.T) {
+	cfg, err := FromYamlFile("../testdata/test.metadata.yaml")
+	require.NoErrorf(t, err, "Error reading from yaml file")
+	jobs := cfg.Jobs
+	require.Len(t, jobs, 1)
+	job := jobs[0]
+	require.True(t, job.HasMetadataSelectors())
+
+	// Sorted by key
+	require.Len(t, job.ImageIncludeMetadata, 2)
+	assert.Equal(t, "backup.enabled=true", job.ImageIncludeMetadata[0].String())
+	assert.Equal(t, "backup.policy=gold|silver", job.ImageIncludeMetadata[1].String())
+	require.Len(t, job.ImageExcludeMetadata, 1)
+
+	policy := job.ImageIncludeMetadata[1]
+	assert.True(t, policy.Matches(map[string]string{"backup.policy": "gold"}))
+	assert.True(t, policy.Matches(map[string]string{"backup.policy": "silver"}))
+	// Values must match in full
+	assert.False(t, policy.Matches(map[string]string{"backup.policy": "golden"}))
+	assert.False(t, policy.Matches(map[string]string{"other": "gold"}))
+	assert.False(t, policy.Matches(nil))
+}
+
+func TestYamlFileOverrides(t *testing.T) {
+	cfg, err := FromYamlFile("../testdata/test.overrides.yaml")
+	require.NoErrorf(t, err, "Error reading from yaml file")
+	jobs := cfg.Jobs
+	require.Len(t, jobs, 1)
+	job := jobs[0]
+	require.Len(t, job.Overrides, 2)
+	assert.True(t, job.NeedsImageMetadata())
+
+	when := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	data := config.SnapshotTemplateData{Time: when, Job: job.Id, Image: "db-1"}
+
+	// No overrides
+	plain := job.ImageConfigFor("vm-1", nil)
+	assert.Empty(t, plain.AppliedOverrides)
+	assert.Equal(t, 1, plain.Priority)
+	assert.Same(t, job.SrcPruning, plain.SrcPruning)
+	assert.Equal(t, "echo done", plain.Hooks.PostBackup)
+	name, err := plain.SnapshotTemplate.Render(data)
+	require.NoError(t, err)
+	assert.Equal(t, "backup-Overrides-20240506", name)
+
+	// Regex override
+	db := job.ImageConfigFor("db-1", nil)
+	assert.Len(t, db.AppliedOverrides, 1)
+	assert.Equal(t, 10, db.Priority)
+	assert.Same(t, job.Overrides[0].SrcPruning, db.SrcPruning)
+	assert.NotSame(t, job.SrcPruning, db.SrcPruning)
+	// Pruning is overridden as a whole
+	assert.Same(t, job.Overrides[0].RcvPruning, db.RcvPruning)
+
+	// Both overrides, the later one wins where they overlap
+	both := job.ImageConfigFor("db-1", map[string]string{"backup.policy": "gold"})
+	assert.Len(t, both.AppliedOverrides, 2)
+	assert.Equal(t, 10, both.Priority)
+	assert.Equal(t, "fsfreeze", both.Hooks.PreSnapshot)
+	assert.Equal(t, "", both.Hooks.PostBackup)
+	name, err = both.SnapshotTemplate.Render(data)
+	require.NoError(t, err)
+	assert.Equal(t, "gold-db-1-20240506", name)
+}
+
+func TestDefaultSnapshotTemplate(t *testing.T) {
+	cfg, err := FromYamlFile("../testdata/test.good.yaml")
+	require.NoErrorf(t, err, "Error reading from yaml file")
+	imageConfig := cfg.Jobs[0].ImageConfigFor("vm-1-disk-0", nil)
+	name, err := imageConfig.SnapshotTemplate.Render(config.SnapshotTemplateData{
+		Time: time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "ctz-2024-05-06-07:08:09", name)
+}
+
+func TestSnapshotTemplateValidation(t *testing.T) {
+	_, err := buildSnapshotTemplate(`gold-{{ .Image }}`)
+	require.ErrorContains(t, err, "template produces the same snapshot name ('gold-image') at different times")
+	_, err = buildSnapshotTemplate(`ctz/{{ .Time.Unix }}`)
+	require.ErrorContains(t, err, "snapshot name 'ctz/981173106' contains invalid character '/'")
+	_, err = buildSnapshotTemplate(`ctz@{{ .Time.Unix }}`)
+	require.ErrorContains(t, err, "contains invalid character '@'")
+	_, err = buildSnapshotTemplate(`{{ .Missing }}`)
+	require.Error(t, err)
+	_, err = buildSnapshotTemplate(config.DefaultSnapshotTemplate)
+	require.NoError(t, err)
+}
+
+func TestYamlFileOrphans(t *testing.T) {
+	cfg, err := FromYamlFile("../testdata/test.orphans.yaml")
+	require.NoErrorf(t, err, "Error reading from yaml file")
+	jobs := cfg.Jobs
+	require.Len(t, jobs, 3)
+
+	assert.Equal(t, config.DefaultOrphanConfig, jobs[0].Orphans)
+
+	prune := jobs[1].Orphans
+	assert.Equal(t, config.OrphanPrune, prune.Policy)
+	require.NotNil(t, prune.Pruning)
+
+	archive := jobs[2].Orphans
+	assert.Equal(t, config.OrphanArchive, archive.Policy)
+	assert.Equal(t, "tank3/ceph-rbd-archive", archive.ArchiveDataset)
+	assert.Equal(t, 7*24*time.Hour, archive.GracePeriod)
+	assert.Nil(t, archive.Pruning)
+}
+
+func TestYamlFileBadOrphans(t *testing.T) {
+	_, err := FromYamlFile("../testdata/test.bad.orphans.yaml")
+	require.ErrorContains(t, err, "policy 'archive' requires archiveDataset")
+}
+
+func TestYamlFileZvolProperties(t *testing.T) {
+	cfg, err := FromYamlFile("../testdata/test.zvolprops.yaml")
+	require.NoErrorf(t, err, "Error reading from yaml file")
+	jobs := cfg.Jobs
+	require.Len(t, jobs, 1)
+	job := jobs[0]
+	assert.Equal(t, config.CopyOptions{ZeroDetect: true}, job.Copy)
+
+	plain := job.ImageConfigFor("vm-1", nil)
+	assert.Equal(t, map[string]string{
+		"volblocksize":      "16K",
+		"compression":       "zstd",
+		"volmode":           "dev",
+		"encryption":        "on",
+		"keyformat":         "raw",
+		"keylocation":       "file:///etc/ctz/backup.key",
+		"com.example:owner": "backups",
+	}, plain.ZvolProperties.Properties())
+
+	// Overrides are merged property by property
+	db := job.ImageConfigFor("db-1", nil)
+	assert.Equal(t, map[string]string{
+		"volblocksize":      "64K",
+		"compression":       "zstd",
+		"volmode":           "dev",
+		"logbias":           "throughput",
+		"encryption":        "on",
+		"keyformat":         "raw",
+		"keylocation":       "file:///etc/ctz/backup.key",
+		"com.example:owner": "backups",
+		"com.example:tier":  "gold",
+	}, db.ZvolProperties.Properties())
+	// The job config must not be modified by the merge
+	assert.Len(t, job.ZvolProperties.UserProperties, 1)
+}
+
+func TestYamlFileBadZvolProperties(t *testing.T) {
+	_, err := FromYamlFile("../testdata/test.bad.zvolprops.yaml")
+	require.ErrorContains(t, err, "volblocksize '12K' must be a power of 2")
+}
+
+func TestYamlFileSpaceCheck(t *testing.T) {
+	cfg, err := FromYamlFile("../testdata/test.spacecheck.yaml")
+	require.NoErrorf(t, err, "Error reading from yaml file")
+	jobs := cfg.Jobs
+	require.Len(t, jobs, 3)
+	assert.Nil(t, jobs[0].SpaceCheck)
+	assert.Equal(t, &config.SpaceCheckConfig{}, jobs[1].SpaceCheck)
+	assert.Equal(t, &config.SpaceCheckConfig{Reserve: 100 << 30, Defer: true}, jobs[2].SpaceCheck)
+}
@@ -5,10 +5,18 @@ import (
 	"github.com/mattventura/ceph-to-zfs/pkg/ctz/pruning"
 	"github.com/mattventura/ceph-to-zfs/pkg/ctz/zfssupport"
 	"regexp"
+	"slices"
+	"time"
 )
 
 const DEFAULT_MAX_CONC = 2
 
+// AllNamespacesWildcard can be used in place of a namespace name to back up all RBD namespaces in a pool.
+const AllNamespacesWildcard = "*"
+
+// HoldTagPrefix is prepended to the job ID to form RbdPoolJobProcessedConfig.HoldTag
+const HoldTagPrefix = "ctz-"
+
 type TopLevelRawConfig struct {
 	Clusters map[string]*CephClusterConfig `yaml:"clusters" binding:"required"`
 	Jobs     []*RbdPoolJobRawConfig        `yaml:"jobs" binding:"required"`
@@ -36,33 +44,252 @@ var DefaultClusterConfig = &CephClusterConfig{
 }
 
 type RbdPoolJobRawConfig struct {
-	Id                string      `yaml:"id" binding:"required"`
-	Label             string      `yaml:"label" binding:"required"`
-	Cluster           string      `yaml:"cluster" binding:"required"`
-	CephPoolName      string      `yaml:"cephPoolName" binding:"required"`
-	ZfsDestination    string      `yaml:"zfsDestination" binding:"required"`
-	ImageIncludeRegex string      `yaml:"imageIncludeRegex" binding:"required"`
-	ImageExcludeRegex string      `yaml:"imageExcludeRegex" binding:"required"`
-	MaxConcurrency    *int        `yaml:"maxConcurrency" binding:"required"`
-	Pruning           *PruningRaw `yaml:"pruning"`
-	Cron              *string     `yaml:"cron""`
+	Id                string     `yaml:"id" binding:"required"`
+	Label             string     `yaml:"label" binding:"required"`
+	Cluster           string     `yaml:"cluster" binding:"required"`
+	CephPoolName      string     `yaml:"cephPoolName" binding:"required"`
+	CephPoolNames     []string   `yaml:"cephPoolNames"`
+	CephPoolRegex     string     `yaml:"cephPoolRegex"`
+	CephNamespaces    StringList `yaml:"cephNamespaces"`
+	ZfsDestination    string     `yaml:"zfsDestination" binding:"required"`
+	ImageIncludeRegex string     `yaml:"imageIncludeRegex" binding:"required"`
+	ImageExcludeRegex string     `yaml:"imageExcludeRegex" binding:"required"`
+	// Image metadata key -> value regex
+	ImageIncludeMetadata map[string]string `yaml:"imageIncludeMetadata"`
+	ImageExcludeMetadata map[string]string `yaml:"imageExcludeMetadata"`
+	MaxConcurrency       *int              `yaml:"maxConcurrency" binding:"required"`
+	Pruning              *PruningRaw       `yaml:"pruning"`
+	Cron                 *string           `yaml:"cron"`
+	// PruneCron schedules pruning without a backup, in addition to the pruning done after each backup
+	PruneCron *string `yaml:"pruneCron"`
+	// Go text/template, see SnapshotTemplateData
+	SnapshotTemplate *string            `yaml:"snapshotTemplate"`
+	Hooks            *HooksConfig       `yaml:"hooks"`
+	Priority         int                `yaml:"priority"`
+	Overrides        []ImageOverrideRaw `yaml:"overrides"`
+	Orphans          *OrphanRawConfig   `yaml:"orphans"`
+	// ZFS properties for newly created zvols
+	ZvolProperties *ZvolPropertiesConfig `yaml:"zvolProperties"`
+	Copy           CopyOptions           `yaml:"copy"`
+	SpaceCheck     *SpaceCheckRawConfig  `yaml:"spaceCheck"`
+	// HoldBase protects the replication base on both sides, see RbdPoolJobProcessedConfig.HoldBase. Defaults to true.
+	HoldBase *bool `yaml:"holdBase"`
+}
+
+type SpaceCheckRawConfig struct {
+	// Reserve is a size such as "100G"
+	Reserve             string `yaml:"reserve"`
+	OnInsufficientSpace string `yaml:"onInsufficientSpace"`
+}
+
+// SpaceCheckConfig controls the check that the destination has enough space for an image before anything is written.
+type SpaceCheckConfig struct {
+	// Reserve is the number of bytes which must still be available after the backup
+	Reserve uint64
+	// Defer marks images which don't fit as deferred rather than failed
+	Defer bool
+}
+
+// CopyOptions control how changed data is written to the zvol. Both options trade extra CPU time (and for
+// CompareBeforeWrite, extra reads from the zvol) for less space used by snapshots.
+type CopyOptions struct {
+	// ZeroDetect discards blocks which are all zeros instead of writing them
+	ZeroDetect bool `yaml:"zeroDetect" json:"zeroDetect"`
+	// CompareBeforeWrite reads the existing content of the zvol, and skips blocks which are unchanged
+	CompareBeforeWrite bool `yaml:"compareBeforeWrite" json:"compareBeforeWrite"`
+}
+
+type OrphanRawConfig struct {
+	Policy         string                `yaml:"policy"`
+	KeepReceiver   []pruning.PruningEnum `yaml:"keepReceiver"`
+	ArchiveDataset string                `yaml:"archiveDataset"`
+	GracePeriod    *pruning.Duration     `yaml:"gracePeriod"`
+}
+
+type OrphanPolicy string
+
+const (
+	// OrphanKeep only reports orphans
+	OrphanKeep OrphanPolicy = "keep"
+	// OrphanPrune applies a separate set of receiver pruning rules to orphans
+	OrphanPrune OrphanPolicy = "prune"
+	// OrphanArchive renames orphans into an archive dataset once the grace period has passed
+	OrphanArchive OrphanPolicy = "archive"
+)
+
+// OrphanConfig controls what happens to zvols under the job's zfsDestination which no longer correspond to an
+// included image, e.g. because the image was deleted or no longer matches the include regex.
+type OrphanConfig struct {
+	Policy         OrphanPolicy
+	Pruning        pruning.Pruner[*zfssupport.ZvolSnapshot]
+	ArchiveDataset string
+	GracePeriod    time.Duration
+}
+
+// DefaultOrphanConfig only reports orphans
+var DefaultOrphanConfig = &OrphanConfig{
+	Policy: OrphanKeep,
 }
 
 type PruningRaw struct {
-	KeepSender   []pruning.PruningEnum `yaml:"keepSender"`
-	KeepReceiver []pruning.PruningEnum `yaml:"keepReceiver"`
+	KeepSender   []pruning.PruningEnum `yaml:"keepSender" json:"keepSender"`
+	KeepReceiver []pruning.PruningEnum `yaml:"keepReceiver" json:"keepReceiver"`
+	// CountSender and CountReceiver limit the number of snapshots left by the keep rules on each side
+	CountSender   *pruning.CountGuard `yaml:"countSender" json:"countSender,omitempty"`
+	CountReceiver *pruning.CountGuard `yaml:"countReceiver" json:"countReceiver,omitempty"`
+	// InUseSnapshots is the InUsePolicy for source snapshots which would be pruned, but are still in use
+	InUseSnapshots InUsePolicy `yaml:"inUseSnapshots" json:"inUseSnapshots,omitempty"`
+	// Quarantine is a grace period between a snapshot being chosen for pruning and it being destroyed, see
+	// pruning.QuarantinePlan. If it is not set, snapshots are destroyed straight away.
+	Quarantine *pruning.Duration `yaml:"quarantine" json:"quarantine,omitempty"`
+}
+
+// InUsePolicy controls how source snapshots which can't be deleted (because they are protected, have clones, or
+// belong to rbd-mirror etc, see models.CephSnapshot.InUseReason) are treated. They are never deleted either way.
+type InUsePolicy string
+
+const (
+	// InUseKeep counts such snapshots as kept
+	InUseKeep InUsePolicy = "keep"
+	// InUseWarn logs a warning for each such snapshot
+	InUseWarn InUsePolicy = "warn"
+)
+
+// HasSpaceBudget indicates that the receiver rules include a spaceBudget rule (possibly nested in a combinator), which
+// needs the space used by the zvol's snapshots (see pruning.PruneContext).
+func (p *PruningRaw) HasSpaceBudget() bool {
+	if p == nil {
+		return false
+	}
+	return pruning.AnyRule(p.KeepReceiver, func(rule interface{}) bool {
+		_, ok := rule.(*pruning.PruneSpaceBudget)
+		return ok
+	})
+}
+
+// HasJobSpaceBudget indicates that the receiver rules include a job-scoped spaceBudget rule (possibly nested in a
+// combinator), which also needs the space used by the job's other zvols (see pruning.PruneContext).
+func (p *PruningRaw) HasJobSpaceBudget() bool {
+	if p == nil {
+		return false
+	}
+	return pruning.AnyRule(p.KeepReceiver, func(rule interface{}) bool {
+		budget, ok := rule.(*pruning.PruneSpaceBudget)
+		return ok && budget.Scope == pruning.SpaceBudgetJob
+	})
+}
+
+// QuarantinePeriod returns the configured grace period, or zero if snapshots should be destroyed straight away
+func (p *PruningRaw) QuarantinePeriod() time.Duration {
+	if p == nil || p.Quarantine == nil {
+		return 0
+	}
+	return p.Quarantine.Duration()
+}
+
+// InUsePolicy returns the configured policy, defaulting to InUseKeep
+func (p *PruningRaw) InUsePolicy() InUsePolicy {
+	if p == nil || p.InUseSnapshots == "" {
+		return InUseKeep
+	}
+	return p.InUseSnapshots
 }
 
 type RbdPoolJobProcessedConfig struct {
-	Id                string
-	Label             string
-	ClusterConfig     *CephClusterConfig
-	CephPoolName      string
+	Id            string
+	Label         string
+	ClusterConfig *CephClusterConfig
+	// CephPoolName is the pool to back up. If it is empty, then the job covers multiple pools, selected by either
+	// CephPoolNames or CephPoolRegex (see IsMultiPool).
+	CephPoolName  string
+	CephPoolNames []string
+	CephPoolRegex *regexp.Regexp
+	// CephNamespaces lists the RBD namespaces to back up. The default namespace is represented by the empty string.
+	CephNamespaces []string
+	// AllNamespaces indicates that every namespace in the pool (including the default namespace) should be backed up,
+	// in which case CephNamespaces is ignored.
+	AllNamespaces     bool
 	ZfsDestination    string
 	ImageIncludeRegex *regexp.Regexp
 	ImageExcludeRegex *regexp.Regexp
-	MaxConcurrency    int
-	SrcPruning        pruning.Pruner[*models.CephSnapshot]
-	RcvPruning        pruning.Pruner[*zfssupport.ZvolSnapshot]
-	Cron              *string
+	// ImageIncludeMetadata selectors must all match for an image to be included
+	ImageIncludeMetadata []*MetadataSelector
+	// ImageExcludeMetadata excludes an image if any of the selectors match
+	ImageExcludeMetadata []*MetadataSelector
+	MaxConcurrency       int
+	SrcPruning           pruning.Pruner[*models.CephSnapshot]
+	RcvPruning           pruning.Pruner[*zfssupport.ZvolSnapshot]
+	Cron                 *string
+	// PruneCron schedules pruning without a backup, see backup.RbdPoolBackupTask.Prune. It may be nil.
+	PruneCron *string
+	// Pruning is the raw pruning config, for display purposes
+	Pruning *PruningRaw
+	// SnapshotTemplate is nil if the job does not specify one, in which case DefaultSnapshotTemplate is used
+	SnapshotTemplate *SnapshotTemplate
+	Hooks            *HooksConfig
+	// Priority determines the order in which images are started - images with a higher priority are started first.
+	Priority  int
+	Overrides []*ImageOverride
+	Orphans   *OrphanConfig
+	// ZvolProperties may be nil if no properties are configured
+	ZvolProperties *ZvolPropertiesConfig
+	Copy           CopyOptions
+	// SpaceCheck is nil if the space check is disabled
+	SpaceCheck *SpaceCheckConfig
+	// HoldBase places a ZFS hold (tagged HoldTag) on the most recent snapshot that exists on both sides, and protects
+	// the matching RBD snapshot, so that nothing else can delete the base of the next incremental backup. Both move
+	// forward after each successful backup. If it is disabled, existing holds and protection are released instead.
+	HoldBase bool
+	// HoldTag identifies the job's holds. It is derived from the job ID, and is kept by ForPool so that it stays
+	// unique to the job.
+	HoldTag string
+	// PoolTaskId is set by ForPool to the pool name, and identifies the pool's task within the multi-pool job. See
+	// TaskId.
+	PoolTaskId string
+}
+
+// TaskId returns the ID of the task which runs this job. This is the job ID, except for jobs derived by ForPool, whose
+// tasks are named after their pool. Anything user-visible which is derived from the job (e.g. the Job field of
+// SnapshotTemplateData) uses Id instead, so that it is the same for every pool.
+func (j *RbdPoolJobProcessedConfig) TaskId() string {
+	if j.PoolTaskId != "" {
+		return j.PoolTaskId
+	}
+	return j.Id
+}
+
+// IsMultiPool indicates that this job covers more than one pool, and needs to be split into one job per pool (see
+// ForPool) after enumerating the pools in the cluster.
+func (j *RbdPoolJobProcessedConfig) IsMultiPool() bool {
+	return j.CephPoolName == ""
+}
+
+// MatchesPool indicates whether a multi-pool job should include the given pool.
+func (j *RbdPoolJobProcessedConfig) MatchesPool(pool string) bool {
+	if j.CephPoolRegex != nil {
+		return j.CephPoolRegex.MatchString(pool)
+	}
+	return slices.Contains(j.CephPoolNames, pool)
+}
+
+// ForPool derives a single-pool job from a multi-pool job. The resulting job keeps the ID of the job, but uses the pool
+// name as its label and task ID (see TaskId), and backs up to a child dataset of ZfsDestination named after the pool (escaped if necessary, see
+// zfssupport.EscapeNameComponent). Scheduling is left to the parent job, so
+// the derived job has no cron or prune cron.
+func (j *RbdPoolJobProcessedConfig) ForPool(pool string) *RbdPoolJobProcessedConfig {
+	out := *j
+	out.PoolTaskId = pool
+	out.Label = pool
+	out.CephPoolName = pool
+	out.CephPoolNames = nil
+	out.CephPoolRegex = nil
+	out.ZfsDestination = j.ZfsDestination + "/" + zfssupport.EscapeNameComponent(pool)
+	out.Cron = nil
+	out.PruneCron = nil
+	return &out
+}
+
+// HasMetadataSelectors indicates whether image metadata needs to be fetched in order to decide which images to back up.
+func (j *RbdPoolJobProcessedConfig) HasMetadataSelectors() bool {
+	return len(j.ImageIncludeMetadata) > 0 || len(j.ImageExcludeMetadata) > 0
 }
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/pruning"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/zfssupport"
+	"regexp"
+)
+
+// HooksConfig contains shell commands which are run at various points of an image backup. Each command is run with
+// /bin/sh -c, and receives the CTZ_JOB, CTZ_POOL, CTZ_NAMESPACE, CTZ_IMAGE and CTZ_SNAPSHOT environment variables.
+type HooksConfig struct {
+	// PreSnapshot runs before the RBD snapshot is created. If it fails, the backup fails.
+	PreSnapshot string `yaml:"preSnapshot" json:"preSnapshot,omitempty"`
+	// PostSnapshot runs after the RBD snapshot is created (or failed to be created), e.g. to thaw a filesystem that was
+	// frozen by PreSnapshot.
+	PostSnapshot string `yaml:"postSnapshot" json:"postSnapshot,omitempty"`
+	// PostBackup runs after the backup has finished. CTZ_RESULT is set to "success", "failure" or "deferred".
+	PostBackup string `yaml:"postBackup" json:"postBackup,omitempty"`
+}
+
+type ImageOverrideRaw struct {
+	ImageRegex       string            `yaml:"imageRegex"`
+	ImageMetadata    map[string]string `yaml:"imageMetadata"`
+	Pruning          *PruningRaw       `yaml:"pruning"`
+	SnapshotTemplate *string           `yaml:"snapshotTemplate"`
+	Hooks            *HooksConfig      `yaml:"hooks"`
+	Priority         *int              `yaml:"priority"`
+	// ZvolProperties are merged with the job's zvolProperties, see ZvolPropertiesConfig.Merge
+	ZvolProperties *ZvolPropertiesConfig `yaml:"zvolProperties"`
+}
+
+// ImageOverride overrides part of the job configuration for images which match it. An image matches if it matches
+// ImageRegex (if specified) and all ImageMetadata selectors. Nil fields are not overridden.
+type ImageOverride struct {
+	ImageRegex       *regexp.Regexp
+	ImageMetadata    []*MetadataSelector
+	Pruning          *PruningRaw
+	SrcPruning       pruning.Pruner[*models.CephSnapshot]
+	RcvPruning       pruning.Pruner[*zfssupport.ZvolSnapshot]
+	SnapshotTemplate *SnapshotTemplate
+	Hooks            *HooksConfig
+	Priority         *int
+	ZvolProperties   *ZvolPropertiesConfig
+	// Description is a short human-readable description of the override, for display purposes
+	Description string
+}
+
+// Matches indicates whether this override applies to an image. spec is the image name, prefixed by "namespace/" for
+// images outside the default namespace.
+func (o *ImageOverride) Matches(spec string, meta map[string]string) bool {
+	if o.ImageRegex != nil && !o.ImageRegex.MatchString(spec) {
+		return false
+	}
+	for _, sel := range o.ImageMetadata {
+		if !sel.Matches(meta) {
+			return false
+		}
+	}
+	return true
+}
+
+// ImageConfig is the effective configuration for a single image, i.e. the job configuration with any matching
+// overrides applied.
+type ImageConfig struct {
+	SrcPruning       pruning.Pruner[*models.CephSnapshot]     `json:"-"`
+	RcvPruning       pruning.Pruner[*zfssupport.ZvolSnapshot] `json:"-"`
+	Pruning          *PruningRaw                              `json:"pruning"`
+	SnapshotTemplate *SnapshotTemplate                        `json:"snapshotTemplate"`
+	Hooks            *HooksConfig                             `json:"hooks"`
+	Priority         int                                      `json:"priority"`
+	ZvolProperties   *ZvolPropertiesConfig                    `json:"zvolProperties"`
+	// AppliedOverrides lists the descriptions of the overrides which were applied, in order
+	AppliedOverrides []string `json:"appliedOverrides"`
+}
+
+// ImageConfigFor resolves the effective configuration for an image. Overrides are applied in order, so later
+// overrides take priority over earlier ones.
+func (j *RbdPoolJobProcessedConfig) ImageConfigFor(spec string, meta map[string]string) *ImageConfig {
+	out := &ImageConfig{
+		SrcPruning:       j.SrcPruning,
+		RcvPruning:       j.RcvPruning,
+		Pruning:          j.Pruning,
+		SnapshotTemplate: j.SnapshotTemplate,
+		Hooks:            j.Hooks,
+		Priority:         j.Priority,
+		ZvolProperties:   j.ZvolProperties,
+		AppliedOverrides: []string{},
+	}
+	if out.SnapshotTemplate == nil {
+		out.SnapshotTemplate = MustSnapshotTemplate(DefaultSnapshotTemplate)
+	}
+	for _, o := range j.Overrides {
+		if !o.Matches(spec, meta) {
+			continue
+		}
+		out.AppliedOverrides = append(out.AppliedOverrides, o.Description)
+		if o.Pruning != nil {
+			out.SrcPruning = o.SrcPruning
+			out.RcvPruning = o.RcvPruning
+			out.Pruning = o.Pruning
+		}
+		if o.SnapshotTemplate != nil {
+			out.SnapshotTemplate = o.SnapshotTemplate
+		}
+		if o.Hooks != nil {
+			out.Hooks = o.Hooks
+		}
+		if o.Priority != nil {
+			out.Priority = *o.Priority
+		}
+		out.ZvolProperties = out.ZvolProperties.Merge(o.ZvolProperties)
+	}
+	return out
+}
+
+// NeedsImageMetadata indicates whether image metadata needs to be fetched in order to select images or resolve their
+// configuration.
+func (j *RbdPoolJobProcessedConfig) NeedsImageMetadata() bool {
+	if j.HasMetadataSelectors() {
+		return true
+	}
+	for _, o := range j.Overrides {
+		if len(o.ImageMetadata) > 0 {
+			return true
+		}
+	}
+	return false
+}
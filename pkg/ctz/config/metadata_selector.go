@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+// MetadataSelector matches RBD images by a single image-meta key/value pair.
+type MetadataSelector struct {
+	Key string
+	// Value must match the entire metadata value
+	Value *regexp.Regexp
+}
+
+// NewMetadataSelector creates a MetadataSelector. The value regex is anchored, i.e. it must match the full value.
+func NewMetadataSelector(key string, valueRegex string) (*MetadataSelector, error) {
+	if key == "" {
+		return nil, fmt.Errorf("metadata selector key must not be empty")
+	}
+	re, err := regexp.Compile("^(?:" + valueRegex + ")$")
+	if err != nil {
+		return nil, err
+	}
+	return &MetadataSelector{Key: key, Value: re}, nil
+}
+
+// Matches indicates whether the image metadata contains the key, with a matching value.
+func (s *MetadataSelector) Matches(meta map[string]string) bool {
+	value, found := meta[s.Key]
+	if !found {
+		return false
+	}
+	return s.Value.MatchString(value)
+}
+
+// String formats the selector as key=regex, for use in logs and reasons.
+func (s *MetadataSelector) String() string {
+	// Strip the anchoring that was added in NewMetadataSelector
+	expr := s.Value.String()
+	return fmt.Sprintf("%v=%v", s.Key, expr[4:len(expr)-2])
+}
+
+// MetadataSelectorsFromConfig converts a raw key -> value regex map into a list of selectors, sorted by key.
+func MetadataSelectorsFromConfig(raw map[string]string) ([]*MetadataSelector, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	out := make([]*MetadataSelector, 0, len(keys))
+	for _, key := range keys {
+		sel, err := NewMetadataSelector(key, raw[key])
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata selector for key '%v': %w", key, err)
+		}
+		out = append(out, sel)
+	}
+	return out, nil
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultSnapshotTemplate produces names of the form ctz-YYYY-MM-dd-HH:mm:ss
+const DefaultSnapshotTemplate = `ctz-{{ .Time.Format "2006-01-02-15:04:05" }}`
+
+// SnapshotTemplateData is the data available to a snapshot name template.
+type SnapshotTemplateData struct {
+	Time      time.Time
+	Job       string
+	Pool      string
+	Namespace string
+	Image     string
+}
+
+// SnapshotTemplate is a text/template which produces snapshot names. See SnapshotTemplateData for available fields.
+type SnapshotTemplate struct {
+	raw  string
+	tmpl *template.Template
+}
+
+func NewSnapshotTemplate(raw string) (*SnapshotTemplate, error) {
+	tmpl, err := template.New("snapshotName").Option("missingkey=error").Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &SnapshotTemplate{raw: raw, tmpl: tmpl}, nil
+}
+
+func MustSnapshotTemplate(raw string) *SnapshotTemplate {
+	t, err := NewSnapshotTemplate(raw)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// Render produces a snapshot name, see CheckSnapshotName
+func (t *SnapshotTemplate) Render(data SnapshotTemplateData) (string, error) {
+	sb := strings.Builder{}
+	err := t.tmpl.Execute(&sb, data)
+	if err != nil {
+		return "", err
+	}
+	name := sb.String()
+	err = CheckSnapshotName(name)
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// CheckSnapshotName makes sure that a snapshot name is valid on both sides. The same name is used for the RBD and ZFS
+// snapshots, so only the characters which both allow are accepted: letters, digits, '_', '-', '.' and ':'.
+func CheckSnapshotName(name string) error {
+	if name == "" {
+		return fmt.Errorf("snapshot name is empty")
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		valid := (c >= 'a' && c <= 'z') ||
+			(c >= 'A' && c <= 'Z') ||
+			(c >= '0' && c <= '9') ||
+			c == '_' || c == '-' || c == '.' || c == ':'
+		if !valid {
+			return fmt.Errorf("snapshot name '%v' contains invalid character '%c'", name, c)
+		}
+	}
+	return nil
+}
+
+func (t *SnapshotTemplate) String() string {
+	return t.raw
+}
+
+func (t *SnapshotTemplate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.raw)
+}
+
+var _ json.Marshaler = &SnapshotTemplate{}
@@ -0,0 +1,19 @@
+package config
+
+// StringList is a list of strings which can also be specified in YAML as a single scalar string.
+type StringList []string
+
+// UnmarshalYAML uses the same "obsolete" unmarshaler style as the pruning config types.
+func (l *StringList) UnmarshalYAML(u func(any) error) error {
+	var single string
+	if err := u(&single); err == nil {
+		*l = StringList{single}
+		return nil
+	}
+	var list []string
+	if err := u(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"maps"
+)
+
+// ZvolPropertiesConfig contains ZFS properties which are set when a zvol is created. Empty fields are left to ZFS
+// (i.e. inherited or defaulted). Existing zvols are not modified, but differences are reported as drift.
+type ZvolPropertiesConfig struct {
+	// VolBlockSize is a size such as "16K". Note that this can't be changed after the zvol is created.
+	VolBlockSize string `yaml:"volblocksize" json:"volblocksize,omitempty"`
+	Compression  string `yaml:"compression" json:"compression,omitempty"`
+	VolMode      string `yaml:"volmode" json:"volmode,omitempty"`
+	Sync         string `yaml:"sync" json:"sync,omitempty"`
+	LogBias      string `yaml:"logbias" json:"logbias,omitempty"`
+	PrimaryCache string `yaml:"primarycache" json:"primarycache,omitempty"`
+	// Encryption, KeyFormat and KeyLocation can only be set at creation time. If Encryption is set (to anything other
+	// than "off"), KeyFormat and KeyLocation are required, since ctz can't answer a key prompt.
+	Encryption  string `yaml:"encryption" json:"encryption,omitempty"`
+	KeyFormat   string `yaml:"keyformat" json:"keyformat,omitempty"`
+	KeyLocation string `yaml:"keylocation" json:"keylocation,omitempty"`
+	// UserProperties are arbitrary ZFS user properties. Names must contain a colon, e.g. "com.example:owner".
+	UserProperties map[string]string `yaml:"userProperties" json:"userProperties,omitempty"`
+}
+
+// Properties returns the configured properties, keyed by ZFS property name
+func (p *ZvolPropertiesConfig) Properties() map[string]string {
+	out := make(map[string]string)
+	if p == nil {
+		return out
+	}
+	native := map[string]string{
+		"volblocksize": p.VolBlockSize,
+		"compression":  p.Compression,
+		"volmode":      p.VolMode,
+		"sync":         p.Sync,
+		"logbias":      p.LogBias,
+		"primarycache": p.PrimaryCache,
+		"encryption":   p.Encryption,
+		"keyformat":    p.KeyFormat,
+		"keylocation":  p.KeyLocation,
+	}
+	for name, value := range native {
+		if value != "" {
+			out[name] = value
+		}
+	}
+	maps.Copy(out, p.UserProperties)
+	return out
+}
+
+// Merge returns a copy of p with any fields which are set in other taking priority. User properties are merged
+// individually.
+func (p *ZvolPropertiesConfig) Merge(other *ZvolPropertiesConfig) *ZvolPropertiesConfig {
+	if p == nil {
+		return other
+	}
+	if other == nil {
+		return p
+	}
+	out := *p
+	set := func(dst *string, src string) {
+		if src != "" {
+			*dst = src
+		}
+	}
+	set(&out.VolBlockSize, other.VolBlockSize)
+	set(&out.Compression, other.Compression)
+	set(&out.VolMode, other.VolMode)
+	set(&out.Sync, other.Sync)
+	set(&out.LogBias, other.LogBias)
+	set(&out.PrimaryCache, other.PrimaryCache)
+	set(&out.Encryption, other.Encryption)
+	set(&out.KeyFormat, other.KeyFormat)
+	set(&out.KeyLocation, other.KeyLocation)
+	if len(other.UserProperties) > 0 {
+		out.UserProperties = maps.Clone(p.UserProperties)
+		if out.UserProperties == nil {
+			out.UserProperties = make(map[string]string)
+		}
+		maps.Copy(out.UserProperties, other.UserProperties)
+	}
+	return &out
+}
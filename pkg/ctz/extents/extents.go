@@ -0,0 +1,225 @@
+// Package extents post-processes the changed extents reported by an RBD diff, so that they can be applied efficiently
+// to a zvol.
+package extents
+
+import (
+	"slices"
+)
+
+// Extent is a byte range of an image
+type Extent struct {
+	Offset uint64
+	Length uint64
+	// Data indicates that the extent contains data which needs to be copied. Otherwise, the extent has been discarded
+	// (i.e. reads as zeros), and can be trimmed on the destination.
+	Data bool
+}
+
+// End is the offset of the first byte after the extent
+func (e Extent) End() uint64 {
+	return e.Offset + e.Length
+}
+
+// Stats sums up the sizes of a list of extents
+type Stats struct {
+	DataBytes    uint64
+	DiscardBytes uint64
+}
+
+func Sum(extents []Extent) Stats {
+	var out Stats
+	for _, e := range extents {
+		if e.Data {
+			out.DataBytes += e.Length
+		} else {
+			out.DiscardBytes += e.Length
+		}
+	}
+	return out
+}
+
+func alignDown(value uint64, blockSize uint64) uint64 {
+	return value - value%blockSize
+}
+
+func alignUp(value uint64, blockSize uint64) uint64 {
+	return alignDown(value+blockSize-1, blockSize)
+}
+
+// coalesce sorts extents and merges those which overlap or are adjacent. All extents must be of the same type.
+func coalesce(extents []Extent) []Extent {
+	slices.SortFunc(extents, func(a, b Extent) int {
+		if a.Offset < b.Offset {
+			return -1
+		} else if a.Offset > b.Offset {
+			return 1
+		}
+		return 0
+	})
+	var out []Extent
+	for _, e := range extents {
+		if e.Length == 0 {
+			continue
+		}
+		if len(out) > 0 {
+			last := &out[len(out)-1]
+			if e.Offset <= last.End() {
+				last.Length = max(last.End(), e.End()) - last.Offset
+				continue
+			}
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// Align expands data extents outward to multiples of blockSize, and shrinks discarded extents inward so that only
+// whole blocks are discarded. The partial blocks at either end of a discarded extent are turned into data extents,
+// since the zeros (along with the rest of the block) need to be written. The result is coalesced and sorted by offset,
+// with data extents split so that none are longer than maxLength (rounded down to a multiple of blockSize).
+//
+// Data for the expanded extents must be read from the same source (i.e. the RBD snapshot) as the original extents.
+// size is the size of the image - extents are never expanded past it, and the final block is treated as whole even
+// if size is not a multiple of blockSize.
+func Align(in []Extent, blockSize uint64, size uint64, maxLength uint64) []Extent {
+	if blockSize == 0 {
+		blockSize = 1
+	}
+	clip := func(e Extent) Extent {
+		if e.End() > size {
+			if e.Offset >= size {
+				e.Length = 0
+			} else {
+				e.Length = size - e.Offset
+			}
+		}
+		return e
+	}
+	var rawData []Extent
+	var rawDiscard []Extent
+	for _, e := range in {
+		e = clip(e)
+		if e.Data {
+			rawData = append(rawData, e)
+		} else {
+			rawDiscard = append(rawDiscard, e)
+		}
+	}
+	// Merge adjacent discards first, so that small neighbouring discards can add up to whole blocks
+	rawDiscard = coalesce(rawDiscard)
+
+	var data []Extent
+	var discard []Extent
+	expand := func(offset uint64, end uint64) {
+		start := alignDown(offset, blockSize)
+		data = append(data, clip(Extent{Offset: start, Length: alignUp(end, blockSize) - start, Data: true}))
+	}
+	for _, e := range rawData {
+		expand(e.Offset, e.End())
+	}
+	for _, e := range rawDiscard {
+		start := alignUp(e.Offset, blockSize)
+		end := alignDown(e.End(), blockSize)
+		if e.End() == size {
+			end = size
+		}
+		if start >= end {
+			expand(e.Offset, e.End())
+			continue
+		}
+		discard = append(discard, Extent{Offset: start, Length: end - start})
+		if e.Offset < start {
+			expand(e.Offset, start)
+		}
+		if end < e.End() {
+			expand(end, e.End())
+		}
+	}
+	data = coalesce(data)
+	discard = coalesce(discard)
+
+	chunk := alignDown(maxLength, blockSize)
+	if chunk == 0 {
+		chunk = blockSize
+	}
+	out := make([]Extent, 0, len(data)+len(discard))
+	for _, e := range data {
+		for e.Length > chunk {
+			out = append(out, Extent{Offset: e.Offset, Length: chunk, Data: true})
+			e.Offset += chunk
+			e.Length -= chunk
+		}
+		out = append(out, e)
+	}
+	out = append(out, discard...)
+	slices.SortFunc(out, func(a, b Extent) int {
+		if a.Offset < b.Offset {
+			return -1
+		} else if a.Offset > b.Offset {
+			return 1
+		}
+		return 0
+	})
+	return out
+}
+
+// Savings counts bytes of data extents which did not need to be written, see Refine
+type Savings struct {
+	// Zero is the number of bytes which were all zeros, and were discarded instead of written
+	Zero uint64
+	// Unchanged is the number of bytes which were skipped because the destination already had the same content
+	Unchanged uint64
+}
+
+func (s *Savings) Add(other Savings) {
+	s.Zero += other.Zero
+	s.Unchanged += other.Unchanged
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Refine splits a data extent into the parts which actually need to be applied to the destination, one block at a
+// time. data is the content of the extent. If existing is not nil, it is the current content of the destination, and
+// blocks which are unchanged are skipped. If zeroDetect is set, blocks which are all zeros are returned as discarded
+// extents rather than written. Adjacent blocks are coalesced.
+func Refine(extent Extent, data []byte, existing []byte, blockSize uint64, zeroDetect bool) ([]Extent, Savings) {
+	var savings Savings
+	if !extent.Data || (existing == nil && !zeroDetect) {
+		return []Extent{extent}, savings
+	}
+	if blockSize == 0 {
+		blockSize = extent.Length
+	}
+	var out []Extent
+	add := func(e Extent) {
+		if len(out) > 0 {
+			last := &out[len(out)-1]
+			if last.Data == e.Data && last.End() == e.Offset {
+				last.Length += e.Length
+				return
+			}
+		}
+		out = append(out, e)
+	}
+	for start := uint64(0); start < extent.Length; start += blockSize {
+		end := min(start+blockSize, extent.Length)
+		block := data[start:end]
+		if existing != nil && slices.Equal(block, existing[start:end]) {
+			savings.Unchanged += end - start
+			continue
+		}
+		zero := zeroDetect && isZero(block)
+		if zero {
+			savings.Zero += end - start
+		}
+		add(Extent{Offset: extent.Offset + start, Length: end - start, Data: !zero})
+	}
+	return out, savings
+}
@@ -0,0 +1,141 @@
+package extents
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+const k = 1024
+
+func data(offset uint64, length uint64) Extent {
+	return Extent{Offset: offset, Length: length, Data: true}
+}
+
+func discard(offset uint64, length uint64) Extent {
+	return Extent{Offset: offset, Length: length}
+}
+
+func TestAlignData(t *testing.T) {
+	in := []Extent{
+		data(5*k, 2*k),
+		data(20*k, 1*k),
+		data(40*k, 1*k),
+		data(100*k, 1*k),
+	}
+	out := Align(in, 16*k, 1024*k, 4096*k)
+	// Each extent touches a different block, but the blocks are adjacent, so they are coalesced
+	assert.Equal(t, []Extent{
+		data(0, 48*k),
+		data(96*k, 16*k),
+	}, out)
+	assert.Equal(t, Stats{DataBytes: 5 * k}, Sum(in))
+	assert.Equal(t, Stats{DataBytes: 64 * k}, Sum(out))
+}
+
+func TestAlignAlreadyAligned(t *testing.T) {
+	in := []Extent{
+		data(0, 16*k),
+		discard(16*k, 32*k),
+		data(64*k, 16*k),
+	}
+	assert.Equal(t, in, Align(in, 16*k, 1024*k, 4096*k))
+}
+
+func TestAlignDiscard(t *testing.T) {
+	in := []Extent{
+		discard(8*k, 36*k),
+	}
+	out := Align(in, 16*k, 1024*k, 4096*k)
+	assert.Equal(t, []Extent{
+		data(0, 16*k),
+		discard(16*k, 16*k),
+		data(32*k, 16*k),
+	}, out)
+}
+
+func TestAlignSmallDiscards(t *testing.T) {
+	// Too small on their own, but together they cover a whole block
+	in := []Extent{
+		discard(16*k, 8*k),
+		discard(24*k, 8*k),
+		// Less than a block, so it is written instead
+		discard(40*k, 4*k),
+	}
+	out := Align(in, 16*k, 1024*k, 4096*k)
+	assert.Equal(t, []Extent{
+		discard(16*k, 16*k),
+		data(32*k, 16*k),
+	}, out)
+}
+
+func TestAlignImageEnd(t *testing.T) {
+	size := uint64(100 * k)
+	in := []Extent{
+		data(90*k, 20*k),
+		discard(50*k, 10*k),
+	}
+	out := Align(in, 16*k, size, 4096*k)
+	assert.Equal(t, []Extent{
+		data(48*k, 16*k),
+		data(80*k, 20*k),
+	}, out)
+
+	// A discard up to the end of the image includes the final partial block
+	out = Align([]Extent{discard(64*k, 36*k)}, 16*k, size, 4096*k)
+	assert.Equal(t, []Extent{discard(64*k, 36*k)}, out)
+}
+
+func TestAlignSplit(t *testing.T) {
+	in := []Extent{
+		data(0, 100*k),
+	}
+	out := Align(in, 16*k, 1024*k, 40*k)
+	// maxLength is rounded down to 32K
+	assert.Equal(t, []Extent{
+		data(0, 32*k),
+		data(32*k, 32*k),
+		data(64*k, 32*k),
+		data(96*k, 16*k),
+	}, out)
+}
+
+func blocks(values ...byte) []byte {
+	var out []byte
+	for _, v := range values {
+		for i := 0; i < 4; i++ {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func TestRefineNoOptions(t *testing.T) {
+	e := data(16, 16)
+	out, savings := Refine(e, blocks(1, 0, 0, 1), nil, 4, false)
+	assert.Equal(t, []Extent{e}, out)
+	assert.Equal(t, Savings{}, savings)
+}
+
+func TestRefineZeroDetect(t *testing.T) {
+	out, savings := Refine(data(16, 20), blocks(1, 0, 0, 1, 0), nil, 4, true)
+	assert.Equal(t, []Extent{
+		data(16, 4),
+		discard(20, 8),
+		data(28, 4),
+		discard(32, 4),
+	}, out)
+	assert.Equal(t, Savings{Zero: 12}, savings)
+}
+
+func TestRefineCompare(t *testing.T) {
+	out, savings := Refine(data(16, 20), blocks(1, 2, 3, 0, 5), blocks(1, 9, 9, 9, 5), 4, true)
+	assert.Equal(t, []Extent{
+		data(20, 8),
+		discard(28, 4),
+	}, out)
+	assert.Equal(t, Savings{Zero: 4, Unchanged: 8}, savings)
+
+	out, savings = Refine(data(16, 8), blocks(1, 2), blocks(1, 2), 4, false)
+	assert.Empty(t, out)
+	assert.Equal(t, Savings{Unchanged: 8}, savings)
+}
@@ -1,12 +1,42 @@
 package models
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 type Snapshot interface {
 	Name() string
 	When() time.Time
 }
 
+// SizedSnapshot is a snapshot which knows how much space it uses
+type SizedSnapshot interface {
+	Snapshot
+	// SpaceUsed is the space which would be freed by destroying only this snapshot
+	SpaceUsed() uint64
+	// SpaceWritten is the space written between the previous snapshot and this one
+	SpaceWritten() uint64
+}
+
+// QuarantinedSnapshot is a snapshot which may have been marked by pruning, to be destroyed once a grace period has
+// passed (see pruning.PlanQuarantine)
+type QuarantinedSnapshot interface {
+	Snapshot
+	// PruneAfter is the end of the grace period, or the zero time if the snapshot is not quarantined
+	PruneAfter() time.Time
+	// Kept indicates that the snapshot was released from quarantine by hand, so it must not be quarantined or
+	// destroyed again
+	Kept() bool
+}
+
+// InUseSnapshot is implemented by snapshots which can be prevented from being deleted, e.g. by protection or holds
+type InUseSnapshot interface {
+	Snapshot
+	// InUseReason explains why the snapshot can't be deleted at the moment, or returns an empty string if it can be
+	InUseReason() string
+}
+
 type ComparableSnapshot interface {
 	Snapshot
 	comparable
@@ -16,8 +46,22 @@ type CephSnapshot struct {
 	name string
 	when time.Time
 	Id   uint64
+	// Protected indicates that the snapshot is protected, i.e. it can't be deleted
+	Protected bool
+	// Children is the number of images cloned from the snapshot
+	Children int
+	// Namespace is the RBD snapshot namespace, e.g. "user" for ordinary snapshots, or "mirror" for snapshots created
+	// by rbd-mirror. Snapshots outside the user namespace are managed by Ceph itself.
+	Namespace string
+	// pruneAfter is set by SetPruneAfter
+	pruneAfter time.Time
+	// kept is set by SetKept
+	kept bool
 }
 
+// SnapNamespaceUser is the namespace of snapshots created by users (including ctz)
+const SnapNamespaceUser = "user"
+
 func NewCephSnapshot(name string, when time.Time, id uint64) *CephSnapshot {
 	return &CephSnapshot{name: name, when: when, Id: id}
 }
@@ -30,4 +74,39 @@ func (c *CephSnapshot) When() time.Time {
 	return c.when
 }
 
-var _ Snapshot = &CephSnapshot{}
+func (c *CephSnapshot) PruneAfter() time.Time {
+	return c.pruneAfter
+}
+
+// SetPruneAfter records that the snapshot is quarantined until the given time. The zero time clears it.
+func (c *CephSnapshot) SetPruneAfter(when time.Time) {
+	c.pruneAfter = when
+}
+
+func (c *CephSnapshot) Kept() bool {
+	return c.kept
+}
+
+// SetKept records that the snapshot was released from quarantine by hand.
+func (c *CephSnapshot) SetKept(kept bool) {
+	c.kept = kept
+}
+
+// InUseReason explains why the snapshot can't be deleted at the moment, or returns an empty string if it can be.
+func (c *CephSnapshot) InUseReason() string {
+	switch {
+	case c.kept:
+		return "released from quarantine"
+	case c.Namespace != "" && c.Namespace != SnapNamespaceUser:
+		return fmt.Sprintf("in %s namespace", c.Namespace)
+	case c.Children > 0:
+		return fmt.Sprintf("has %d clone(s)", c.Children)
+	case c.Protected:
+		return "protected"
+	default:
+		return ""
+	}
+}
+
+var _ QuarantinedSnapshot = &CephSnapshot{}
+var _ InUseSnapshot = &CephSnapshot{}
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCephSnapshotInUseReason(t *testing.T) {
+	snap := NewCephSnapshot("foo", time.Unix(0, 0), 1)
+	assert.Equal(t, "", snap.InUseReason())
+	snap.Namespace = SnapNamespaceUser
+	assert.Equal(t, "", snap.InUseReason())
+	snap.Protected = true
+	assert.Equal(t, "protected", snap.InUseReason())
+	snap.Children = 2
+	assert.Equal(t, "has 2 clone(s)", snap.InUseReason())
+	snap.Namespace = "mirror"
+	assert.Equal(t, "in mirror namespace", snap.InUseReason())
+	snap.SetKept(true)
+	assert.Equal(t, "released from quarantine", snap.InUseReason())
+}
@@ -0,0 +1,72 @@
+package models
+
+import "slices"
+
+// SpaceUsage describes the space used by the backup of an image, or the sum of that for several images.
+type SpaceUsage struct {
+	// ZFS side, see the zfs properties of the same names
+	Used            uint64 `json:"used"`
+	UsedBySnapshots uint64 `json:"usedBySnapshots"`
+	Referenced      uint64 `json:"referenced"`
+	LogicalUsed     uint64 `json:"logicalUsed"`
+	// CompressRatio is the zvol's compressratio. For sums, it is recomputed as LogicalUsed / Used.
+	CompressRatio float64 `json:"compressRatio"`
+	// RbdProvisioned is the size of the RBD image
+	RbdProvisioned uint64 `json:"rbdProvisioned"`
+	// RbdUsed is the amount of data actually allocated in the RBD image. It is zero if the image does not have the
+	// fast-diff feature, since it is too expensive to find out otherwise.
+	RbdUsed uint64 `json:"rbdUsed"`
+	// Images is the number of images which are included in this usage
+	Images int `json:"images"`
+}
+
+// Add adds another usage to this one
+func (s *SpaceUsage) Add(other *SpaceUsage) {
+	if other == nil {
+		return
+	}
+	s.Used += other.Used
+	s.UsedBySnapshots += other.UsedBySnapshots
+	s.Referenced += other.Referenced
+	s.LogicalUsed += other.LogicalUsed
+	s.RbdProvisioned += other.RbdProvisioned
+	s.RbdUsed += other.RbdUsed
+	s.Images += other.Images
+	if s.Used > 0 {
+		s.CompressRatio = float64(s.LogicalUsed) / float64(s.Used)
+	} else {
+		s.CompressRatio = 1
+	}
+}
+
+// SpaceUsageSortFields lists the fields (by JSON name) which SortKey accepts
+var SpaceUsageSortFields = []string{"used", "usedBySnapshots", "referenced", "logicalUsed", "compressRatio", "rbdProvisioned", "rbdUsed", "images"}
+
+// SortKey returns the value of a field by its JSON name, for sorting. The second return value is false if the field
+// is unknown.
+func (s *SpaceUsage) SortKey(field string) (float64, bool) {
+	if !slices.Contains(SpaceUsageSortFields, field) {
+		return 0, false
+	}
+	if s == nil {
+		return 0, true
+	}
+	switch field {
+	case "used":
+		return float64(s.Used), true
+	case "usedBySnapshots":
+		return float64(s.UsedBySnapshots), true
+	case "referenced":
+		return float64(s.Referenced), true
+	case "logicalUsed":
+		return float64(s.LogicalUsed), true
+	case "compressRatio":
+		return s.CompressRatio, true
+	case "rbdProvisioned":
+		return float64(s.RbdProvisioned), true
+	case "rbdUsed":
+		return float64(s.RbdUsed), true
+	default:
+		return float64(s.Images), true
+	}
+}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSpaceUsageAdd(t *testing.T) {
+	total := &SpaceUsage{}
+	total.Add(&SpaceUsage{Used: 100, UsedBySnapshots: 10, LogicalUsed: 200, CompressRatio: 2, RbdUsed: 150, Images: 1})
+	total.Add(&SpaceUsage{Used: 300, UsedBySnapshots: 20, LogicalUsed: 300, CompressRatio: 1, RbdUsed: 250, Images: 1})
+	total.Add(nil)
+	assert.Equal(t, &SpaceUsage{
+		Used:            400,
+		UsedBySnapshots: 30,
+		LogicalUsed:     500,
+		CompressRatio:   1.25,
+		RbdUsed:         400,
+		Images:          2,
+	}, total)
+}
+
+func TestSpaceUsageSortKey(t *testing.T) {
+	s := &SpaceUsage{UsedBySnapshots: 42, CompressRatio: 1.5}
+	for _, field := range SpaceUsageSortFields {
+		_, ok := s.SortKey(field)
+		assert.True(t, ok, field)
+	}
+	key, _ := s.SortKey("usedBySnapshots")
+	assert.Equal(t, 42.0, key)
+	key, _ = s.SortKey("compressRatio")
+	assert.Equal(t, 1.5, key)
+	_, ok := s.SortKey("bogus")
+	assert.False(t, ok)
+}
@@ -1,6 +1,7 @@
 package pruning
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"gopkg.in/yaml.v3"
@@ -21,6 +22,13 @@ func (d Duration) Duration() time.Duration { return d.d }
 
 var _ ObsoleteUnmarshaler = &Duration{}
 
+// MarshalJSON allows the raw config to be displayed, e.g. in the web API
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(formatDuration(d.d))
+}
+
+var _ json.Marshaler = Duration{}
+
 func (d *Duration) UnmarshalYAML(unmarshal func(v interface{}) error) error {
 	var s string
 	err := unmarshal(&s)
@@ -65,6 +73,11 @@ func parsePositiveDuration(e string) (time.Duration, error) {
 
 var durationStringRegex *regexp.Regexp = regexp.MustCompile(`^\s*([\+-]?\d+)\s*(|s|m|h|d|w)\s*$`)
 
+// ParseDuration parses a duration in the same format as the config file, e.g. "30d" or "2w"
+func ParseDuration(e string) (time.Duration, error) {
+	return parseDuration(e)
+}
+
 func parseDuration(e string) (d time.Duration, err error) {
 	comps := durationStringRegex.FindStringSubmatch(e)
 	if comps == nil {
@@ -108,3 +121,23 @@ func parseDuration(e string) (d time.Duration, err error) {
 	d = time.Duration(durationFactor) * durationUnit
 	return
 }
+
+// formatDuration is the inverse of parseDuration, using the largest unit which evenly divides the duration.
+func formatDuration(d time.Duration) string {
+	units := []struct {
+		suffix string
+		unit   time.Duration
+	}{
+		{"w", 24 * 7 * time.Hour},
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+	}
+	for _, u := range units {
+		if d != 0 && d%u.unit == 0 {
+			return fmt.Sprintf("%d%s", d/u.unit, u.suffix)
+		}
+	}
+	return fmt.Sprintf("%ds", d/time.Second)
+}
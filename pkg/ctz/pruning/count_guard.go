@@ -0,0 +1,95 @@
+package pruning
+
+import (
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
+	"github.com/pkg/errors"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// CountGuard limits the number of snapshots that remain after pruning, regardless of the keep rules. Zero means no
+// limit. Only snapshots which match Regex are counted, and only those are kept or destroyed by the guard. Snapshots
+// which are in use (see models.InUseSnapshot) can't be destroyed, so they are counted as kept.
+type CountGuard struct {
+	// Min is the minimum number of snapshots to keep. If the rules would leave fewer, the newest of the snapshots
+	// they would destroy are kept instead.
+	Min int `yaml:"min" json:"min,omitempty"`
+	// Max is the maximum number of snapshots to keep. If the rules would leave more, the oldest of the remaining
+	// snapshots are destroyed as well.
+	Max int `yaml:"max" json:"max,omitempty"`
+	// Regex limits the guard to matching snapshots, e.g. those created by ctz. Empty matches every snapshot.
+	Regex string `yaml:"regex" json:"regex,omitempty"`
+}
+
+func (g *CountGuard) Validate() error {
+	if g.Min < 0 || g.Max < 0 {
+		return errors.New("snapshot counts must not be negative")
+	}
+	if g.Max > 0 && g.Min > g.Max {
+		return errors.Errorf("min (%d) must not be greater than max (%d)", g.Min, g.Max)
+	}
+	_, err := regexp.Compile(g.Regex)
+	if err != nil {
+		return errors.Errorf("invalid regex %q: %s", g.Regex, err)
+	}
+	return nil
+}
+
+// applyCountGuard adjusts the destroy list so that the number of remaining snapshots which match re is within the
+// limits
+func applyCountGuard[T models.Snapshot](g *CountGuard, re *regexp.Regexp, snaps []T, destroy []T) []T {
+	if g == nil {
+		return destroy
+	}
+	// oldest first
+	byAge := func(a, b T) int {
+		if c := a.When().Compare(b.When()); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name(), b.Name())
+	}
+	destroying := make(map[models.Snapshot]bool, len(destroy))
+	for _, snap := range destroy {
+		destroying[snap] = true
+	}
+	// The snapshots which the guard may keep or destroy, i.e. those which match, and aren't in use
+	var restorable, destroyable []T
+	remaining := 0
+	for _, snap := range snaps {
+		if !re.MatchString(snap.Name()) {
+			continue
+		}
+		switch {
+		case inUse(snap):
+			remaining++
+		case destroying[snap]:
+			restorable = append(restorable, snap)
+		default:
+			remaining++
+			destroyable = append(destroyable, snap)
+		}
+	}
+	if remaining < g.Min {
+		slices.SortFunc(restorable, byAge)
+		restore := min(g.Min-remaining, len(restorable))
+		restoring := make(map[models.Snapshot]bool, restore)
+		for _, snap := range restorable[len(restorable)-restore:] {
+			restoring[snap] = true
+		}
+		destroy = filterSnapList(destroy, func(snap T) bool {
+			return !restoring[snap]
+		})
+	} else if g.Max > 0 && remaining > g.Max {
+		slices.SortFunc(destroyable, byAge)
+		extra := min(remaining-g.Max, len(destroyable))
+		destroy = append(slices.Clone(destroy), destroyable[:extra]...)
+	}
+	return destroy
+}
+
+// inUse indicates whether a snapshot is in use, so that it won't be destroyed even if it is in the destroy list
+func inUse(snap models.Snapshot) bool {
+	s, ok := snap.(models.InUseSnapshot)
+	return ok && s.InUseReason() != ""
+}
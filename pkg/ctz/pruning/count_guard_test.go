@@ -0,0 +1,112 @@
+package pruning
+
+import (
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCountGuard(t *testing.T) {
+	var snaps []models.Snapshot
+	for i, name := range []string{"a", "b", "c", "d", "e"} {
+		snaps = append(snaps, stubSnap{name: name, date: time.Unix(int64(i), 0)})
+	}
+	keepLast2 := []KeepRule[models.Snapshot]{MustKeepLastN[models.Snapshot](2, "")}
+	keepAll := []KeepRule[models.Snapshot]{MustKeepRegex[models.Snapshot]("", false)}
+	tcs := map[string]struct {
+		rules   []KeepRule[models.Snapshot]
+		guard   *CountGuard
+		destroy []string
+	}{
+		"noGuard": {
+			rules:   keepLast2,
+			destroy: []string{"a", "b", "c"},
+		},
+		"min": {
+			rules:   keepLast2,
+			guard:   &CountGuard{Min: 3},
+			destroy: []string{"a", "b"},
+		},
+		"minAboveCount": {
+			rules:   keepLast2,
+			guard:   &CountGuard{Min: 10},
+			destroy: []string{},
+		},
+		"max": {
+			rules:   keepAll,
+			guard:   &CountGuard{Max: 3},
+			destroy: []string{"a", "b"},
+		},
+		"maxWithoutRules": {
+			guard:   &CountGuard{Min: 1, Max: 4},
+			destroy: []string{"a"},
+		},
+		"withinLimits": {
+			rules:   keepLast2,
+			guard:   &CountGuard{Min: 1, Max: 4},
+			destroy: []string{"a", "b", "c"},
+		},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			p, err := NewGuardedPruner(tc.rules, tc.guard)
+			require.NoError(t, err)
+			destroy := snapshotList(p.Destroy(snaps)).NameList()
+			assert.ElementsMatch(t, tc.destroy, destroy)
+		})
+	}
+}
+
+type inUseStubSnap struct {
+	stubSnap
+	inUse string
+}
+
+func (s inUseStubSnap) InUseReason() string { return s.inUse }
+
+func TestCountGuardScope(t *testing.T) {
+	var snaps []models.Snapshot
+	for i, name := range []string{"manual-1", "ctz-1", "ctz-2", "manual-2", "ctz-3"} {
+		snaps = append(snaps, stubSnap{name: name, date: time.Unix(int64(i), 0)})
+	}
+	keepAll := []KeepRule[models.Snapshot]{MustKeepRegex[models.Snapshot]("", false)}
+	// Only ctz- snapshots are counted and destroyed
+	p, err := NewGuardedPruner(keepAll, &CountGuard{Max: 2, Regex: "^ctz-"})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"ctz-1"}, snapshotList(p.Destroy(snaps)).NameList())
+	// Only ctz- snapshots are counted and restored
+	p, err = NewGuardedPruner([]KeepRule[models.Snapshot]{MustKeepRegex[models.Snapshot]("^manual-", false)}, &CountGuard{Min: 1, Regex: "^ctz-"})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"ctz-1", "ctz-2"}, snapshotList(p.Destroy(snaps)).NameList())
+
+	_, err = NewGuardedPruner[models.Snapshot](nil, &CountGuard{Max: 2, Regex: "("})
+	assert.ErrorContains(t, err, "invalid regex")
+}
+
+func TestCountGuardInUse(t *testing.T) {
+	snaps := []models.Snapshot{
+		inUseStubSnap{stubSnap: stubSnap{name: "a", date: time.Unix(1, 0)}, inUse: "has 1 hold(s)"},
+		inUseStubSnap{stubSnap: stubSnap{name: "b", date: time.Unix(2, 0)}},
+		inUseStubSnap{stubSnap: stubSnap{name: "c", date: time.Unix(3, 0)}},
+		inUseStubSnap{stubSnap: stubSnap{name: "d", date: time.Unix(4, 0)}},
+	}
+	keepAll := []KeepRule[models.Snapshot]{MustKeepRegex[models.Snapshot]("", false)}
+	// "a" can't be destroyed, so the next oldest is destroyed instead
+	p, err := NewGuardedPruner(keepAll, &CountGuard{Max: 2})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"b", "c"}, snapshotList(p.Destroy(snaps)).NameList())
+	// "a" won't be destroyed, so it counts towards the minimum
+	p, err = NewGuardedPruner([]KeepRule[models.Snapshot]{MustKeepLastN[models.Snapshot](1, "")}, &CountGuard{Min: 3})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a", "b"}, snapshotList(p.Destroy(snaps)).NameList())
+}
+
+func TestCountGuardInvalid(t *testing.T) {
+	_, err := NewGuardedPruner[models.Snapshot](nil, &CountGuard{Min: 5, Max: 3})
+	assert.ErrorContains(t, err, "min (5) must not be greater than max (3)")
+	_, err = NewGuardedPruner[models.Snapshot](nil, &CountGuard{Min: -1})
+	assert.ErrorContains(t, err, "must not be negative")
+}
@@ -0,0 +1,141 @@
+package pruning
+
+import (
+	"fmt"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
+	"regexp"
+	"strings"
+)
+
+// Reasons maps the name of each snapshot to the reasons it was kept (the rules which kept it) or destroyed, so that
+// retention policies can be debugged
+type Reasons map[string][]string
+
+const (
+	ReasonNotKept  = "not kept by any rule"
+	ReasonNoRules  = "no keep rules"
+	ReasonDisabled = "pruning is not configured"
+)
+
+// ExplainingKeepRule is implemented by rules which can say more about why they kept each snapshot than their String
+// method, e.g. which bucket of the retention grid the snapshot fell into
+type ExplainingKeepRule[T models.Snapshot] interface {
+	KeepRule[T]
+	// KeepRuleExplained is like KeepRuleInContext, but also returns the reason each snapshot was kept
+	KeepRuleExplained(snaps []T, ctx *PruneContext) (destroyList []T, kept map[models.Snapshot]string)
+}
+
+// describeRule is the reason given for the snapshots kept by a rule which isn't an ExplainingKeepRule
+func describeRule[T models.Snapshot](r KeepRule[T]) string {
+	if s, ok := r.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", r)
+}
+
+// describe formats a rule description such as "lastN(count=5, regex=ctz-.*)". Empty params are left out.
+func describe(name string, params ...string) string {
+	var nonEmpty []string
+	for _, p := range params {
+		if p != "" {
+			nonEmpty = append(nonEmpty, p)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s(%s)", name, strings.Join(nonEmpty, ", "))
+}
+
+// regexParam is the description of a rule's regex, which is left out if it matches everything
+func regexParam(re *regexp.Regexp) string {
+	if re.String() == "" {
+		return ""
+	}
+	return "regex=" + re.String()
+}
+
+// explainRule runs a single rule, and returns the snapshots it destroys, along with the reason it kept each of the
+// others
+func explainRule[T models.Snapshot](r KeepRule[T], snaps []T, ctx *PruneContext) ([]T, map[models.Snapshot]string) {
+	if er, ok := r.(ExplainingKeepRule[T]); ok {
+		return er.KeepRuleExplained(snaps, ctx)
+	}
+	destroy := destroyListInContext(r, snaps, ctx)
+	destroying := make(map[models.Snapshot]bool, len(destroy))
+	for _, snap := range destroy {
+		destroying[snap] = true
+	}
+	kept := make(map[models.Snapshot]string, len(snaps)-len(destroy))
+	reason := describeRule(r)
+	for _, snap := range snaps {
+		if !destroying[snap] {
+			kept[snap] = reason
+		}
+	}
+	return destroy, kept
+}
+
+// explainNested is like countDestroys, but also collects the reasons that the other rules kept each snapshot
+func explainNested[T models.Snapshot](rules []KeepRule[T], snaps []T, ctx *PruneContext) (map[models.Snapshot]int, map[models.Snapshot][]string) {
+	counts := make(map[models.Snapshot]int, len(snaps))
+	reasons := make(map[models.Snapshot][]string, len(snaps))
+	for _, r := range rules {
+		destroy, kept := explainRule(r, snaps, ctx)
+		for _, snap := range destroy {
+			counts[snap]++
+		}
+		for _, snap := range snaps {
+			if reason, ok := kept[snap]; ok {
+				reasons[snap] = append(reasons[snap], reason)
+			}
+		}
+	}
+	return counts, reasons
+}
+
+// PruneSnapshotsExplained is like PruneSnapshotsInContext, but also returns the reasons for each snapshot, i.e. every
+// rule which kept it
+func PruneSnapshotsExplained[T models.Snapshot](snaps []T, keepRules []KeepRule[T], ctx *PruneContext) ([]T, Reasons) {
+	reasons := make(Reasons, len(snaps))
+	if len(keepRules) == 0 {
+		for _, snap := range snaps {
+			reasons[snap.Name()] = []string{ReasonNoRules}
+		}
+		return []T{}, reasons
+	}
+	counts, kept := explainNested(keepRules, snaps, withKeptByOtherRules(keepRules, snaps, ctx))
+	remove := make([]T, 0, len(snaps))
+	for _, snap := range snaps {
+		if counts[snap] == len(keepRules) {
+			remove = append(remove, snap)
+			reasons[snap.Name()] = []string{ReasonNotKept}
+		} else {
+			reasons[snap.Name()] = kept[snap]
+		}
+	}
+	return remove, reasons
+}
+
+// explainCountGuard replaces the reasons for the snapshots which the guard kept or destroyed, contrary to the rules
+func explainCountGuard[T models.Snapshot](g *CountGuard, chosen []T, destroy []T, reasons Reasons) {
+	if g == nil {
+		return
+	}
+	chosenByRules := make(map[models.Snapshot]bool, len(chosen))
+	for _, snap := range chosen {
+		chosenByRules[snap] = true
+	}
+	destroying := make(map[models.Snapshot]bool, len(destroy))
+	for _, snap := range destroy {
+		destroying[snap] = true
+		if !chosenByRules[snap] {
+			reasons[snap.Name()] = []string{fmt.Sprintf("destroyed to stay within the maximum count (%d)", g.Max)}
+		}
+	}
+	for _, snap := range chosen {
+		if !destroying[snap] {
+			reasons[snap.Name()] = []string{fmt.Sprintf("kept to stay within the minimum count (%d)", g.Min)}
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package pruning
+
+import (
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExplain(t *testing.T) {
+	now := time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+	snaps := []models.Snapshot{
+		stubSnap{name: "ctz-1", date: now.Add(-72 * time.Hour)},
+		stubSnap{name: "manual-1", date: now.Add(-48 * time.Hour)},
+		stubSnap{name: "ctz-2", date: now.Add(-90 * time.Minute)},
+		stubSnap{name: "ctz-3", date: now},
+	}
+	rules := []KeepRule[models.Snapshot]{
+		MustKeepLastN[models.Snapshot](1, "ctz-.*"),
+		MustKeepRegex[models.Snapshot]("^manual-", false),
+		MustNewKeepGrid[models.Snapshot]("ctz-.*", "2x1h | 1x1d"),
+	}
+	destroy, reasons := NewPruner(rules).Explain(snaps, nil)
+	assert.Equal(t, []models.Snapshot{snaps[0]}, destroy)
+	assert.Equal(t, Reasons{
+		"ctz-1":    {ReasonNotKept},
+		"manual-1": {"regex(regex=^manual-)"},
+		"ctz-2":    {"grid(grid=2x1h | 1x1d, regex=ctz-.*): bucket 2 of 3 (1h to 2h old)"},
+		"ctz-3": {
+			"lastN(count=1, regex=ctz-.*)",
+			"grid(grid=2x1h | 1x1d, regex=ctz-.*): bucket 1 of 3 (0s to 1h old)",
+		},
+	}, reasons)
+	// The plain methods agree with the explanation
+	assert.ElementsMatch(t, destroy, NewPruner(rules).Destroy(snaps))
+}
+
+func TestExplainCalendar(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2024, 6, d, 12, 0, 0, 0, time.UTC)
+	}
+	snaps := []models.Snapshot{
+		stubSnap{name: "a", date: day(1)},
+		stubSnap{name: "b", date: day(8)},
+		stubSnap{name: "c", date: day(9)},
+		stubSnap{name: "d", date: day(9).Add(time.Hour)},
+	}
+	rule := MustKeepCalendar[models.Snapshot](&PruneCalendar{Days: 3, Months: 1, Timezone: "UTC"})
+	destroy, kept := rule.KeepRuleExplained(snaps, nil)
+	assert.ElementsMatch(t, []models.Snapshot{snaps[0], snaps[2]}, destroy)
+	assert.Equal(t, map[models.Snapshot]string{
+		snaps[1]: "calendar(days=3, months=1, timezone=UTC): newest in day 2 of 3",
+		snaps[3]: "calendar(days=3, months=1, timezone=UTC): newest in day 1 of 3, month 1 of 1",
+	}, kept)
+}
+
+func TestExplainCombinators(t *testing.T) {
+	snaps := []models.Snapshot{
+		stubSnap{name: "ctz-1", date: time.Unix(1, 0)},
+		stubSnap{name: "tmp-1", date: time.Unix(2, 0)},
+		stubSnap{name: "ctz-2", date: time.Unix(3, 0)},
+	}
+	rule, err := RuleFromConfig[models.Snapshot](PruningEnum{Ret: &PruneAll{Rules: []PruningEnum{
+		lastNRule(2, ""),
+		{Ret: &PruneNot{Rule: regexRule("^tmp-")}},
+	}}})
+	require.NoError(t, err)
+	destroy, reasons := NewPruner([]KeepRule[models.Snapshot]{rule}).Explain(snaps, nil)
+	assert.ElementsMatch(t, []models.Snapshot{snaps[0], snaps[1]}, destroy)
+	assert.Equal(t, Reasons{
+		"ctz-1": {ReasonNotKept},
+		"tmp-1": {ReasonNotKept},
+		"ctz-2": {"all(lastN(count=2), not(regex(regex=^tmp-)))"},
+	}, reasons)
+}
+
+func TestExplainCountGuard(t *testing.T) {
+	var snaps []models.Snapshot
+	for i, name := range []string{"a", "b", "c", "d"} {
+		snaps = append(snaps, stubSnap{name: name, date: time.Unix(int64(i), 0)})
+	}
+	p, err := NewGuardedPruner([]KeepRule[models.Snapshot]{MustKeepRegex[models.Snapshot]("^d$", false)}, &CountGuard{Min: 2})
+	require.NoError(t, err)
+	_, reasons := p.Explain(snaps, nil)
+	assert.Equal(t, []string{ReasonNotKept}, reasons["a"])
+	assert.Equal(t, []string{"kept to stay within the minimum count (2)"}, reasons["c"])
+
+	p, err = NewGuardedPruner([]KeepRule[models.Snapshot]{MustKeepRegex[models.Snapshot]("", false)}, &CountGuard{Max: 3})
+	require.NoError(t, err)
+	_, reasons = p.Explain(snaps, nil)
+	assert.Equal(t, []string{"destroyed to stay within the maximum count (3)"}, reasons["a"])
+	assert.Equal(t, []string{"regex(regex=)"}, reasons["b"])
+}
+
+func TestExplainNoRules(t *testing.T) {
+	snaps := []models.Snapshot{stubSnap{name: "a", date: time.Unix(1, 0)}}
+	destroy, reasons := NewPruner[models.Snapshot](nil).Explain(snaps, nil)
+	assert.Empty(t, destroy)
+	assert.Equal(t, Reasons{"a": {ReasonNoRules}}, reasons)
+	destroy, reasons = NoPruner[models.Snapshot]().Explain(snaps, nil)
+	assert.Empty(t, destroy)
+	assert.Equal(t, Reasons{"a": {ReasonDisabled}}, reasons)
+}
@@ -0,0 +1,171 @@
+package pruning
+
+import (
+	"fmt"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
+	"github.com/pkg/errors"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+type PruneCalendar struct {
+	Type   string `yaml:"type" json:"type"`
+	Days   int    `yaml:"days" json:"days,omitempty"`
+	Weeks  int    `yaml:"weeks" json:"weeks,omitempty"`
+	Months int    `yaml:"months" json:"months,omitempty"`
+	Years  int    `yaml:"years" json:"years,omitempty"`
+	// Timezone is an IANA timezone name such as "Europe/Berlin". Defaults to the local timezone.
+	Timezone string `yaml:"timezone" json:"timezone,omitempty"`
+	Regex    string `yaml:"regex" json:"regex"`
+}
+
+// calendarPeriod numbers consecutive calendar periods (e.g. days) with consecutive integers
+type calendarPeriod struct {
+	// name is the singular name of the period, e.g. "day"
+	name  string
+	count int
+	index func(t time.Time) int
+}
+
+// KeepCalendar keeps the newest snapshot in each of the last N calendar days, ISO weeks, months and years. Periods
+// are counted back from the period containing the most recent snapshot that matches the regex, and include periods
+// without any snapshots. A snapshot which is the newest in several periods (e.g. both its day and its month) is only
+// kept once.
+type KeepCalendar[T models.Snapshot] struct {
+	periods []calendarPeriod
+	loc     *time.Location
+	re      *regexp.Regexp
+}
+
+var _ ExplainingKeepRule[models.Snapshot] = &KeepCalendar[models.Snapshot]{}
+
+func NewKeepCalendar[T models.Snapshot](in *PruneCalendar) (*KeepCalendar[T], error) {
+	if in.Days < 0 || in.Weeks < 0 || in.Months < 0 || in.Years < 0 {
+		return nil, errors.New("calendar counts must not be negative")
+	}
+	if in.Days+in.Weeks+in.Months+in.Years == 0 {
+		return nil, errors.New("calendar rule must specify at least one of days, weeks, months or years")
+	}
+	loc := time.Local
+	if in.Timezone != "" {
+		var err error
+		loc, err = time.LoadLocation(in.Timezone)
+		if err != nil {
+			return nil, errors.Errorf("invalid timezone %q: %s", in.Timezone, err)
+		}
+	}
+	re, err := regexp.Compile(in.Regex)
+	if err != nil {
+		return nil, errors.Errorf("invalid regex %q: %s", in.Regex, err)
+	}
+	return &KeepCalendar[T]{
+		periods: []calendarPeriod{
+			{"day", in.Days, dayIndex},
+			{"week", in.Weeks, weekIndex},
+			{"month", in.Months, monthIndex},
+			{"year", in.Years, func(t time.Time) int { return t.Year() }},
+		},
+		loc: loc,
+		re:  re,
+	}, nil
+}
+
+func MustKeepCalendar[T models.Snapshot](in *PruneCalendar) *KeepCalendar[T] {
+	k, err := NewKeepCalendar[T](in)
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// dayIndex is the number of days between 1970-01-01 and the date of t (in t's location)
+func dayIndex(t time.Time) int {
+	date := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return int(date.Unix() / (24 * 60 * 60))
+}
+
+// weekIndex numbers ISO weeks (starting on Monday)
+func weekIndex(t time.Time) int {
+	day := dayIndex(t)
+	monday := day - (int(t.Weekday())+6)%7
+	// 1970-01-05 (day 4) was a Monday, so this divides exactly
+	return (monday + 3) / 7
+}
+
+func monthIndex(t time.Time) int {
+	return t.Year()*12 + int(t.Month()) - 1
+}
+
+func (k *KeepCalendar[T]) String() string {
+	params := make([]string, 0, len(k.periods)+2)
+	for _, period := range k.periods {
+		if period.count > 0 {
+			params = append(params, fmt.Sprintf("%ss=%d", period.name, period.count))
+		}
+	}
+	if k.loc != time.Local {
+		params = append(params, "timezone="+k.loc.String())
+	}
+	params = append(params, regexParam(k.re))
+	return describe("calendar", params...)
+}
+
+func (k *KeepCalendar[T]) KeepRule(snaps []T) (destroyList []T) {
+	destroyList, _ = k.fit(snaps)
+	return destroyList
+}
+
+// KeepRuleExplained gives the periods that each kept snapshot is the newest in, e.g. "day 2 of 14", where day 1 is the
+// day of the most recent snapshot
+func (k *KeepCalendar[T]) KeepRuleExplained(snaps []T, _ *PruneContext) ([]T, map[models.Snapshot]string) {
+	destroyList, newestIn := k.fit(snaps)
+	kept := make(map[models.Snapshot]string, len(newestIn))
+	for snap, periods := range newestIn {
+		kept[snap] = fmt.Sprintf("%v: newest in %v", k, strings.Join(periods, ", "))
+	}
+	return destroyList, kept
+}
+
+// fit returns the snapshots to destroy, and the periods that each of the others is the newest in
+func (k *KeepCalendar[T]) fit(snaps []T) (destroyList []T, newestIn map[models.Snapshot][]string) {
+	matching, notMatching := partitionSnapList(snaps, func(snapshot T) bool {
+		return k.re.MatchString(snapshot.Name())
+	})
+	// snaps that don't match the regex are not kept by this rule
+	destroyList = append(destroyList, notMatching...)
+
+	if len(matching) == 0 {
+		return destroyList, nil
+	}
+
+	// youngest first, so that the first snapshot seen in each period is the one to keep
+	sort.SliceStable(matching, func(i, j int) bool {
+		return matching[i].When().After(matching[j].When())
+	})
+	newest := matching[0].When().In(k.loc)
+
+	newestIn = make(map[models.Snapshot][]string)
+	for _, period := range k.periods {
+		if period.count == 0 {
+			continue
+		}
+		newestIndex := period.index(newest)
+		seen := make(map[int]bool)
+		for _, snap := range matching {
+			index := period.index(snap.When().In(k.loc))
+			if newestIndex-index >= period.count || seen[index] {
+				continue
+			}
+			seen[index] = true
+			newestIn[snap] = append(newestIn[snap], fmt.Sprintf("%v %d of %d", period.name, newestIndex-index+1, period.count))
+		}
+	}
+	for _, snap := range matching {
+		if _, ok := newestIn[snap]; !ok {
+			destroyList = append(destroyList, snap)
+		}
+	}
+	return destroyList, newestIn
+}
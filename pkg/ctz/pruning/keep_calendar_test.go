@@ -0,0 +1,81 @@
+package pruning
+
+import (
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func calendarSnaps(t *testing.T, names map[string]string) []models.Snapshot {
+	var out []models.Snapshot
+	for name, when := range names {
+		date, err := time.Parse(time.RFC3339, when)
+		require.NoError(t, err)
+		out = append(out, stubSnap{name: name, date: date})
+	}
+	return out
+}
+
+func TestKeepCalendar(t *testing.T) {
+	snaps := calendarSnaps(t, map[string]string{
+		// Sunday
+		"ctz-a": "2024-03-10T23:00:00Z",
+		"ctz-b": "2024-03-10T12:00:00Z",
+		"ctz-c": "2024-03-09T08:00:00Z",
+		// Monday of the same ISO week
+		"ctz-d": "2024-03-04T10:00:00Z",
+		// Sunday of the previous ISO week
+		"ctz-e": "2024-03-03T10:00:00Z",
+		"ctz-f": "2024-02-28T10:00:00Z",
+		"ctz-g": "2024-01-15T10:00:00Z",
+		"ctz-h": "2023-12-31T10:00:00Z",
+		"ctz-i": "2022-06-01T10:00:00Z",
+		"other": "2024-03-10T23:30:00Z",
+	})
+	tcs := map[string]struct {
+		cfg     PruneCalendar
+		destroy []string
+	}{
+		"days": {
+			cfg:     PruneCalendar{Days: 2, Timezone: "UTC", Regex: "^ctz-"},
+			destroy: []string{"ctz-b", "ctz-d", "ctz-e", "ctz-f", "ctz-g", "ctz-h", "ctz-i", "other"},
+		},
+		"weeks": {
+			cfg:     PruneCalendar{Weeks: 2, Timezone: "UTC", Regex: "^ctz-"},
+			destroy: []string{"ctz-b", "ctz-c", "ctz-d", "ctz-f", "ctz-g", "ctz-h", "ctz-i", "other"},
+		},
+		"monthsAndYears": {
+			cfg:     PruneCalendar{Months: 3, Years: 3, Timezone: "UTC", Regex: "^ctz-"},
+			destroy: []string{"ctz-b", "ctz-c", "ctz-d", "ctz-e", "other"},
+		},
+		"noRegex": {
+			cfg:     PruneCalendar{Days: 1, Timezone: "UTC"},
+			destroy: []string{"ctz-a", "ctz-b", "ctz-c", "ctz-d", "ctz-e", "ctz-f", "ctz-g", "ctz-h", "ctz-i"},
+		},
+		"timezone": {
+			// In Berlin, ctz-a is on the 11th, so it is the only snapshot on the most recent day
+			cfg:     PruneCalendar{Days: 2, Timezone: "Europe/Berlin", Regex: "^ctz-"},
+			destroy: []string{"ctz-c", "ctz-d", "ctz-e", "ctz-f", "ctz-g", "ctz-h", "ctz-i", "other"},
+		},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			rule, err := NewKeepCalendar[models.Snapshot](&tc.cfg)
+			require.NoError(t, err)
+			destroy := snapshotList(rule.KeepRule(snaps)).NameList()
+			assert.ElementsMatch(t, tc.destroy, destroy)
+		})
+	}
+}
+
+func TestKeepCalendarInvalid(t *testing.T) {
+	_, err := NewKeepCalendar[models.Snapshot](&PruneCalendar{})
+	assert.ErrorContains(t, err, "at least one of")
+	_, err = NewKeepCalendar[models.Snapshot](&PruneCalendar{Days: -1})
+	assert.ErrorContains(t, err, "must not be negative")
+	_, err = NewKeepCalendar[models.Snapshot](&PruneCalendar{Days: 1, Timezone: "Nowhere/Special"})
+	assert.ErrorContains(t, err, "invalid timezone")
+}
@@ -0,0 +1,247 @@
+package pruning
+
+import (
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
+	"github.com/pkg/errors"
+	"slices"
+)
+
+// PruneAny keeps a snapshot if any of the nested rules keep it. This is how the top-level rules are combined, so it is
+// mostly useful inside PruneAll or PruneNot.
+type PruneAny struct {
+	Type  string        `yaml:"type" json:"type"`
+	Rules []PruningEnum `yaml:"rules" json:"rules"`
+}
+
+// PruneAll keeps a snapshot only if all of the nested rules keep it
+type PruneAll struct {
+	Type  string        `yaml:"type" json:"type"`
+	Rules []PruningEnum `yaml:"rules" json:"rules"`
+}
+
+// PruneNot keeps a snapshot only if the nested rule does not keep it
+type PruneNot struct {
+	Type string      `yaml:"type" json:"type"`
+	Rule PruningEnum `yaml:"rule" json:"rule"`
+}
+
+// destroyListInContext runs a single rule, passing ctx if the rule supports it
+func destroyListInContext[T models.Snapshot](r KeepRule[T], snaps []T, ctx *PruneContext) []T {
+	if cr, ok := r.(ContextKeepRule[T]); ok {
+		return cr.KeepRuleInContext(snaps, ctx)
+	}
+	return r.KeepRule(snaps)
+}
+
+// countDestroys runs every rule, and counts how many of them would destroy each snapshot
+func countDestroys[T models.Snapshot](rules []KeepRule[T], snaps []T, ctx *PruneContext) map[models.Snapshot]int {
+	counts := make(map[models.Snapshot]int, len(snaps))
+	for _, r := range rules {
+		for _, snap := range destroyListInContext(r, snaps, ctx) {
+			counts[snap]++
+		}
+	}
+	return counts
+}
+
+func nestedRules[T models.Snapshot](name string, in []PruningEnum) ([]KeepRule[T], error) {
+	if len(in) == 0 {
+		return nil, errors.Errorf("%s requires at least one rule", name)
+	}
+	rules, err := RulesFromConfig[T](in)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid rule in %s", name)
+	}
+	return rules, nil
+}
+
+type KeepAny[T models.Snapshot] struct {
+	rules []KeepRule[T]
+}
+
+var _ ExplainingKeepRule[models.Snapshot] = &KeepAny[models.Snapshot]{}
+
+func NewKeepAny[T models.Snapshot](in *PruneAny) (*KeepAny[T], error) {
+	rules, err := nestedRules[T]("any", in.Rules)
+	if err != nil {
+		return nil, err
+	}
+	return &KeepAny[T]{rules: rules}, nil
+}
+
+func (k *KeepAny[T]) usesKeptByOtherRules() bool {
+	return slices.ContainsFunc(k.rules, usesKeptByOtherRules[T])
+}
+
+func (k *KeepAny[T]) String() string {
+	return describeNested("any", k.rules)
+}
+
+func (k *KeepAny[T]) KeepRule(snaps []T) []T {
+	return k.KeepRuleInContext(snaps, nil)
+}
+
+// KeepRuleInContext destroys the snapshots which every nested rule would destroy
+func (k *KeepAny[T]) KeepRuleInContext(snaps []T, ctx *PruneContext) []T {
+	counts := countDestroys(k.rules, snaps, withKeptByOtherRules(k.rules, snaps, ctx))
+	return filterSnapList(snaps, func(snap T) bool {
+		return counts[snap] == len(k.rules)
+	})
+}
+
+// KeepRuleExplained gives the reasons of the nested rules which kept each snapshot
+func (k *KeepAny[T]) KeepRuleExplained(snaps []T, ctx *PruneContext) ([]T, map[models.Snapshot]string) {
+	counts, reasons := explainNested(k.rules, snaps, withKeptByOtherRules(k.rules, snaps, ctx))
+	return explainCombined("any", snaps, reasons, func(snap T) bool {
+		return counts[snap] == len(k.rules)
+	})
+}
+
+type KeepAll[T models.Snapshot] struct {
+	rules []KeepRule[T]
+}
+
+var _ ExplainingKeepRule[models.Snapshot] = &KeepAll[models.Snapshot]{}
+
+func NewKeepAll[T models.Snapshot](in *PruneAll) (*KeepAll[T], error) {
+	rules, err := nestedRules[T]("all", in.Rules)
+	if err != nil {
+		return nil, err
+	}
+	return &KeepAll[T]{rules: rules}, nil
+}
+
+func (k *KeepAll[T]) usesKeptByOtherRules() bool {
+	return slices.ContainsFunc(k.rules, usesKeptByOtherRules[T])
+}
+
+func (k *KeepAll[T]) String() string {
+	return describeNested("all", k.rules)
+}
+
+func (k *KeepAll[T]) KeepRule(snaps []T) []T {
+	return k.KeepRuleInContext(snaps, nil)
+}
+
+// KeepRuleInContext destroys the snapshots which any nested rule would destroy
+func (k *KeepAll[T]) KeepRuleInContext(snaps []T, ctx *PruneContext) []T {
+	counts := countDestroys(k.rules, snaps, ctx)
+	return filterSnapList(snaps, func(snap T) bool {
+		return counts[snap] > 0
+	})
+}
+
+// KeepRuleExplained gives the reasons of all the nested rules for each kept snapshot
+func (k *KeepAll[T]) KeepRuleExplained(snaps []T, ctx *PruneContext) ([]T, map[models.Snapshot]string) {
+	counts, reasons := explainNested(k.rules, snaps, ctx)
+	return explainCombined("all", snaps, reasons, func(snap T) bool {
+		return counts[snap] > 0
+	})
+}
+
+type KeepNot[T models.Snapshot] struct {
+	rule KeepRule[T]
+}
+
+var _ ExplainingKeepRule[models.Snapshot] = &KeepNot[models.Snapshot]{}
+
+func NewKeepNot[T models.Snapshot](in *PruneNot) (*KeepNot[T], error) {
+	if in.Rule.Ret == nil {
+		return nil, errors.New("not requires a rule")
+	}
+	rule, err := RuleFromConfig[T](in.Rule)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid rule in not")
+	}
+	return &KeepNot[T]{rule: rule}, nil
+}
+
+func (k *KeepNot[T]) usesKeptByOtherRules() bool {
+	return slices.ContainsFunc([]KeepRule[T]{k.rule}, usesKeptByOtherRules[T])
+}
+
+func (k *KeepNot[T]) String() string {
+	return describeNested("not", []KeepRule[T]{k.rule})
+}
+
+func (k *KeepNot[T]) KeepRule(snaps []T) []T {
+	return k.KeepRuleInContext(snaps, nil)
+}
+
+// KeepRuleInContext destroys the snapshots which the nested rule would keep. The snapshots kept by the other rules
+// aren't passed on, since they would be kept regardless of what the nested rule does.
+func (k *KeepNot[T]) KeepRuleInContext(snaps []T, ctx *PruneContext) []T {
+	if ctx != nil && ctx.KeptByOtherRules != nil {
+		nested := *ctx
+		nested.KeptByOtherRules = nil
+		ctx = &nested
+	}
+	counts := countDestroys([]KeepRule[T]{k.rule}, snaps, ctx)
+	return filterSnapList(snaps, func(snap T) bool {
+		return counts[snap] == 0
+	})
+}
+
+// KeepRuleExplained can only give the description of the rule, since the nested rule destroyed the kept snapshots
+func (k *KeepNot[T]) KeepRuleExplained(snaps []T, ctx *PruneContext) ([]T, map[models.Snapshot]string) {
+	destroyList := k.KeepRuleInContext(snaps, ctx)
+	destroying := make(map[models.Snapshot]bool, len(destroyList))
+	for _, snap := range destroyList {
+		destroying[snap] = true
+	}
+	kept := make(map[models.Snapshot]string, len(snaps)-len(destroyList))
+	for _, snap := range snaps {
+		if !destroying[snap] {
+			kept[snap] = k.String()
+		}
+	}
+	return destroyList, kept
+}
+
+// describeNested describes a combinator, e.g. "any(lastN(count=5), regex(regex=manual-.*))"
+func describeNested[T models.Snapshot](name string, rules []KeepRule[T]) string {
+	descriptions := make([]string, len(rules))
+	for i, r := range rules {
+		descriptions[i] = describeRule(r)
+	}
+	return describe(name, descriptions...)
+}
+
+// explainCombined returns the snapshots for which destroy returns true, along with the nested reasons for the others,
+// e.g. "all(lastN(count=5), regex(regex=ctz-.*))"
+func explainCombined[T models.Snapshot](name string, snaps []T, reasons map[models.Snapshot][]string, destroy func(snap T) bool) ([]T, map[models.Snapshot]string) {
+	var destroyList []T
+	kept := make(map[models.Snapshot]string, len(snaps))
+	for _, snap := range snaps {
+		if destroy(snap) {
+			destroyList = append(destroyList, snap)
+		} else {
+			kept[snap] = describe(name, reasons[snap]...)
+		}
+	}
+	return destroyList, kept
+}
+
+// AnyRule indicates whether f returns true for any of the rules, including rules nested in combinators
+func AnyRule(rules []PruningEnum, f func(rule interface{}) bool) bool {
+	for _, rule := range rules {
+		if f(rule.Ret) {
+			return true
+		}
+		switch v := rule.Ret.(type) {
+		case *PruneAny:
+			if AnyRule(v.Rules, f) {
+				return true
+			}
+		case *PruneAll:
+			if AnyRule(v.Rules, f) {
+				return true
+			}
+		case *PruneNot:
+			if AnyRule([]PruningEnum{v.Rule}, f) {
+				return true
+			}
+		}
+	}
+	return false
+}
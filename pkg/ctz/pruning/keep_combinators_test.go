@@ -0,0 +1,110 @@
+package pruning
+
+import (
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/zfssupport"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func regexRule(regex string) PruningEnum {
+	return PruningEnum{Ret: &PruneKeepRegex{Type: "regex", Regex: regex}}
+}
+
+func lastNRule(count int, regex string) PruningEnum {
+	return PruningEnum{Ret: &PruneKeepLastN{Type: "lastN", Count: count, Regex: regex}}
+}
+
+func TestKeepCombinators(t *testing.T) {
+	var snaps []models.Snapshot
+	for i, name := range []string{"ctz-1", "manual-1", "ctz-2", "ctz-3", "other", "manual-2", "ctz-4"} {
+		snaps = append(snaps, stubSnap{name: name, date: time.Unix(int64(i), 0)})
+	}
+	names := func(in []models.Snapshot) []string {
+		out := make([]string, len(in))
+		for i, s := range in {
+			out[i] = s.Name()
+		}
+		return out
+	}
+	tcs := map[string]struct {
+		rule    PruningEnum
+		destroy []string
+	}{
+		"any": {
+			rule:    PruningEnum{Ret: &PruneAny{Rules: []PruningEnum{regexRule("^manual-"), lastNRule(1, "")}}},
+			destroy: []string{"ctz-1", "ctz-2", "ctz-3", "other"},
+		},
+		"all": {
+			// The last 3 snapshots, but only if they are ctz snapshots
+			rule:    PruningEnum{Ret: &PruneAll{Rules: []PruningEnum{regexRule("^ctz-"), lastNRule(3, "")}}},
+			destroy: []string{"ctz-1", "manual-1", "ctz-2", "ctz-3", "other", "manual-2"},
+		},
+		"not": {
+			rule:    PruningEnum{Ret: &PruneNot{Rule: regexRule("^ctz-")}},
+			destroy: []string{"ctz-1", "ctz-2", "ctz-3", "ctz-4"},
+		},
+		"nested": {
+			// (ctz AND among the last 2 ctz snapshots) OR manual
+			rule: PruningEnum{Ret: &PruneAny{Rules: []PruningEnum{
+				{Ret: &PruneAll{Rules: []PruningEnum{regexRule("^ctz-"), lastNRule(2, "^ctz-")}}},
+				regexRule("^manual-"),
+			}}},
+			destroy: []string{"ctz-1", "ctz-2", "other"},
+		},
+		"exclusion": {
+			// Everything except "other"
+			rule:    PruningEnum{Ret: &PruneAll{Rules: []PruningEnum{regexRule(""), {Ret: &PruneNot{Rule: regexRule("^other$")}}}}},
+			destroy: []string{"other"},
+		},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			rule, err := RuleFromConfig[models.Snapshot](tc.rule)
+			require.NoError(t, err)
+			assert.Equal(t, tc.destroy, names(rule.KeepRule(snaps)))
+		})
+	}
+}
+
+func TestKeepCombinatorsContext(t *testing.T) {
+	snaps := []sizedStubSnap{
+		{stubSnap{name: "ctz-1", date: time.Unix(1, 0)}, 4},
+		{stubSnap{name: "ctz-2", date: time.Unix(2, 0)}, 4},
+	}
+	rule, err := RuleFromConfig[sizedStubSnap](PruningEnum{Ret: &PruneAll{Rules: []PruningEnum{
+		{Ret: &PruneSpaceBudget{Budget: "10", Scope: SpaceBudgetJob}},
+	}}})
+	require.NoError(t, err)
+	assert.Empty(t, rule.KeepRule(snaps))
+	// The context is passed to nested rules
+	destroy := rule.(ContextKeepRule[sizedStubSnap]).KeepRuleInContext(snaps, &PruneContext{OtherUsage: 4})
+	assert.Equal(t, []sizedStubSnap{snaps[0]}, destroy)
+}
+
+func TestKeepCombinatorsInvalid(t *testing.T) {
+	_, err := RuleFromConfig[models.Snapshot](PruningEnum{Ret: &PruneAny{}})
+	assert.ErrorContains(t, err, "any requires at least one rule")
+	_, err = RuleFromConfig[models.Snapshot](PruningEnum{Ret: &PruneAll{}})
+	assert.ErrorContains(t, err, "all requires at least one rule")
+	_, err = RuleFromConfig[models.Snapshot](PruningEnum{Ret: &PruneNot{}})
+	assert.ErrorContains(t, err, "not requires a rule")
+	// Restrictions on nested rules still apply
+	_, err = RuleFromConfig[*zfssupport.ZvolSnapshot](PruningEnum{Ret: &PruneNot{Rule: PruningEnum{Ret: &PruneKeepNotReplicated{}}}})
+	assert.ErrorContains(t, err, "notReplicated can only be used for the sender")
+}
+
+func TestAnyRule(t *testing.T) {
+	isBudget := func(rule interface{}) bool {
+		_, ok := rule.(*PruneSpaceBudget)
+		return ok
+	}
+	budget := PruningEnum{Ret: &PruneSpaceBudget{}}
+	assert.False(t, AnyRule([]PruningEnum{regexRule("")}, isBudget))
+	assert.True(t, AnyRule([]PruningEnum{regexRule(""), budget}, isBudget))
+	assert.True(t, AnyRule([]PruningEnum{{Ret: &PruneAny{Rules: []PruningEnum{{Ret: &PruneNot{Rule: budget}}}}}}, isBudget))
+	assert.True(t, AnyRule([]PruningEnum{{Ret: &PruneAll{Rules: []PruningEnum{budget}}}}, isBudget))
+}
@@ -14,9 +14,13 @@ import (
 // and deletes all snapshots that do not fit the grid specification.
 type KeepGrid[T models.Snapshot] struct {
 	retentionGrid *retentiongrid.Grid
-	re            *regexp.Regexp
+	// intervals are the configured intervals, one per bucket of the grid
+	intervals RetentionIntervalList
+	re        *regexp.Regexp
 }
 
+var _ ExplainingKeepRule[models.Snapshot] = &KeepGrid[models.Snapshot]{}
+
 func NewKeepGrid[T models.Snapshot](in *PruneGrid) (p *KeepGrid[T], err error) {
 
 	if in.Regex == "" {
@@ -81,12 +85,57 @@ func newKeepGrid[T models.Snapshot](re *regexp.Regexp, configIntervals []Retenti
 
 	return &KeepGrid[T]{
 		retentionGrid: retentiongrid.NewGrid(intervals),
+		intervals:     configIntervals,
 		re:            re,
 	}, nil
 }
 
+func (p *KeepGrid[T]) String() string {
+	return describe("grid", "grid="+p.intervals.String(), regexParam(p.re))
+}
+
 // Prune filters snapshots with the retention grid.
 func (p *KeepGrid[T]) KeepRule(snaps []T) (destroyList []T) {
+	destroyList, _ = p.fit(snaps)
+	return destroyList
+}
+
+// KeepRuleExplained gives the bucket of the grid that each kept snapshot fell into, along with the age range it covers
+func (p *KeepGrid[T]) KeepRuleExplained(snaps []T, _ *PruneContext) ([]T, map[models.Snapshot]string) {
+	destroyList, buckets := p.fit(snaps)
+	destroying := make(map[models.Snapshot]bool, len(destroyList))
+	for _, snap := range destroyList {
+		destroying[snap] = true
+	}
+	// The age range of each bucket, relative to the newest matching snapshot
+	starts := make([]time.Duration, len(p.intervals)+1)
+	for i, interval := range p.intervals {
+		starts[i+1] = starts[i] + interval.length
+	}
+	kept := make(map[models.Snapshot]string, len(snaps)-len(destroyList))
+	for _, snap := range snaps {
+		if destroying[snap] {
+			continue
+		}
+		bucket, ok := buckets[snap]
+		if !ok {
+			kept[snap] = p.String()
+			continue
+		}
+		keep := ""
+		if p.intervals[bucket].keepCount == RetentionGridKeepCountAll {
+			keep = ", keep=all"
+		} else if p.intervals[bucket].keepCount != 1 {
+			keep = fmt.Sprintf(", keep=%d", p.intervals[bucket].keepCount)
+		}
+		kept[snap] = fmt.Sprintf("%v: bucket %d of %d (%v to %v old%v)", p, bucket+1, len(p.intervals),
+			formatDuration(starts[bucket]), formatDuration(starts[bucket+1]), keep)
+	}
+	return destroyList, kept
+}
+
+// fit returns the snapshots to destroy, and the bucket that each matching snapshot fell into
+func (p *KeepGrid[T]) fit(snaps []T) (destroyList []T, buckets map[models.Snapshot]int) {
 
 	matching, notMatching := partitionSnapList(snaps, func(snapshot T) bool {
 		return p.re.MatchString(snapshot.Name())
@@ -96,7 +145,7 @@ func (p *KeepGrid[T]) KeepRule(snaps []T) (destroyList []T) {
 	destroyList = append(destroyList, notMatching...)
 
 	if len(matching) == 0 {
-		return destroyList
+		return destroyList, nil
 	}
 
 	// Evaluate retention grid
@@ -104,11 +153,15 @@ func (p *KeepGrid[T]) KeepRule(snaps []T) (destroyList []T) {
 	for i := range matching {
 		entrySlice = append(entrySlice, matching[i])
 	}
-	_, gridDestroyList := p.retentionGrid.FitEntries(entrySlice)
+	_, gridDestroyList, gridBuckets := p.retentionGrid.FitEntriesWithBuckets(entrySlice)
 
 	// Revert adaptors
 	for i := range gridDestroyList {
 		destroyList = append(destroyList, gridDestroyList[i].(T))
 	}
-	return destroyList
+	buckets = make(map[models.Snapshot]int, len(gridBuckets))
+	for entry, bucket := range gridBuckets {
+		buckets[entry.(T)] = bucket
+	}
+	return destroyList, buckets
 }
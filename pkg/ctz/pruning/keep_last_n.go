@@ -1,6 +1,7 @@
 package pruning
 
 import (
+	"fmt"
 	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
 	"regexp"
 	"sort"
@@ -35,6 +36,10 @@ func NewKeepLastN[T models.Snapshot](n int, regex string) (*KeepLastN[T], error)
 	return &KeepLastN[T]{n, re}, nil
 }
 
+func (k KeepLastN[T]) String() string {
+	return describe("lastN", fmt.Sprintf("count=%d", k.n), regexParam(k.re))
+}
+
 func (k KeepLastN[T]) KeepRule(snaps []T) (destroyList []T) {
 	matching, notMatching := partitionSnapList(snaps, func(snapshot T) bool {
 		return k.re.MatchString(snapshot.Name())
@@ -0,0 +1,54 @@
+package pruning
+
+import (
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
+	"github.com/pkg/errors"
+	"regexp"
+	"time"
+)
+
+type PruneMaxAge struct {
+	Type  string   `yaml:"type" json:"type"`
+	Age   Duration `yaml:"age" json:"age"`
+	Regex string   `yaml:"regex" json:"regex"`
+}
+
+// KeepMaxAge keeps snapshots which match the regex and are younger than the given age
+type KeepMaxAge[T models.Snapshot] struct {
+	age time.Duration
+	re  *regexp.Regexp
+	// now is overridden by tests
+	now func() time.Time
+}
+
+var _ ContextKeepRule[models.Snapshot] = &KeepMaxAge[models.Snapshot]{}
+
+func NewKeepMaxAge[T models.Snapshot](in *PruneMaxAge) (*KeepMaxAge[T], error) {
+	if in.Age.Duration() <= 0 {
+		return nil, errors.Errorf("age must be positive, got %s", in.Age.Duration())
+	}
+	re, err := regexp.Compile(in.Regex)
+	if err != nil {
+		return nil, errors.Errorf("invalid regex %q: %s", in.Regex, err)
+	}
+	return &KeepMaxAge[T]{age: in.Age.Duration(), re: re, now: time.Now}, nil
+}
+
+func (k *KeepMaxAge[T]) String() string {
+	return describe("maxAge", "age="+formatDuration(k.age), regexParam(k.re))
+}
+
+func (k *KeepMaxAge[T]) KeepRule(snaps []T) (destroyList []T) {
+	return k.KeepRuleInContext(snaps, nil)
+}
+
+func (k *KeepMaxAge[T]) KeepRuleInContext(snaps []T, ctx *PruneContext) (destroyList []T) {
+	now := k.now()
+	if ctx != nil && !ctx.Now.IsZero() {
+		now = ctx.Now
+	}
+	cutoff := now.Add(-k.age)
+	return filterSnapList(snaps, func(snapshot T) bool {
+		return !k.re.MatchString(snapshot.Name()) || !snapshot.When().After(cutoff)
+	})
+}
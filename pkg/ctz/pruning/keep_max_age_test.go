@@ -0,0 +1,37 @@
+package pruning
+
+import (
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestKeepMaxAge(t *testing.T) {
+	var cfg PruneMaxAge
+	require.NoError(t, yaml.Unmarshal([]byte("{type: maxAge, age: 7d, regex: '^ctz-'}"), &cfg))
+	rule, err := NewKeepMaxAge[models.Snapshot](&cfg)
+	require.NoError(t, err)
+	now := time.Unix(1_000_000_000, 0)
+	rule.now = func() time.Time { return now }
+
+	snaps := []models.Snapshot{
+		stubSnap{name: "ctz-new", date: now.Add(-time.Hour)},
+		stubSnap{name: "ctz-6d", date: now.Add(-6 * 24 * time.Hour)},
+		stubSnap{name: "ctz-8d", date: now.Add(-8 * 24 * time.Hour)},
+		stubSnap{name: "other", date: now.Add(-time.Hour)},
+	}
+	destroy := snapshotList(rule.KeepRule(snaps)).NameList()
+	assert.ElementsMatch(t, []string{"ctz-8d", "other"}, destroy)
+
+	destroy = snapshotList(rule.KeepRuleInContext(snaps, &PruneContext{Now: now.Add(2 * 24 * time.Hour)})).NameList()
+	assert.ElementsMatch(t, []string{"ctz-6d", "ctz-8d", "other"}, destroy)
+}
+
+func TestKeepMaxAgeInvalid(t *testing.T) {
+	_, err := NewKeepMaxAge[models.Snapshot](&PruneMaxAge{})
+	assert.ErrorContains(t, err, "age must be positive")
+}
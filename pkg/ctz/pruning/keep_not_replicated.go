@@ -0,0 +1,57 @@
+package pruning
+
+import (
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
+	"github.com/pkg/errors"
+)
+
+type PruneKeepNotReplicated struct {
+	Type string `yaml:"type" json:"type"`
+}
+
+// KeepNotReplicated keeps snapshots which have not been replicated to the receiver yet, i.e. those which are newer than
+// the newest snapshot which also exists on the receiver (by name, see PruneContext.ReceiverNames). It can only be used
+// on the sender. Without a context, nothing is known to have been replicated, so every snapshot is kept.
+type KeepNotReplicated[T models.Snapshot] struct {
+}
+
+var _ ContextKeepRule[models.Snapshot] = &KeepNotReplicated[models.Snapshot]{}
+
+func NewKeepNotReplicated[T models.Snapshot]() (*KeepNotReplicated[T], error) {
+	var zero T
+	if _, ok := any(zero).(*models.CephSnapshot); !ok {
+		return nil, errors.Errorf("notReplicated can only be used for the sender (not supported for %T)", zero)
+	}
+	return &KeepNotReplicated[T]{}, nil
+}
+
+func (*KeepNotReplicated[T]) String() string {
+	return "notReplicated"
+}
+
+func (k *KeepNotReplicated[T]) KeepRule(snaps []T) (destroyList []T) {
+	return k.KeepRuleInContext(snaps, nil)
+}
+
+func (*KeepNotReplicated[T]) KeepRuleInContext(snaps []T, ctx *PruneContext) (destroyList []T) {
+	if ctx == nil {
+		return []T{}
+	}
+	onReceiver := make(map[string]bool, len(ctx.ReceiverNames))
+	for _, name := range ctx.ReceiverNames {
+		onReceiver[name] = true
+	}
+	var newest models.Snapshot
+	for _, snap := range snaps {
+		if onReceiver[snap.Name()] && (newest == nil || snap.When().After(newest.When())) {
+			newest = snap
+		}
+	}
+	if newest == nil {
+		return []T{}
+	}
+	// Older snapshots have been replicated too, even if they no longer exist on the receiver
+	return filterSnapList(snaps, func(snapshot T) bool {
+		return !snapshot.When().After(newest.When())
+	})
+}
@@ -0,0 +1,37 @@
+package pruning
+
+import (
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/zfssupport"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeepNotReplicated(t *testing.T) {
+	rule, err := NewKeepNotReplicated[*models.CephSnapshot]()
+	require.NoError(t, err)
+	snaps := []*models.CephSnapshot{
+		models.NewCephSnapshot("a", time.Unix(100, 0), 1),
+		models.NewCephSnapshot("b", time.Unix(200, 0), 2),
+		models.NewCephSnapshot("c", time.Unix(300, 0), 3),
+		models.NewCephSnapshot("d", time.Unix(400, 0), 4),
+	}
+	// "a" no longer exists on the receiver, but is older than "b", so it has still been replicated
+	destroy := rule.KeepRuleInContext(snaps, &PruneContext{ReceiverNames: []string{"b", "x"}})
+	assert.Equal(t, []*models.CephSnapshot{snaps[0], snaps[1]}, destroy)
+
+	// Nothing has been replicated
+	assert.Empty(t, rule.KeepRuleInContext(snaps, &PruneContext{ReceiverNames: []string{"x"}}))
+	// Without a context, nothing is known to have been replicated
+	assert.Empty(t, rule.KeepRule(snaps))
+}
+
+func TestKeepNotReplicatedReceiver(t *testing.T) {
+	_, err := NewKeepNotReplicated[*zfssupport.ZvolSnapshot]()
+	require.ErrorContains(t, err, "notReplicated can only be used for the sender")
+	_, err = NewKeepNotReplicated[*models.CephSnapshot]()
+	require.NoError(t, err)
+}
@@ -28,6 +28,14 @@ func MustKeepRegex[T models.Snapshot](expr string, negate bool) *KeepRegex[T] {
 	return k
 }
 
+func (k *KeepRegex[T]) String() string {
+	negate := ""
+	if k.negate {
+		negate = "negate"
+	}
+	return describe("regex", "regex="+k.expr.String(), negate)
+}
+
 func (k *KeepRegex[T]) KeepRule(snaps []T) []T {
 	return filterSnapList(snaps, func(s T) bool {
 		if k.negate {
@@ -0,0 +1,166 @@
+package pruning
+
+import (
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/util"
+	"github.com/pkg/errors"
+	"maps"
+	"regexp"
+	"sort"
+)
+
+const (
+	// SpaceBudgetZvol applies the budget to the snapshots of each zvol separately
+	SpaceBudgetZvol = "zvol"
+	// SpaceBudgetJob applies the budget to the snapshots of all zvols in the job, see PruneContext.OtherUsage
+	SpaceBudgetJob = "job"
+)
+
+type PruneSpaceBudget struct {
+	Type string `yaml:"type" json:"type"`
+	// Budget is a size such as "500G"
+	Budget string `yaml:"budget" json:"budget"`
+	// Scope is either SpaceBudgetZvol (the default) or SpaceBudgetJob
+	Scope string `yaml:"scope" json:"scope,omitempty"`
+	Regex string `yaml:"regex" json:"regex"`
+}
+
+// KeepSpaceBudget keeps the newest snapshots which match the regex, as long as the space used by the zvol's snapshots
+// (its usedbysnapshots property, see PruneContext.UsedBySnapshots) fits the budget. Matching snapshots are destroyed
+// oldest first until it fits, and the space freed by destroying each one is estimated by its used property. That
+// underestimates the space freed once several neighbouring snapshots are destroyed, since data which they shared is
+// not counted, so more snapshots may be destroyed than strictly necessary. Snapshots which another rule keeps (see
+// PruneContext.KeptByOtherRules) are kept regardless, so they are skipped, and newer snapshots are destroyed instead.
+// It can only be used with snapshot types which implement models.SizedSnapshot, i.e. on the receiver.
+type KeepSpaceBudget[T models.Snapshot] struct {
+	budget uint64
+	// budgetSpec is the budget as configured, e.g. "500G"
+	budgetSpec string
+	job        bool
+	re         *regexp.Regexp
+}
+
+var _ ContextKeepRule[models.Snapshot] = &KeepSpaceBudget[models.Snapshot]{}
+
+func NewKeepSpaceBudget[T models.Snapshot](in *PruneSpaceBudget) (*KeepSpaceBudget[T], error) {
+	var zero T
+	if _, ok := any(zero).(models.SizedSnapshot); !ok {
+		return nil, errors.Errorf("spaceBudget can only be used for the receiver (not supported for %T)", zero)
+	}
+	budget, err := util.ParseSize(in.Budget)
+	if err != nil {
+		return nil, errors.Errorf("invalid budget %q: %s", in.Budget, err)
+	}
+	if budget == 0 {
+		return nil, errors.New("budget must be positive")
+	}
+	switch in.Scope {
+	case "", SpaceBudgetZvol, SpaceBudgetJob:
+	default:
+		return nil, errors.Errorf("invalid scope %q, must be %q or %q", in.Scope, SpaceBudgetZvol, SpaceBudgetJob)
+	}
+	re, err := regexp.Compile(in.Regex)
+	if err != nil {
+		return nil, errors.Errorf("invalid regex %q: %s", in.Regex, err)
+	}
+	return &KeepSpaceBudget[T]{budget: budget, budgetSpec: in.Budget, job: in.Scope == SpaceBudgetJob, re: re}, nil
+}
+
+// IsJobScoped indicates that the rule needs PruneContext.OtherUsage as well as PruneContext.UsedBySnapshots
+func (k *KeepSpaceBudget[T]) IsJobScoped() bool {
+	return k.job
+}
+
+func (k *KeepSpaceBudget[T]) String() string {
+	scope := ""
+	if k.job {
+		scope = "scope=" + SpaceBudgetJob
+	}
+	return describe("spaceBudget", "budget="+k.budgetSpec, scope, regexParam(k.re))
+}
+
+func (k *KeepSpaceBudget[T]) KeepRule(snaps []T) (destroyList []T) {
+	return k.KeepRuleInContext(snaps, nil)
+}
+
+func (k *KeepSpaceBudget[T]) KeepRuleInContext(snaps []T, ctx *PruneContext) (destroyList []T) {
+	matching, notMatching := partitionSnapList(snaps, func(snapshot T) bool {
+		return k.re.MatchString(snapshot.Name())
+	})
+	// snaps that don't match the regex are not kept by this rule
+	destroyList = append(destroyList, notMatching...)
+
+	// The space used by the snapshots is at least the sum of the space used only by each of them, which is all that
+	// is known without a context
+	var used uint64
+	for _, snap := range snaps {
+		used += any(snap).(models.SizedSnapshot).SpaceUsed()
+	}
+	if ctx != nil {
+		used = max(used, ctx.UsedBySnapshots)
+		if k.job {
+			used += ctx.OtherUsage
+		}
+	}
+	// oldest first
+	sort.SliceStable(matching, func(i, j int) bool {
+		return matching[i].When().Before(matching[j].When())
+	})
+	for _, snap := range matching {
+		if used <= k.budget {
+			break
+		}
+		destroyList = append(destroyList, snap)
+		// This rule doesn't keep it, but it won't be destroyed, so no space is freed
+		if ctx != nil && ctx.KeptByOtherRules[snap] {
+			continue
+		}
+		used -= min(used, any(snap).(models.SizedSnapshot).SpaceUsed())
+	}
+	return destroyList
+}
+
+func (k *KeepSpaceBudget[T]) usesKeptByOtherRules() bool {
+	return true
+}
+
+// keptByOtherRulesUser is implemented by rules which depend on PruneContext.KeptByOtherRules, including combinators
+// which contain such a rule
+type keptByOtherRulesUser interface {
+	usesKeptByOtherRules() bool
+}
+
+func usesKeptByOtherRules[T models.Snapshot](r KeepRule[T]) bool {
+	user, ok := r.(keptByOtherRulesUser)
+	return ok && user.usesKeptByOtherRules()
+}
+
+// withKeptByOtherRules runs the rules which don't depend on PruneContext.KeptByOtherRules, and returns a copy of ctx
+// with the snapshots that they keep added to it. rules are combined by keeping a snapshot if any of them keeps it. If
+// none of the rules (or all of them) depend on it, ctx is returned as it is.
+func withKeptByOtherRules[T models.Snapshot](rules []KeepRule[T], snaps []T, ctx *PruneContext) *PruneContext {
+	var others []KeepRule[T]
+	for _, r := range rules {
+		if !usesKeptByOtherRules(r) {
+			others = append(others, r)
+		}
+	}
+	if len(others) == len(rules) || len(others) == 0 {
+		return ctx
+	}
+	out := &PruneContext{}
+	if ctx != nil {
+		*out = *ctx
+	}
+	out.KeptByOtherRules = maps.Clone(out.KeptByOtherRules)
+	if out.KeptByOtherRules == nil {
+		out.KeptByOtherRules = make(map[models.Snapshot]bool, len(snaps))
+	}
+	counts := countDestroys(others, snaps, ctx)
+	for _, snap := range snaps {
+		if counts[snap] < len(others) {
+			out.KeptByOtherRules[snap] = true
+		}
+	}
+	return out
+}
@@ -0,0 +1,113 @@
+package pruning
+
+import (
+	"fmt"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/zfssupport"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sizedStubSnap struct {
+	stubSnap
+	used uint64
+}
+
+func (s sizedStubSnap) SpaceUsed() uint64    { return s.used }
+func (s sizedStubSnap) SpaceWritten() uint64 { return 0 }
+
+var _ models.SizedSnapshot = sizedStubSnap{}
+
+func TestKeepSpaceBudget(t *testing.T) {
+	const mib = 1024 * 1024
+	snaps := []sizedStubSnap{
+		{stubSnap{name: "ctz-1", date: time.Unix(1, 0)}, 1 * mib},
+		{stubSnap{name: "ctz-2", date: time.Unix(2, 0)}, 10 * mib},
+		{stubSnap{name: "ctz-3", date: time.Unix(3, 0)}, 1 * mib},
+		{stubSnap{name: "other", date: time.Unix(4, 0)}, 2 * mib},
+		{stubSnap{name: "ctz-5", date: time.Unix(5, 0)}, 3 * mib},
+	}
+
+	rule, err := NewKeepSpaceBudget[sizedStubSnap](&PruneSpaceBudget{Budget: "10M", Regex: "^ctz-"})
+	require.NoError(t, err)
+	// 17M are used, and destroying ctz-1 and ctz-2 frees 11M, even though ctz-1 would fit on its own
+	assert.ElementsMatch(t, []string{"other", "ctz-1", "ctz-2"}, spaceBudgetNames(rule.KeepRule(snaps)))
+	// The zvol's usedbysnapshots includes data shared by several snapshots, which isn't in any of their used
+	destroy := rule.KeepRuleInContext(snaps, &PruneContext{UsedBySnapshots: 22 * mib})
+	assert.ElementsMatch(t, []string{"other", "ctz-1", "ctz-2", "ctz-3"}, spaceBudgetNames(destroy))
+
+	job, err := NewKeepSpaceBudget[sizedStubSnap](&PruneSpaceBudget{Budget: "10M", Scope: SpaceBudgetJob, Regex: "^ctz-"})
+	require.NoError(t, err)
+	assert.True(t, job.IsJobScoped())
+	// Without a context, this is the same as a zvol-scoped budget
+	assert.ElementsMatch(t, []string{"other", "ctz-1", "ctz-2"}, spaceBudgetNames(job.KeepRule(snaps)))
+	destroy = job.KeepRuleInContext(snaps, &PruneContext{UsedBySnapshots: 17 * mib, OtherUsage: 5 * mib})
+	assert.ElementsMatch(t, []string{"other", "ctz-1", "ctz-2", "ctz-3"}, spaceBudgetNames(destroy))
+
+	// Rules are combined as usual, so lastN acts as a minimum
+	p := NewPruner([]KeepRule[sizedStubSnap]{job, MustKeepLastN[sizedStubSnap](3, "^ctz-")})
+	destroy = p.DestroyInContext(snaps, &PruneContext{UsedBySnapshots: 17 * mib, OtherUsage: 5 * mib})
+	assert.ElementsMatch(t, []string{"other", "ctz-1"}, spaceBudgetNames(destroy))
+}
+
+func TestKeepSpaceBudgetWithOtherRules(t *testing.T) {
+	snaps := []sizedStubSnap{
+		{stubSnap{name: "ctz-1", date: time.Unix(1, 0)}, 10},
+		{stubSnap{name: "ctz-2", date: time.Unix(2, 0)}, 10},
+		{stubSnap{name: "ctz-3", date: time.Unix(3, 0)}, 10},
+		{stubSnap{name: "ctz-4", date: time.Unix(4, 0)}, 10},
+	}
+	budget, err := NewKeepSpaceBudget[sizedStubSnap](&PruneSpaceBudget{Budget: "25"})
+	require.NoError(t, err)
+	// ctz-1 is kept by the regex rule, so destroying it frees nothing, and newer snapshots are destroyed instead
+	rules := []KeepRule[sizedStubSnap]{budget, MustKeepRegex[sizedStubSnap]("^ctz-1$", false)}
+	p := NewPruner(rules)
+	assert.ElementsMatch(t, []string{"ctz-2", "ctz-3"}, spaceBudgetNames(p.Destroy(snaps)))
+	destroy, reasons := p.Explain(snaps, nil)
+	assert.ElementsMatch(t, []string{"ctz-2", "ctz-3"}, spaceBudgetNames(destroy))
+	assert.Equal(t, []string{ReasonNotKept}, reasons["ctz-2"])
+
+	// The same applies inside an any rule
+	p = NewPruner([]KeepRule[sizedStubSnap]{&KeepAny[sizedStubSnap]{rules: rules}})
+	assert.ElementsMatch(t, []string{"ctz-2", "ctz-3"}, spaceBudgetNames(p.Destroy(snaps)))
+}
+
+func TestKeepSpaceBudgetLargeBase(t *testing.T) {
+	const mib = 1024 * 1024
+	// The first snapshot holds the whole image, but that data is still referenced by the zvol itself, so the
+	// snapshots only use the space of the small deltas which have been overwritten since
+	snaps := make([]*zfssupport.ZvolSnapshot, 4)
+	for i := range snaps {
+		snaps[i] = zfssupport.NewZvolSnapshot(fmt.Sprintf("ctz-%d", i+1), time.Unix(int64(i), 0), 1*mib)
+	}
+	snaps[0].Written = 100 * mib
+	ctx := &PruneContext{UsedBySnapshots: 5 * mib}
+
+	rule, err := NewKeepSpaceBudget[*zfssupport.ZvolSnapshot](&PruneSpaceBudget{Budget: "10M"})
+	require.NoError(t, err)
+	assert.Empty(t, rule.KeepRuleInContext(snaps, ctx))
+
+	rule, err = NewKeepSpaceBudget[*zfssupport.ZvolSnapshot](&PruneSpaceBudget{Budget: "3M"})
+	require.NoError(t, err)
+	assert.Equal(t, []*zfssupport.ZvolSnapshot{snaps[0], snaps[1]}, rule.KeepRuleInContext(snaps, ctx))
+}
+
+func spaceBudgetNames(in []sizedStubSnap) []string {
+	out := make([]string, len(in))
+	for i, s := range in {
+		out[i] = s.name
+	}
+	return out
+}
+
+func TestKeepSpaceBudgetInvalid(t *testing.T) {
+	_, err := NewKeepSpaceBudget[*models.CephSnapshot](&PruneSpaceBudget{Budget: "10G"})
+	assert.ErrorContains(t, err, "spaceBudget can only be used for the receiver")
+	_, err = NewKeepSpaceBudget[sizedStubSnap](&PruneSpaceBudget{Budget: "lots"})
+	assert.ErrorContains(t, err, "invalid budget")
+	_, err = NewKeepSpaceBudget[sizedStubSnap](&PruneSpaceBudget{Budget: "10G", Scope: "pool"})
+	assert.ErrorContains(t, err, "invalid scope")
+}
@@ -1,10 +1,13 @@
 package pruning
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
+	"regexp"
+	"time"
 )
 
 type PruningEnum struct {
@@ -23,16 +26,23 @@ type PruningEnum struct {
 //
 //var _ yaml.Unmarshaler = &PruningEnum{}
 
+// MarshalJSON allows the raw config to be displayed, e.g. in the web API
+func (t PruningEnum) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.Ret)
+}
+
+var _ json.Marshaler = PruningEnum{}
+
 type PruneKeepLastN struct {
-	Type  string `yaml:"type"`
-	Count int    `yaml:"count"`
-	Regex string `yaml:"regex"`
+	Type  string `yaml:"type" json:"type"`
+	Count int    `yaml:"count" json:"count"`
+	Regex string `yaml:"regex" json:"regex"`
 }
 
 type PruneKeepRegex struct {
-	Type   string `yaml:"type"`
-	Regex  string `yaml:"regex"`
-	Negate bool   `yaml:"negate"`
+	Type   string `yaml:"type" json:"type"`
+	Regex  string `yaml:"regex" json:"regex"`
+	Negate bool   `yaml:"negate" json:"negate"`
 }
 
 // TODO: this is implementing the "obsoleteUnmarshaler" interface
@@ -41,9 +51,16 @@ type PruneKeepRegex struct {
 
 func (t *PruningEnum) UnmarshalYAML(u func(interface{}) error) (err error) {
 	t.Ret, err = enumUnmarshalOld(u, map[string]interface{}{
-		"lastN": &PruneKeepLastN{},
-		"grid":  &PruneGrid{},
-		"regex": &PruneKeepRegex{},
+		"lastN":         &PruneKeepLastN{},
+		"grid":          &PruneGrid{},
+		"regex":         &PruneKeepRegex{},
+		"notReplicated": &PruneKeepNotReplicated{},
+		"calendar":      &PruneCalendar{},
+		"maxAge":        &PruneMaxAge{},
+		"spaceBudget":   &PruneSpaceBudget{},
+		"any":           &PruneAny{},
+		"all":           &PruneAll{},
+		"not":           &PruneNot{},
 	})
 	_ = len("")
 	return
@@ -96,18 +113,17 @@ func enumUnmarshalOld(u func(interface{}) error, types map[string]interface{}) (
 
 // The returned snapshot list is guaranteed to only contains elements of input parameter snaps
 func PruneSnapshots[T models.Snapshot](snaps []T, keepRules []KeepRule[T]) []T {
+	return PruneSnapshotsInContext(snaps, keepRules, nil)
+}
+
+// PruneSnapshotsInContext is like PruneSnapshots, but passes ctx to any rules which implement ContextKeepRule
+func PruneSnapshotsInContext[T models.Snapshot](snaps []T, keepRules []KeepRule[T], ctx *PruneContext) []T {
 
 	if len(keepRules) == 0 {
 		return []T{}
 	}
 
-	remCount := make(map[models.Snapshot]int, len(snaps))
-	for _, r := range keepRules {
-		ruleRems := r.KeepRule(snaps)
-		for _, ruleRem := range ruleRems {
-			remCount[ruleRem]++
-		}
-	}
+	remCount := countDestroys(keepRules, snaps, withKeptByOtherRules(keepRules, snaps, ctx))
 
 	remove := make([]T, 0, len(snaps))
 	for snap, rc := range remCount {
@@ -138,6 +154,20 @@ func RuleFromConfig[T models.Snapshot](in PruningEnum) (KeepRule[T], error) {
 		return NewKeepRegex[T](v.Regex, v.Negate)
 	case *PruneGrid:
 		return NewKeepGrid[T](v)
+	case *PruneKeepNotReplicated:
+		return NewKeepNotReplicated[T]()
+	case *PruneCalendar:
+		return NewKeepCalendar[T](v)
+	case *PruneMaxAge:
+		return NewKeepMaxAge[T](v)
+	case *PruneSpaceBudget:
+		return NewKeepSpaceBudget[T](v)
+	case *PruneAny:
+		return NewKeepAny[T](v)
+	case *PruneAll:
+		return NewKeepAll[T](v)
+	case *PruneNot:
+		return NewKeepNot[T](v)
 	default:
 		return nil, fmt.Errorf("unknown keep rule type %T", v)
 	}
@@ -147,16 +177,56 @@ type KeepRule[T models.Snapshot] interface {
 	KeepRule(snaps []T) (destroyList []T)
 }
 
+// PruneContext carries information which isn't available from the snapshots themselves
+type PruneContext struct {
+	// UsedBySnapshots is the usedbysnapshots property of the dataset being pruned, for space budgets
+	UsedBySnapshots uint64
+	// OtherUsage is the space used by the snapshots of the other datasets in the job (by the same measure as
+	// UsedBySnapshots), for job-scoped space budgets
+	OtherUsage uint64
+	// Now overrides the current time for age-based rules, e.g. when simulating pruning. Zero means the real time.
+	Now time.Time
+	// ReceiverNames are the names of the snapshots on the receiver, for notReplicated rules on the sender
+	ReceiverNames []string
+	// KeptByOtherRules are the snapshots which are kept regardless of any space budget, since another rule keeps
+	// them. It is filled in by withKeptByOtherRules.
+	KeptByOtherRules map[models.Snapshot]bool
+}
+
+// ContextKeepRule is implemented by rules which need a PruneContext. KeepRule is used if there is no context.
+type ContextKeepRule[T models.Snapshot] interface {
+	KeepRule[T]
+	KeepRuleInContext(snaps []T, ctx *PruneContext) (destroyList []T)
+}
+
 type Pruner[T models.Snapshot] interface {
 	Destroy(snapshots []T) []T
+	// DestroyInContext is like Destroy, but ctx is passed to rules which implement ContextKeepRule. ctx may be nil.
+	DestroyInContext(snapshots []T, ctx *PruneContext) []T
+	// Explain is like DestroyInContext, but also returns the reasons each snapshot was kept or destroyed
+	Explain(snapshots []T, ctx *PruneContext) ([]T, Reasons)
 }
 
 type pruner[T models.Snapshot] struct {
 	rules []KeepRule[T]
+	guard *CountGuard
+	// guardRegex is the compiled CountGuard.Regex
+	guardRegex *regexp.Regexp
 }
 
 func (p *pruner[T]) Destroy(snapshots []T) []T {
-	return PruneSnapshots(snapshots, p.rules)
+	return p.DestroyInContext(snapshots, nil)
+}
+
+func (p *pruner[T]) DestroyInContext(snapshots []T, ctx *PruneContext) []T {
+	return applyCountGuard(p.guard, p.guardRegex, snapshots, PruneSnapshotsInContext(snapshots, p.rules, ctx))
+}
+
+func (p *pruner[T]) Explain(snapshots []T, ctx *PruneContext) ([]T, Reasons) {
+	chosen, reasons := PruneSnapshotsExplained(snapshots, p.rules, ctx)
+	destroy := applyCountGuard(p.guard, p.guardRegex, snapshots, chosen)
+	explainCountGuard(p.guard, chosen, destroy, reasons)
+	return destroy, reasons
 }
 
 var _ Pruner[models.Snapshot] = &pruner[models.Snapshot]{}
@@ -165,6 +235,20 @@ func NewPruner[T models.Snapshot](rules []KeepRule[T]) Pruner[T] {
 	return &pruner[T]{rules: rules}
 }
 
+// NewGuardedPruner is like NewPruner, but the result of the rules is adjusted to stay within the guard's limits. guard
+// may be nil.
+func NewGuardedPruner[T models.Snapshot](rules []KeepRule[T], guard *CountGuard) (Pruner[T], error) {
+	out := &pruner[T]{rules: rules, guard: guard}
+	if guard != nil {
+		err := guard.Validate()
+		if err != nil {
+			return nil, err
+		}
+		out.guardRegex = regexp.MustCompile(guard.Regex)
+	}
+	return out, nil
+}
+
 type noopPruner[T models.Snapshot] struct {
 }
 
@@ -172,6 +256,18 @@ func (n *noopPruner[T]) Destroy(snapshots []T) []T {
 	return []T{}
 }
 
+func (n *noopPruner[T]) DestroyInContext(snapshots []T, _ *PruneContext) []T {
+	return []T{}
+}
+
+func (n *noopPruner[T]) Explain(snapshots []T, _ *PruneContext) ([]T, Reasons) {
+	reasons := make(Reasons, len(snapshots))
+	for _, snap := range snapshots {
+		reasons[snap.Name()] = []string{ReasonDisabled}
+	}
+	return []T{}, reasons
+}
+
 var _ Pruner[models.Snapshot] = &noopPruner[models.Snapshot]{}
 
 func NoPruner[T models.Snapshot]() Pruner[T] {
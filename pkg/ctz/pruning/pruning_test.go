@@ -150,3 +150,16 @@ func TestPruneSnapshots(t *testing.T) {
 
 	testTable[models.Snapshot](tcs, t)
 }
+
+func TestRetentionIntervalListString(t *testing.T) {
+	spec := "1x1h(keep=all) | 24x3h | 7x1d | 2x1w | 3x30d(keep=2)"
+	intervals, err := ParseRetentionIntervalSpec(spec)
+	require.NoError(t, err)
+	formatted := RetentionIntervalList(intervals).String()
+	assert.Equal(t, spec, formatted)
+
+	// The formatted spec must parse back into the same intervals
+	reparsed, err := ParseRetentionIntervalSpec(formatted)
+	require.NoError(t, err)
+	assert.Equal(t, intervals, reparsed)
+}
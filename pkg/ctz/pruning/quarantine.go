@@ -0,0 +1,47 @@
+package pruning
+
+import (
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
+	"time"
+)
+
+// QuarantinePlan splits pruning into two phases: snapshots chosen for destruction are first quarantined (marked with
+// the end of a grace period), and are only destroyed once the grace period has passed. Each list preserves the order
+// of the snapshots passed to PlanQuarantine.
+type QuarantinePlan[T models.QuarantinedSnapshot] struct {
+	// Quarantine are newly chosen for destruction, and should be marked
+	Quarantine []T
+	// Waiting are already quarantined, and are still chosen for destruction, but their grace period has not passed
+	Waiting []T
+	// Destroy have been quarantined for their whole grace period, and are still chosen for destruction
+	Destroy []T
+	// Release are quarantined, but are no longer chosen for destruction (e.g. because the rules have changed), so the
+	// mark should be removed
+	Release []T
+}
+
+// PlanQuarantine decides what to do with each snapshot, given the snapshots which the pruner chose to destroy. Kept
+// snapshots (see models.QuarantinedSnapshot) are treated as if they were not chosen.
+func PlanQuarantine[T models.QuarantinedSnapshot](snaps []T, destroy []T, now time.Time) *QuarantinePlan[T] {
+	destroying := make(map[models.Snapshot]bool, len(destroy))
+	for _, snap := range destroy {
+		destroying[snap] = true
+	}
+	out := &QuarantinePlan[T]{}
+	for _, snap := range snaps {
+		pruneAfter := snap.PruneAfter()
+		switch {
+		case !destroying[snap] || snap.Kept():
+			if !pruneAfter.IsZero() {
+				out.Release = append(out.Release, snap)
+			}
+		case pruneAfter.IsZero():
+			out.Quarantine = append(out.Quarantine, snap)
+		case now.Before(pruneAfter):
+			out.Waiting = append(out.Waiting, snap)
+		default:
+			out.Destroy = append(out.Destroy, snap)
+		}
+	}
+	return out
+}
@@ -0,0 +1,55 @@
+package pruning
+
+import (
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/util"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type quarantinedStubSnap struct {
+	stubSnap
+	pruneAfter time.Time
+}
+
+func (s quarantinedStubSnap) PruneAfter() time.Time { return s.pruneAfter }
+func (s quarantinedStubSnap) Kept() bool            { return false }
+
+// keptStubSnap was released from quarantine by hand
+type keptStubSnap struct {
+	quarantinedStubSnap
+}
+
+func (s keptStubSnap) Kept() bool { return true }
+
+func TestPlanQuarantine(t *testing.T) {
+	now := time.Unix(1000, 0)
+	snaps := []models.QuarantinedSnapshot{
+		quarantinedStubSnap{stubSnap{name: "kept", date: time.Unix(1, 0)}, time.Time{}},
+		quarantinedStubSnap{stubSnap{name: "new", date: time.Unix(2, 0)}, time.Time{}},
+		quarantinedStubSnap{stubSnap{name: "waiting", date: time.Unix(3, 0)}, now.Add(time.Hour)},
+		quarantinedStubSnap{stubSnap{name: "expired", date: time.Unix(4, 0)}, now.Add(-time.Hour)},
+		quarantinedStubSnap{stubSnap{name: "due", date: time.Unix(5, 0)}, now},
+		quarantinedStubSnap{stubSnap{name: "released", date: time.Unix(6, 0)}, now.Add(-time.Hour)},
+		keptStubSnap{quarantinedStubSnap{stubSnap{name: "keep", date: time.Unix(7, 0)}, time.Time{}}},
+		keptStubSnap{quarantinedStubSnap{stubSnap{name: "keepQuarantined", date: time.Unix(8, 0)}, now.Add(-time.Hour)}},
+	}
+	destroy := []models.QuarantinedSnapshot{snaps[4], snaps[3], snaps[2], snaps[1], snaps[6], snaps[7]}
+
+	plan := PlanQuarantine(snaps, destroy, now)
+	names := func(snaps []models.QuarantinedSnapshot) []string {
+		return util.Map(snaps, models.QuarantinedSnapshot.Name)
+	}
+	assert.Equal(t, []string{"new"}, names(plan.Quarantine))
+	assert.Equal(t, []string{"waiting"}, names(plan.Waiting))
+	assert.Equal(t, []string{"expired", "due"}, names(plan.Destroy))
+	assert.Equal(t, []string{"released", "keepQuarantined"}, names(plan.Release))
+
+	plan = PlanQuarantine(snaps, nil, now)
+	assert.Empty(t, plan.Quarantine)
+	assert.Empty(t, plan.Waiting)
+	assert.Empty(t, plan.Destroy)
+	assert.Equal(t, []string{"waiting", "expired", "due", "released", "keepQuarantined"}, names(plan.Release))
+}
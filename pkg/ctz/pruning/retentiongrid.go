@@ -1,6 +1,7 @@
 package pruning
 
 import (
+	"encoding/json"
 	"fmt"
 	"regexp"
 	"strconv"
@@ -13,9 +14,9 @@ type RetentionIntervalList []RetentionInterval
 var _ ObsoleteUnmarshaler = &RetentionIntervalList{}
 
 type PruneGrid struct {
-	Type  string                `yaml:"type"`
-	Grid  RetentionIntervalList `yaml:"grid"`
-	Regex string                `yaml:"regex"`
+	Type  string                `yaml:"type" json:"type"`
+	Grid  RetentionIntervalList `yaml:"grid" json:"grid"`
+	Regex string                `yaml:"regex" json:"regex"`
 }
 
 type RetentionInterval struct {
@@ -49,6 +50,31 @@ func (t *RetentionIntervalList) UnmarshalYAML(u func(any) error) (err error) {
 	return nil
 }
 
+// String converts the list back into a grid spec. Consecutive identical intervals are combined, so the result is
+// equivalent to the original spec, but may not be identical (e.g. "24h" is formatted as "1d").
+func (t RetentionIntervalList) String() string {
+	var parts []string
+	for i := 0; i < len(t); {
+		j := i + 1
+		for j < len(t) && t[j] == t[i] {
+			j++
+		}
+		part := fmt.Sprintf("%dx%v", j-i, formatDuration(t[i].length))
+		if t[i].keepCount == RetentionGridKeepCountAll {
+			part += "(keep=all)"
+		} else if t[i].keepCount != 1 {
+			part += fmt.Sprintf("(keep=%d)", t[i].keepCount)
+		}
+		parts = append(parts, part)
+		i = j
+	}
+	return strings.Join(parts, " | ")
+}
+
+func (t RetentionIntervalList) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
 var retentionStringIntervalRegex *regexp.Regexp = regexp.MustCompile(`^\s*(\d+)\s*x\s*([^\(]+)\s*(\((.*)\))?\s*$`)
 
 func parseRetentionGridIntervalString(e string) (intervals []RetentionInterval, err error) {
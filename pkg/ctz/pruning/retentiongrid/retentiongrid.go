@@ -30,6 +30,13 @@ func NewGrid(l []Interval) *Grid {
 }
 
 func (g Grid) FitEntries(entries []Entry) (keep, remove []Entry) {
+	keep, remove, _ = g.FitEntriesWithBuckets(entries)
+	return
+}
+
+// FitEntriesWithBuckets is like FitEntries, but also returns the index of the interval (bucket) that each entry fell
+// into. Entries which are older than the oldest bucket are not in the map.
+func (g Grid) FitEntriesWithBuckets(entries []Entry) (keep, remove []Entry, buckets map[Entry]int) {
 
 	if len(entries) == 0 {
 		return
@@ -42,7 +49,32 @@ func (g Grid) FitEntries(entries []Entry) (keep, remove []Entry) {
 	})
 	now := entries[0].When()
 
-	return g.fitEntriesWithNow(now, entries)
+	keep, remove = g.fitEntriesWithNow(now, entries)
+	return keep, remove, g.bucketsWithNow(now, entries)
+}
+
+// bucketsWithNow maps each entry to the index of the bucket that fitEntriesWithNow puts it in. Entries which are in
+// the future, or older than the oldest bucket, are not in the map.
+func (g Grid) bucketsWithNow(now time.Time, entries []Entry) map[Entry]int {
+	buckets := make([]bucket, len(g.intervals))
+	buckets[0] = makeBucketFromInterval(now, g.intervals[0])
+	for i := 1; i < len(g.intervals); i++ {
+		buckets[i] = makeBucketFromInterval(buckets[i-1].youngerThan, g.intervals[i])
+	}
+
+	bucketOf := make(map[Entry]int)
+	for _, e := range entries {
+		if now.Before(e.When()) {
+			continue
+		}
+		for bi := range buckets {
+			if buckets[bi].Contains(e) {
+				bucketOf[e] = bi
+				break
+			}
+		}
+	}
+	return bucketOf
 }
 
 type bucket struct {
@@ -183,3 +183,15 @@ func TestComplex(t *testing.T) {
 	validateRetentionGridFitEntries(t, now, snaps, keep, remove)
 
 }
+
+func TestFitEntriesWithBuckets(t *testing.T) {
+	g := gridFromString("1m,-1|1m,1")
+	relt := func(secs int64) time.Time { return time.Unix(secs, 0) }
+	a := testSnap{"a", true, relt(0)}
+	b := testSnap{"b", true, relt(-30)}
+	c := testSnap{"c", true, relt(-90)}
+	d := testSnap{"d", false, relt(-150)}
+	_, remove, buckets := g.FitEntriesWithBuckets([]Entry{a, b, c, d})
+	assert.Equal(t, []Entry{d}, remove)
+	assert.Equal(t, map[Entry]int{a: 0, b: 0, c: 1}, buckets)
+}
@@ -0,0 +1,83 @@
+// Package replication moves the replication base of an image, i.e. the snapshot which the next incremental backup
+// needs on both sides, and which is therefore protected on the sender and held on the receiver.
+package replication
+
+import (
+	"errors"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/util"
+)
+
+// Sender protects the replication base on the sender side, and records which snapshot it is, see
+// cephsupport.CephImageView
+type Sender interface {
+	// ProtectBase protects the named snapshot, records it as the base for tag, and returns the previous base for tag
+	// (or "" if there was none), which is left protected
+	ProtectBase(name string, tag string) (previous string, err error)
+	// ClearBase removes the record of the base for tag, leaving the snapshot protected
+	ClearBase(tag string) (previous string, err error)
+	// UnprotectBase unprotects a snapshot which is no longer the base for any tag
+	UnprotectBase(name string) error
+}
+
+// Receiver holds the replication base on the receiver side, see zfssupport.ZvolDestination
+type Receiver interface {
+	// Hold places a hold with the given tag on the named snapshot
+	Hold(name string, tag string) error
+	// ReleaseHolds releases the holds with the given tag on every snapshot apart from except
+	ReleaseHolds(tag string, except string) error
+}
+
+// MoveBase makes name (which must exist on both sides) the replication base for tag, and returns the previous base on
+// the sender side. The new base is protected and then held before anything is released, so that a failure never
+// leaves either side without a base:
+//
+//  1. protect (and record) the new base on the sender
+//  2. hold the new base on the receiver
+//  3. release the receiver's other holds
+//  4. unprotect the previous base on the sender
+//
+// If the hold fails, the sender's record is rolled back to the previous base, and the new base is unprotected again.
+// Once the new base is in place on both sides, steps 3 and 4 are both attempted, even if one of them fails.
+func MoveBase(sender Sender, receiver Receiver, name string, tag string) (previous string, err error) {
+	previous, err = sender.ProtectBase(name, tag)
+	if err != nil {
+		return "", util.Wrap("error protecting new base", err)
+	}
+	err = receiver.Hold(name, tag)
+	if err != nil {
+		err = util.Wrap("error holding new base", err)
+		if previous == name {
+			return "", err
+		}
+		return "", errors.Join(err, rollBack(sender, previous, name, tag))
+	}
+	var errs []error
+	err = receiver.ReleaseHolds(tag, name)
+	if err != nil {
+		errs = append(errs, util.Wrap("error releasing previous hold", err))
+	}
+	if previous != "" && previous != name {
+		err = sender.UnprotectBase(previous)
+		if err != nil {
+			errs = append(errs, util.Wrap("error unprotecting previous base", err))
+		}
+	}
+	return previous, errors.Join(errs...)
+}
+
+// rollBack restores previous as the sender's base for tag, after name failed to become the base
+func rollBack(sender Sender, previous string, name string, tag string) error {
+	var err error
+	if previous == "" {
+		_, err = sender.ClearBase(tag)
+	} else {
+		_, err = sender.ProtectBase(previous, tag)
+	}
+	if err == nil {
+		err = sender.UnprotectBase(name)
+	}
+	if err != nil {
+		return util.Wrap("error restoring previous base", err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package replication
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSides records the calls made to both sides, in order. Calls listed in fail return an error.
+type fakeSides struct {
+	base  string
+	calls []string
+	fail  map[string]bool
+}
+
+func (f *fakeSides) call(format string, args ...any) error {
+	c := fmt.Sprintf(format, args...)
+	f.calls = append(f.calls, c)
+	if f.fail[c] {
+		return errors.New(c + " failed")
+	}
+	return nil
+}
+
+func (f *fakeSides) ProtectBase(name string, tag string) (string, error) {
+	err := f.call("protect %v", name)
+	if err != nil {
+		return "", err
+	}
+	previous := f.base
+	f.base = name
+	return previous, nil
+}
+
+func (f *fakeSides) ClearBase(tag string) (string, error) {
+	err := f.call("clear")
+	if err != nil {
+		return "", err
+	}
+	previous := f.base
+	f.base = ""
+	return previous, nil
+}
+
+func (f *fakeSides) UnprotectBase(name string) error {
+	return f.call("unprotect %v", name)
+}
+
+func (f *fakeSides) Hold(name string, tag string) error {
+	return f.call("hold %v", name)
+}
+
+func (f *fakeSides) ReleaseHolds(tag string, except string) error {
+	return f.call("release except %v", except)
+}
+
+func TestMoveBase(t *testing.T) {
+	f := &fakeSides{base: "old"}
+	previous, err := MoveBase(f, f, "new", "ctz-job")
+	assert.NoError(t, err)
+	assert.Equal(t, "old", previous)
+	assert.Equal(t, "new", f.base)
+	assert.Equal(t, []string{"protect new", "hold new", "release except new", "unprotect old"}, f.calls)
+
+	// Nothing to unprotect on the first run, or if the base hasn't changed
+	for _, base := range []string{"", "new"} {
+		f = &fakeSides{base: base}
+		_, err = MoveBase(f, f, "new", "ctz-job")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"protect new", "hold new", "release except new"}, f.calls)
+	}
+}
+
+func TestMoveBaseFailures(t *testing.T) {
+	// Nothing else is touched if protecting fails
+	f := &fakeSides{base: "old", fail: map[string]bool{"protect new": true}}
+	_, err := MoveBase(f, f, "new", "ctz-job")
+	assert.Error(t, err)
+	assert.Equal(t, "old", f.base)
+	assert.Equal(t, []string{"protect new"}, f.calls)
+
+	// If holding fails, the old base keeps its hold, and the sender goes back to the old base
+	f = &fakeSides{base: "old", fail: map[string]bool{"hold new": true}}
+	_, err = MoveBase(f, f, "new", "ctz-job")
+	assert.Error(t, err)
+	assert.Equal(t, "old", f.base)
+	assert.Equal(t, []string{"protect new", "hold new", "protect old", "unprotect new"}, f.calls)
+
+	f = &fakeSides{fail: map[string]bool{"hold new": true}}
+	_, err = MoveBase(f, f, "new", "ctz-job")
+	assert.Error(t, err)
+	assert.Equal(t, "", f.base)
+	assert.Equal(t, []string{"protect new", "hold new", "clear", "unprotect new"}, f.calls)
+
+	// Once the new base is in place on both sides, a failure to release the old hold doesn't stop the old base being
+	// unprotected
+	f = &fakeSides{base: "old", fail: map[string]bool{"release except new": true}}
+	previous, err := MoveBase(f, f, "new", "ctz-job")
+	assert.Error(t, err)
+	assert.Equal(t, "old", previous)
+	assert.Equal(t, "new", f.base)
+	assert.Equal(t, []string{"protect new", "hold new", "release except new", "unprotect old"}, f.calls)
+}
@@ -0,0 +1,154 @@
+// Package simulate runs the pruning rules of a job against a synthetic series of snapshots, so that a policy can be
+// checked before it is deployed.
+package simulate
+
+import (
+	"errors"
+	"github.com/adhocore/gronx"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/config"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/pruning"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/util"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/zfssupport"
+	"slices"
+	"time"
+)
+
+// Options describes a simulation. Each simulated run creates one snapshot on both sides, named using
+// SnapshotTemplate, and then prunes both sides.
+type Options struct {
+	// Cron is the schedule of the simulated runs
+	Cron string
+	// Start is the time of the first simulated run (or the first cron tick after it)
+	Start time.Time
+	// Span is how long to simulate for
+	Span time.Duration
+	// Job is passed to SnapshotTemplate, along with the time of each run
+	Job              string
+	SnapshotTemplate *config.SnapshotTemplate
+	SrcPruning       pruning.Pruner[*models.CephSnapshot]
+	RcvPruning       pruning.Pruner[*zfssupport.ZvolSnapshot]
+	// WrittenPerSnapshot is the size of each receiver snapshot (both used and written), as seen by spaceBudget rules
+	WrittenPerSnapshot uint64
+}
+
+// Step is the result of a single simulated run
+type Step struct {
+	Time              time.Time `json:"time"`
+	Snapshot          string    `json:"snapshot"`
+	SenderCount       int       `json:"senderCount"`
+	ReceiverCount     int       `json:"receiverCount"`
+	SenderDestroyed   []string  `json:"senderDestroyed"`
+	ReceiverDestroyed []string  `json:"receiverDestroyed"`
+}
+
+// SideSummary summarises one side (sender or receiver) over the whole simulation
+type SideSummary struct {
+	// MaxCount is the largest number of snapshots that existed after any run
+	MaxCount int `json:"maxCount"`
+	// MaxOldestAge is the largest age of the oldest snapshot after any run
+	MaxOldestAge time.Duration `json:"maxOldestAge"`
+	// Survivors are the snapshots which exist at the end of the simulation, oldest first
+	Survivors []models.Snapshot `json:"-"`
+}
+
+type Result struct {
+	Steps    []Step      `json:"steps"`
+	Sender   SideSummary `json:"sender"`
+	Receiver SideSummary `json:"receiver"`
+	// End is the time of the last simulated run
+	End time.Time `json:"end"`
+}
+
+// maxSteps guards against accidentally simulating e.g. a per-minute cron over several years
+const maxSteps = 1_000_000
+
+func Run(opts Options) (*Result, error) {
+	if !gronx.IsValid(opts.Cron) {
+		return nil, errors.New("invalid cron expression")
+	}
+	if opts.Span <= 0 {
+		return nil, errors.New("span must be positive")
+	}
+	template := opts.SnapshotTemplate
+	if template == nil {
+		template = config.MustSnapshotTemplate(config.DefaultSnapshotTemplate)
+	}
+	end := opts.Start.Add(opts.Span)
+	var src []*models.CephSnapshot
+	var rcv []*zfssupport.ZvolSnapshot
+	result := &Result{}
+	now, err := gronx.NextTickAfter(opts.Cron, opts.Start, true)
+	for ; err == nil && !now.After(end); now, err = gronx.NextTickAfter(opts.Cron, now, false) {
+		if len(result.Steps) >= maxSteps {
+			return nil, errors.New("too many runs, use a shorter span or a less frequent cron")
+		}
+		name, renderErr := template.Render(config.SnapshotTemplateData{Time: now, Job: opts.Job, Pool: "pool", Image: "image"})
+		if renderErr != nil {
+			return nil, util.Wrap("error generating snapshot name", renderErr)
+		}
+		src = append(src, models.NewCephSnapshot(name, now, uint64(len(result.Steps))))
+		rcv = append(rcv, zfssupport.NewZvolSnapshot(name, now, opts.WrittenPerSnapshot))
+
+		srcDestroy := opts.SrcPruning.DestroyInContext(src, &pruning.PruneContext{
+			Now:           now,
+			ReceiverNames: util.Map(rcv, (*zfssupport.ZvolSnapshot).Name),
+		})
+		rcvDestroy := opts.RcvPruning.DestroyInContext(rcv, &pruning.PruneContext{Now: now})
+		src = remove(src, srcDestroy)
+		rcv = remove(rcv, rcvDestroy)
+
+		result.Steps = append(result.Steps, Step{
+			Time:              now,
+			Snapshot:          name,
+			SenderCount:       len(src),
+			ReceiverCount:     len(rcv),
+			SenderDestroyed:   names(srcDestroy),
+			ReceiverDestroyed: names(rcvDestroy),
+		})
+		observe(&result.Sender, now, src)
+		observe(&result.Receiver, now, rcv)
+		result.End = now
+	}
+	if err != nil {
+		return nil, util.Wrap("error evaluating cron expression", err)
+	}
+	result.Sender.Survivors = survivors(src)
+	result.Receiver.Survivors = survivors(rcv)
+	return result, nil
+}
+
+func observe[T models.Snapshot](s *SideSummary, now time.Time, snaps []T) {
+	s.MaxCount = max(s.MaxCount, len(snaps))
+	for _, snap := range snaps {
+		s.MaxOldestAge = max(s.MaxOldestAge, now.Sub(snap.When()))
+	}
+}
+
+// remove returns the snapshots which are not in destroy, preserving their order
+func remove[T models.Snapshot](snaps []T, destroy []T) []T {
+	destroying := make(map[models.Snapshot]bool, len(destroy))
+	for _, snap := range destroy {
+		destroying[snap] = true
+	}
+	return slices.DeleteFunc(snaps, func(snap T) bool {
+		return destroying[snap]
+	})
+}
+
+// names returns the names of the snapshots, oldest first
+func names[T models.Snapshot](snaps []T) []string {
+	sorted := slices.Clone(snaps)
+	slices.SortStableFunc(sorted, func(a, b T) int {
+		return a.When().Compare(b.When())
+	})
+	return util.Map(sorted, func(snap T) string {
+		return snap.Name()
+	})
+}
+
+func survivors[T models.Snapshot](snaps []T) []models.Snapshot {
+	return util.Map(snaps, func(snap T) models.Snapshot {
+		return snap
+	})
+}
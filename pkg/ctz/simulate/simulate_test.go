@@ -0,0 +1,63 @@
+package simulate
+
+import (
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/config"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/pruning"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/zfssupport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+	"testing"
+	"time"
+)
+
+const testPruning = `
+keepSender:
+  - type: lastN
+    count: 3
+keepReceiver:
+  - type: maxAge
+    age: 12h
+`
+
+func TestRun(t *testing.T) {
+	var raw config.PruningRaw
+	require.NoError(t, yaml.Unmarshal([]byte(testPruning), &raw))
+	srcRules, err := pruning.RulesFromConfig[*models.CephSnapshot](raw.KeepSender)
+	require.NoError(t, err)
+	rcvRules, err := pruning.RulesFromConfig[*zfssupport.ZvolSnapshot](raw.KeepReceiver)
+	require.NoError(t, err)
+
+	result, err := Run(Options{
+		Cron:       "0 * * * *",
+		Start:      time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Span:       48 * time.Hour,
+		SrcPruning: pruning.NewPruner(srcRules),
+		RcvPruning: pruning.NewPruner(rcvRules),
+	})
+	require.NoError(t, err)
+	require.Len(t, result.Steps, 49)
+	assert.Equal(t, time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC), result.End)
+
+	assert.Equal(t, 3, result.Sender.MaxCount)
+	assert.Equal(t, 2*time.Hour, result.Sender.MaxOldestAge)
+	require.Len(t, result.Sender.Survivors, 3)
+	assert.Equal(t, "ctz-2024-01-02-22:00:00", result.Sender.Survivors[0].Name())
+
+	assert.Equal(t, 12, result.Receiver.MaxCount)
+	assert.Equal(t, 11*time.Hour, result.Receiver.MaxOldestAge)
+	assert.Len(t, result.Receiver.Survivors, 12)
+
+	last := result.Steps[48]
+	assert.Equal(t, "ctz-2024-01-03-00:00:00", last.Snapshot)
+	assert.Equal(t, []string{"ctz-2024-01-02-21:00:00"}, last.SenderDestroyed)
+	assert.Equal(t, []string{"ctz-2024-01-02-12:00:00"}, last.ReceiverDestroyed)
+}
+
+func TestRunInvalid(t *testing.T) {
+	_, err := Run(Options{Cron: "not a cron", Span: time.Hour})
+	assert.ErrorContains(t, err, "invalid cron expression")
+	_, err = Run(Options{Cron: "0 * * * *"})
+	assert.ErrorContains(t, err, "span must be positive")
+}
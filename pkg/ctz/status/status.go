@@ -100,6 +100,9 @@ var (
 	Failed     StatusType = &statusType{label: "Failed", isTerminal: true, isBad: true}
 	// Skipped indicates that the job never started, but its parent finished
 	Skipped StatusType = &statusType{label: "Skipped", isTerminal: true}
+	// Deferred indicates that the job decided not to run this time (e.g. due to insufficient space), and will try again
+	// on the next run.
+	Deferred StatusType = &statusType{label: "Deferred", isTerminal: true}
 	// ChildrenFailed indicates that regardless of whether the job was successful, one or more children failed.
 	ChildrenFailed StatusType = &statusType{label: "Children Failed", isTerminal: true, isBad: true}
 
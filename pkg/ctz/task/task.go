@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/mattventura/ceph-to-zfs/pkg/ctz/logging"
 	"github.com/mattventura/ceph-to-zfs/pkg/ctz/status"
+	"strings"
 	"sync"
 	"time"
 )
@@ -27,8 +28,33 @@ type CancellableTask interface {
 	Cancel() error
 }
 
+// PrunableTask can apply its pruning rules to existing snapshots without running a backup. With dryRun, the snapshots
+// which would be pruned are reported, but nothing is deleted.
+type PrunableTask interface {
+	Task
+	Prune(dryRun bool) error
+}
+
+// ReleasableTask can undo pruning of snapshots which are still quarantined. An empty snapshot name releases every
+// quarantined snapshot.
+type ReleasableTask interface {
+	Task
+	ReleaseQuarantine(snapshot string) error
+}
+
 var InProgressError = errors.New("task is already in progress")
 
+// DeferredError can be returned by a task function to indicate that the task decided not to run this time, e.g.
+// because a precondition was not met. The status is set to status.Deferred rather than status.Failed, and Run
+// returns nil.
+type DeferredError struct {
+	Reason string
+}
+
+func (e *DeferredError) Error() string {
+	return "deferred: " + e.Reason
+}
+
 type ManagedTask struct {
 	mut      *sync.Mutex
 	prepped  bool
@@ -75,7 +101,14 @@ func (mt *ManagedTask) Prepare() (err error) {
 	return mt.doPrep()
 }
 
-func (mt *ManagedTask) Run(successMsg func() string) (err error) {
+func (mt *ManagedTask) Run(successMsg func() string) error {
+	return mt.RunFunc(mt.taskFunc, successMsg)
+}
+
+// RunFunc is like Run, but runs f instead of the task function. This lets a task offer other actions (such as pruning
+// without a backup) which share its preparation and status handling, and which can't run at the same time as the task
+// function.
+func (mt *ManagedTask) RunFunc(f func() error, successMsg func() string) (err error) {
 	locked := mt.mut.TryLock()
 	if !locked {
 		// TODO: we don't really want it to complain if you request it to run
@@ -107,7 +140,12 @@ func (mt *ManagedTask) Run(successMsg func() string) (err error) {
 		mt.log.SetExtraData("runEndTime", float64(end.UnixMilli())/1000.0)
 		mt.log.SetExtraData("runTime", float64(diff.Milliseconds())/1000.0)
 	}()
-	err = mt.taskFunc()
+	err = f()
+	var deferred *DeferredError
+	if errors.As(err, &deferred) {
+		mt.log.SetStatus(status.MakeStatus(status.Deferred, deferred.Reason))
+		return nil
+	}
 	if err != nil {
 		return err
 	}
@@ -119,6 +157,29 @@ func (mt *ManagedTask) Run(successMsg func() string) (err error) {
 	return err
 }
 
+// Find looks up a descendant of root by a path of task IDs separated by slashes, e.g. "job/image". Empty components are
+// ignored, so "" and "/" refer to root itself. It returns nil if there is no such task.
+func Find(root Task, path string) Task {
+	current := root
+	for _, id := range strings.Split(path, "/") {
+		if id == "" {
+			continue
+		}
+		var next Task
+		for _, child := range current.Children() {
+			if child.Id() == id {
+				next = child
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		current = next
+	}
+	return current
+}
+
 func RunParallel[T Task](children []T, f func(T) error) []error {
 	var errs []error
 	wg := sync.WaitGroup{}
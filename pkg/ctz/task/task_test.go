@@ -173,3 +173,89 @@ func TestManagedTaskFailPrep(t *testing.T) {
 	require.Equal(t, status.Failed, tl.Status().Type())
 	require.Equal(t, errMsg, tl.Status().Msg())
 }
+
+func TestManagedTaskDeferred(t *testing.T) {
+	tl := logging.NewRootLogger("test")
+	prep := func() error {
+		return nil
+	}
+	run := func() error {
+		return &DeferredError{Reason: "not enough space"}
+	}
+	mt := NewManagedTask(tl, prep, run)
+
+	err := mt.Run(nil)
+	require.NoError(t, err)
+	require.Equal(t, status.Deferred, tl.Status().Type())
+	require.Equal(t, "not enough space", tl.Status().Msg())
+}
+
+func TestManagedTaskRunFunc(t *testing.T) {
+	prepCount := 0
+	runCount := 0
+	otherCount := 0
+
+	tl := logging.NewRootLogger("test")
+	prep := func() error {
+		prepCount++
+		return nil
+	}
+	run := func() error {
+		runCount++
+		return nil
+	}
+	mt := NewManagedTask(tl, prep, run)
+
+	err := mt.RunFunc(func() error {
+		require.Equal(t, status.InProgress, tl.Status().Type())
+		otherCount++
+		return nil
+	}, func() string {
+		return "Other"
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, prepCount)
+	require.Equal(t, 0, runCount)
+	require.Equal(t, 1, otherCount)
+	require.Equal(t, status.Success, tl.Status().Type())
+	require.Equal(t, "Other", tl.Status().Msg())
+
+	// The alternate function can't run while the task is running
+	err = mt.Run(func() string {
+		err := mt.RunFunc(func() error {
+			otherCount++
+			return nil
+		}, nil)
+		require.ErrorIs(t, err, InProgressError)
+		return "Run"
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, prepCount)
+	require.Equal(t, 1, runCount)
+	require.Equal(t, 1, otherCount)
+}
+
+type findTestTask struct {
+	id       string
+	children []Task
+}
+
+func (f *findTestTask) Id() string                          { return f.id }
+func (f *findTestTask) Label() string                       { return f.id }
+func (f *findTestTask) Run() error                          { return nil }
+func (f *findTestTask) Children() []Task                    { return f.children }
+func (f *findTestTask) StatusLog() *logging.JobStatusLogger { return nil }
+
+func TestFind(t *testing.T) {
+	image := &findTestTask{id: "image"}
+	job := &findTestTask{id: "job", children: []Task{&findTestTask{id: "other"}, image}}
+	root := &findTestTask{id: "root", children: []Task{job}}
+
+	require.Equal(t, root, Find(root, ""))
+	require.Equal(t, root, Find(root, "/"))
+	require.Equal(t, job, Find(root, "/job"))
+	require.Equal(t, image, Find(root, "job/image"))
+	require.Equal(t, image, Find(root, "/job/image/"))
+	require.Nil(t, Find(root, "job/missing"))
+	require.Nil(t, Find(root, "image"))
+}
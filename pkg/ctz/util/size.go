@@ -0,0 +1,26 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseSize parses a ZFS-style size such as "16K", "16k", "1M", "1.5G" or "16384" into bytes. Suffixes are powers of
+// 1024, and an optional trailing "B" (e.g. "16KB" or "16KiB") is accepted.
+func ParseSize(size string) (uint64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "IB"), "B")
+	multiplier := uint64(1)
+	if s != "" {
+		if idx := strings.IndexByte("KMGTPE", s[len(s)-1]); idx >= 0 {
+			multiplier = uint64(1) << (10 * (idx + 1))
+			s = s[:len(s)-1]
+		}
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size '%v'", size)
+	}
+	return uint64(value * float64(multiplier)), nil
+}
@@ -0,0 +1,29 @@
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]uint64{
+		"16384": 16384,
+		"16K":   16384,
+		"16k":   16384,
+		"16KiB": 16384,
+		"16KB":  16384,
+		"1M":    1 << 20,
+		"1.5G":  3 << 29,
+		"0":     0,
+	}
+	for in, expected := range cases {
+		actual, err := ParseSize(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, expected, actual, in)
+	}
+	for _, in := range []string{"", "K", "abc", "-1K", "16X"} {
+		_, err := ParseSize(in)
+		assert.Error(t, err, in)
+	}
+}
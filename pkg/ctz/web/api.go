@@ -1,12 +1,15 @@
 package web
 
 import (
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/mattventura/ceph-to-zfs/pkg/ctz/logging"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/status"
 	"github.com/mattventura/ceph-to-zfs/pkg/ctz/task"
 	"github.com/mattventura/ceph-to-zfs/pkg/ctz/util"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -25,6 +28,9 @@ func (w *Api) InstallRoutes(r *gin.RouterGroup) {
 	r.GET("/startall", w.StartAll)
 	r.GET("/prepall", w.PrepareAll)
 	r.GET("/taskdetails/*task", w.TaskDetails)
+	r.GET("/space", w.Space)
+	r.GET("/prune/*task", w.Prune)
+	r.GET("/release/*task", w.Release)
 }
 
 func (w *Api) AllTasks(c *gin.Context) {
@@ -60,6 +66,70 @@ func (w *Api) TaskDetails(c *gin.Context) {
 
 }
 
+// Prune starts pruning a job, or a single image (e.g. /prune/job/image), without running a backup. With ?dryRun=true,
+// nothing is deleted, and the snapshot report in the image's task details shows what would have been pruned. It fails
+// with 409 Conflict if the task is already busy.
+func (w *Api) Prune(c *gin.Context) {
+	taskPath := c.Param("task")
+	t := task.Find(w.t, taskPath)
+	if t == nil {
+		c.JSON(http.StatusNotFound, gin.H{"Error": fmt.Sprintf("task %s not found", taskPath)})
+		return
+	}
+	prunable, ok := t.(task.PrunableTask)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("task %s can't be pruned", taskPath)})
+		return
+	}
+	dryRunParam := c.DefaultQuery("dryRun", "false")
+	dryRun, err := strconv.ParseBool(dryRunParam)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("invalid dryRun value '%v', must be true or false", dryRunParam)})
+		return
+	}
+	if isBusy(t) {
+		c.JSON(http.StatusConflict, gin.H{"Error": fmt.Sprintf("task %s is already in progress", taskPath)})
+		return
+	}
+	// Pruning a whole job can take a while, so the result is reported through the task's status
+	go prunable.Prune(dryRun)
+	c.JSON(http.StatusAccepted, gin.H{"Status": "Started", "DryRun": dryRun})
+}
+
+// Release undoes pruning of a job or image (e.g. /release/job/image) while the pruned snapshots are still
+// quarantined. With ?snapshot=name, only snapshots with that name are released. Unlike Prune, this waits for the
+// release to finish, so that failures are reported in the response.
+func (w *Api) Release(c *gin.Context) {
+	taskPath := c.Param("task")
+	t := task.Find(w.t, taskPath)
+	if t == nil {
+		c.JSON(http.StatusNotFound, gin.H{"Error": fmt.Sprintf("task %s not found", taskPath)})
+		return
+	}
+	releasable, ok := t.(task.ReleasableTask)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("task %s does not support releasing snapshots", taskPath)})
+		return
+	}
+	snapshot := c.Query("snapshot")
+	err := releasable.ReleaseQuarantine(snapshot)
+	if errors.Is(err, task.InProgressError) {
+		c.JSON(http.StatusConflict, gin.H{"Error": fmt.Sprintf("task %s is already in progress", taskPath)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"Error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"Status": "Released", "Message": t.StatusLog().Status().Msg(), "Snapshot": snapshot})
+}
+
+// isBusy checks whether the task is preparing or running, or is waiting to run as part of its parent
+func isBusy(t task.Task) bool {
+	st := t.StatusLog().Status().Type()
+	return st.IsActive() || st == status.Waiting
+}
+
 type TasksResponse struct {
 	ServerInfo ServerInfo `json:"serverInfo"`
 	Task       TaskView   `json:"task"`
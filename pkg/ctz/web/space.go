@@ -0,0 +1,95 @@
+package web
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/task"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// spaceReporter matches backup.SpaceReporter, without depending on the backup package
+type spaceReporter interface {
+	SpaceUsage() *models.SpaceUsage
+}
+
+type SpaceResponse struct {
+	ServerInfo ServerInfo         `json:"serverInfo"`
+	Total      *models.SpaceUsage `json:"total"`
+	// Jobs contains every task between the root and the images, i.e. jobs, and pools of multi-pool jobs
+	Jobs   []SpaceEntry `json:"jobs"`
+	Images []SpaceEntry `json:"images"`
+}
+
+type SpaceEntry struct {
+	// Path is the list of task IDs from the root, as used by the taskdetails endpoint
+	Path  []string           `json:"path"`
+	Label string             `json:"label"`
+	Space *models.SpaceUsage `json:"space"`
+}
+
+// Space reports the space used by each image and job. The lists can be sorted with the "sort" query parameter (any
+// field of models.SpaceUsage, by JSON name, default "used") and "order" ("asc" or "desc", default "desc").
+func (w *Api) Space(c *gin.Context) {
+	sortField := c.DefaultQuery("sort", "used")
+	order := c.DefaultQuery("order", "desc")
+	if _, ok := (&models.SpaceUsage{}).SortKey(sortField); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("invalid sort field '%v', must be one of: %v", sortField, strings.Join(models.SpaceUsageSortFields, ", "))})
+		return
+	}
+	if order != "asc" && order != "desc" {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("invalid order '%v', must be asc or desc", order)})
+		return
+	}
+	resp := SpaceResponse{
+		ServerInfo: MakeServerInfo(),
+		Jobs:       []SpaceEntry{},
+		Images:     []SpaceEntry{},
+	}
+	if reporter, ok := w.t.(spaceReporter); ok {
+		resp.Total = reporter.SpaceUsage()
+	}
+	var walk func(t task.Task, path []string)
+	walk = func(t task.Task, path []string) {
+		for _, child := range t.Children() {
+			childPath := append(slices.Clone(path), child.Id())
+			reporter, ok := child.(spaceReporter)
+			if !ok {
+				continue
+			}
+			entry := SpaceEntry{Path: childPath, Label: child.Label(), Space: reporter.SpaceUsage()}
+			if len(child.Children()) == 0 && (entry.Space == nil || entry.Space.Images == 1) {
+				// Images which haven't completed a backup yet have nothing to report
+				if entry.Space != nil {
+					resp.Images = append(resp.Images, entry)
+				}
+			} else {
+				resp.Jobs = append(resp.Jobs, entry)
+				walk(child, childPath)
+			}
+		}
+	}
+	walk(w.t, []string{})
+	sortSpaceEntries(resp.Jobs, sortField, order == "desc")
+	sortSpaceEntries(resp.Images, sortField, order == "desc")
+	c.JSON(http.StatusOK, resp)
+}
+
+func sortSpaceEntries(entries []SpaceEntry, field string, descending bool) {
+	slices.SortStableFunc(entries, func(a, b SpaceEntry) int {
+		ak, _ := a.Space.SortKey(field)
+		bk, _ := b.Space.SortKey(field)
+		out := 0
+		if ak < bk {
+			out = -1
+		} else if ak > bk {
+			out = 1
+		}
+		if descending {
+			out = -out
+		}
+		return out
+	})
+}
@@ -0,0 +1,83 @@
+package zfssupport
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// nameEscapeChar introduces an escape sequence in a dataset name component. It is followed by two hex digits, which
+// are one byte of the original (UTF-8) name. Since the escape character is itself always escaped, the mapping is
+// reversible.
+const nameEscapeChar = ':'
+
+// isSafeNameChar indicates whether a byte can be used as-is in a dataset name component. ZFS allows a few more
+// characters than this (such as spaces), but these are awkward enough elsewhere (e.g. device node paths) that they are
+// escaped anyway.
+func isSafeNameChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') ||
+		(c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9') ||
+		c == '_' || c == '-' || c == '.'
+}
+
+// EscapeNameComponent maps an arbitrary string (such as an RBD image name) to a valid ZFS dataset name component.
+// Characters which ZFS does not allow (and a few which it does, see isSafeNameChar) are replaced by ':' followed by
+// their hex value. The names "." and ".." have their first character escaped. See UnescapeNameComponent for the
+// reverse.
+func EscapeNameComponent(name string) string {
+	var sb strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if isSafeNameChar(c) && !(i == 0 && (name == "." || name == "..")) {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteString(fmt.Sprintf("%c%02x", nameEscapeChar, c))
+		}
+	}
+	return sb.String()
+}
+
+// UnescapeNameComponent reverses EscapeNameComponent
+func UnescapeNameComponent(escaped string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(escaped); i++ {
+		c := escaped[i]
+		if c != nameEscapeChar {
+			sb.WriteByte(c)
+			continue
+		}
+		if i+2 >= len(escaped) {
+			return "", fmt.Errorf("truncated escape sequence in '%v'", escaped)
+		}
+		value, err := strconv.ParseUint(escaped[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape sequence in '%v'", escaped)
+		}
+		sb.WriteByte(byte(value))
+		i += 2
+	}
+	return sb.String(), nil
+}
+
+// EscapeNamePath applies EscapeNameComponent to each slash-separated component of a relative path
+func EscapeNamePath(path string) string {
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		parts[i] = EscapeNameComponent(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// UnescapeNamePath reverses EscapeNamePath
+func UnescapeNamePath(path string) (string, error) {
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		unescaped, err := UnescapeNameComponent(part)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = unescaped
+	}
+	return strings.Join(parts, "/"), nil
+}
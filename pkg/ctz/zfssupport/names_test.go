@@ -0,0 +1,45 @@
+package zfssupport
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestEscapeNameComponent(t *testing.T) {
+	cases := map[string]string{
+		"vm-100-disk-0": "vm-100-disk-0",
+		"My_Image.v2":   "My_Image.v2",
+		"disk@1":        "disk:401",
+		"50%":           "50:25",
+		"a b":           "a:20b",
+		"already:colon": "already:3acolon",
+		".":             ":2e",
+		"..":            ":2e.",
+		"..a":           "..a",
+		"ümlaut":        ":c3:bcmlaut",
+		"":              "",
+	}
+	for in, expected := range cases {
+		escaped := EscapeNameComponent(in)
+		assert.Equal(t, expected, escaped, "escaping '%v'", in)
+		unescaped, err := UnescapeNameComponent(escaped)
+		require.NoError(t, err)
+		assert.Equal(t, in, unescaped, "round trip of '%v'", in)
+	}
+}
+
+func TestUnescapeNameComponentInvalid(t *testing.T) {
+	_, err := UnescapeNameComponent("foo:4")
+	assert.Error(t, err)
+	_, err = UnescapeNameComponent("foo:zz")
+	assert.Error(t, err)
+}
+
+func TestEscapeNamePath(t *testing.T) {
+	escaped := EscapeNamePath("my ns/disk@1")
+	assert.Equal(t, "my:20ns/disk:401", escaped)
+	unescaped, err := UnescapeNamePath(escaped)
+	require.NoError(t, err)
+	assert.Equal(t, "my ns/disk@1", unescaped)
+}
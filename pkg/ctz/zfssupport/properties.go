@@ -0,0 +1,111 @@
+package zfssupport
+
+import (
+	"fmt"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/models"
+	"github.com/mattventura/ceph-to-zfs/pkg/ctz/util"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// PropertyDrift is a property of an existing zvol which does not have the configured value
+type PropertyDrift struct {
+	Property string `json:"property"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// propertyMatches compares a configured property value with the value reported by "zfs get -p"
+func propertyMatches(property string, expected string, actual string) bool {
+	if expected == actual {
+		return true
+	}
+	switch property {
+	case "volblocksize":
+		e, err1 := util.ParseSize(expected)
+		a, err2 := util.ParseSize(actual)
+		return err1 == nil && err2 == nil && e == a
+	case "encryption":
+		// "on" means the default algorithm, which is reported as the algorithm name
+		return expected == "on" && actual != "off"
+	}
+	return false
+}
+
+// GetProperties gets several properties of the zvol with a single zfs command. Unset user properties have the value
+// "-".
+func (z *ZvolDestination) GetProperties(properties []string) (map[string]string, error) {
+	args := []string{
+		"get",
+		"-p",                   // parseable values
+		"-H",                   // omit header
+		"-o", "property,value", // property name and value only
+		strings.Join(properties, ","),
+		z.dataset.Name,
+	}
+	output, err := exec.Command("zfs", args...).Output()
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSuffix(string(output), "\n"), "\n") {
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		out[parts[0]] = parts[1]
+	}
+	return out, nil
+}
+
+// PropertyDrift compares the zvol's properties with the expected values, and returns those which differ, sorted by
+// property name.
+func (z *ZvolDestination) PropertyDrift(expected map[string]string) ([]PropertyDrift, error) {
+	if len(expected) == 0 {
+		return nil, nil
+	}
+	names := make([]string, 0, len(expected))
+	for name := range expected {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	actual, err := z.GetProperties(names)
+	if err != nil {
+		return nil, err
+	}
+	var out []PropertyDrift
+	for _, name := range names {
+		if !propertyMatches(name, expected[name], actual[name]) {
+			out = append(out, PropertyDrift{Property: name, Expected: expected[name], Actual: actual[name]})
+		}
+	}
+	return out, nil
+}
+
+// SpaceUsage fills in the ZFS side of a models.SpaceUsage
+func (z *ZvolDestination) SpaceUsage(usage *models.SpaceUsage) error {
+	props, err := z.GetProperties([]string{"used", "usedbysnapshots", "referenced", "logicalused", "compressratio"})
+	if err != nil {
+		return err
+	}
+	sizes := map[string]*uint64{
+		"used":            &usage.Used,
+		"usedbysnapshots": &usage.UsedBySnapshots,
+		"referenced":      &usage.Referenced,
+		"logicalused":     &usage.LogicalUsed,
+	}
+	for name, dest := range sizes {
+		*dest, err = strconv.ParseUint(props[name], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid value '%v' for %v", props[name], name)
+		}
+	}
+	// Depending on the ZFS version, this may or may not have a trailing "x" even with -p
+	usage.CompressRatio, err = strconv.ParseFloat(strings.TrimSuffix(props["compressratio"], "x"), 64)
+	if err != nil {
+		return fmt.Errorf("invalid value '%v' for compressratio", props["compressratio"])
+	}
+	return nil
+}
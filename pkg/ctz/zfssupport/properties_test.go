@@ -0,0 +1,16 @@
+package zfssupport
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPropertyMatches(t *testing.T) {
+	assert.True(t, propertyMatches("compression", "lz4", "lz4"))
+	assert.False(t, propertyMatches("compression", "lz4", "zstd"))
+	assert.True(t, propertyMatches("volblocksize", "16K", "16384"))
+	assert.False(t, propertyMatches("volblocksize", "16K", "8192"))
+	assert.True(t, propertyMatches("encryption", "on", "aes-256-gcm"))
+	assert.False(t, propertyMatches("encryption", "on", "off"))
+	assert.False(t, propertyMatches("ctz:foo", "bar", "-"))
+}
@@ -0,0 +1,95 @@
+package zfssupport
+
+import (
+	"github.com/mistifyio/go-zfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestParseSnapshotList(t *testing.T) {
+	output := "tank/backups/vm-1@ctz-2024-05-06-07:08:09\t1714979289\t1234567890123\t0\t4096\t1048576\t-\n" +
+		"tank/backups/vm-1@manual\t1714990000\t42\t1\t0\t8192\t2024-06-01\n"
+	snaps, err := parseSnapshotList(output, []string{"ctz:test"})
+	require.NoError(t, err)
+	require.Len(t, snaps, 2)
+
+	first := snaps[0]
+	assert.Equal(t, "ctz-2024-05-06-07:08:09", first.Name())
+	assert.Equal(t, time.Unix(1714979289, 0), first.When())
+	assert.Equal(t, uint64(1234567890123), first.Guid)
+	assert.Equal(t, uint64(0), first.UserRefs)
+	assert.Equal(t, uint64(4096), first.Used)
+	assert.Equal(t, uint64(1048576), first.Written)
+	assert.Equal(t, "", first.UserProperty("ctz:test"))
+	assert.Equal(t, "tank/backups/vm-1@ctz-2024-05-06-07:08:09", first.Dataset().Name)
+	assert.Equal(t, zfs.DatasetSnapshot, first.Dataset().Type)
+
+	second := snaps[1]
+	assert.Equal(t, "manual", second.Name())
+	assert.Equal(t, uint64(1), second.UserRefs)
+	assert.Equal(t, "2024-06-01", second.UserProperty("ctz:test"))
+}
+
+func TestParseSnapshotListInvalid(t *testing.T) {
+	_, err := parseSnapshotList("tank/backups/vm-1@snap\t123\n", nil)
+	assert.Error(t, err)
+	_, err = parseSnapshotList("tank/backups/vm-1\t1\t2\t3\t4\t5\n", nil)
+	assert.Error(t, err)
+	_, err = parseSnapshotList("tank/backups/vm-1@snap\tabc\t2\t3\t4\t5\n", nil)
+	assert.Error(t, err)
+}
+
+func TestZvolSnapshotPruneAfter(t *testing.T) {
+	output := "tank/backups/vm-1@a\t1714979289\t1\t0\t0\t0\t-\t-\n" +
+		"tank/backups/vm-1@b\t1714979289\t2\t0\t0\t0\t1715000000\t-\n" +
+		"tank/backups/vm-1@c\t1714979289\t3\t0\t0\t0\tgarbage\t1715000000\n"
+	snaps, err := parseSnapshotList(output, snapshotUserProperties)
+	require.NoError(t, err)
+	require.Len(t, snaps, 3)
+	assert.True(t, snaps[0].PruneAfter().IsZero())
+	assert.Equal(t, time.Unix(1715000000, 0), snaps[1].PruneAfter())
+	assert.True(t, snaps[2].PruneAfter().IsZero())
+
+	snaps[1].setUserProperty(PruneAfterProperty, "")
+	assert.True(t, snaps[1].PruneAfter().IsZero())
+
+	assert.False(t, snaps[0].Kept())
+	assert.True(t, snaps[2].Kept())
+}
+
+func TestParseHolds(t *testing.T) {
+	output := "tank/backups/vm-1@a\tctz-Backup_VMs\tMon Jun  3 12:00 2024\n" +
+		"tank/backups/vm-1@a\tzrepl_last_received\tMon Jun  3 12:00 2024\n" +
+		"tank/backups/vm-1@b\tctz-Other\tMon Jun  3 13:00 2024\n"
+	holds, err := parseHolds(output)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"a": {"ctz-Backup_VMs", "zrepl_last_received"},
+		"b": {"ctz-Other"},
+	}, holds)
+
+	_, err = parseHolds("tank/backups/vm-1\tctz-Backup_VMs\tMon Jun  3 12:00 2024\n")
+	assert.Error(t, err)
+	_, err = parseHolds("tank/backups/vm-1@a\n")
+	assert.Error(t, err)
+}
+
+func TestZvolSnapshotInUseReason(t *testing.T) {
+	snap := NewZvolSnapshot("a", time.Unix(1, 0), 0)
+	assert.Equal(t, "", snap.InUseReason())
+	snap.UserRefs = 2
+	assert.Equal(t, "has 2 hold(s)", snap.InUseReason())
+	snap.setUserProperty(KeepProperty, "1715000000")
+	assert.Equal(t, "released from quarantine", snap.InUseReason())
+}
+
+func TestParseVolumeList(t *testing.T) {
+	output := "tank/backups/vm-1\ntank/backups/ns/vm-2\ntank/backupsx/vm-3\n"
+	volumes := parseVolumeList(output, "tank/backups")
+	require.Len(t, volumes, 2)
+	assert.Equal(t, "tank/backups/vm-1", volumes["vm-1"].Name())
+	assert.Equal(t, "tank/backups/ns/vm-2", volumes["ns/vm-2"].Name())
+	assert.Empty(t, parseVolumeList("", "tank/backups"))
+}